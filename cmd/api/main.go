@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/RadekPudelko/relay/internal/database"
@@ -53,10 +58,15 @@ func run() error {
 	if particleToken == "" {
 		log.Fatalf("run: missing PARTICLE_TOKEN in .env file")
 	}
-	particle, err := particle.NewParticle(particleToken)
+	particleAPI, err := particle.NewParticle(particleToken)
 	if err != nil {
 		log.Fatalf("run: %+v", err)
 	}
+	limits := myConfig.RateLimits
+	rateLimited := particle.NewRateLimited(particleAPI,
+		particle.Rate{PerSecond: limits.PingsPerSecond, Burst: limits.PingBurst},
+		particle.Rate{PerSecond: limits.FunctionsPerSecond, Burst: limits.FunctionBurst},
+		time.Duration(limits.DeviceSpacingMs)*time.Millisecond)
 
 	dbConn, err := database.Setup(myConfig.Database.Filename, true)
 	if err != nil {
@@ -64,7 +74,40 @@ func run() error {
 	}
 	defer dbConn.Close()
 
-	go server.BackgroundTask(myConfig, dbConn, particle)
-	err = server.Run(dbConn, myConfig.Server.Host, fmt.Sprintf("%d",myConfig.Server.Port))
-	return nil
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	wakeup := server.NewWakeup()
+	backgroundDone := make(chan struct{})
+	go func() {
+		server.BackgroundTask(ctx, myConfig, dbConn, rateLimited, wakeup)
+		close(backgroundDone)
+	}()
+
+	// Other goroutines which write to the db, waited for before it is closed
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		server.RunWebhookDispatcher(ctx, myConfig, dbConn)
+	}()
+	if myConfig.DeviceEvents.Enabled {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			server.SubscribeDeviceStatus(ctx, myConfig, dbConn, particleToken, wakeup)
+		}()
+	}
+
+	err = server.Run(ctx, myConfig, dbConn, wakeup)
+	if err != nil {
+		log.Printf("run: %+v", err)
+		stop()
+	}
+
+	// Let the relays in flight drain before the db is closed
+	<-backgroundDone
+	workers.Wait()
+	log.Printf("run: shutdown complete")
+	return err
 }
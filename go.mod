@@ -7,4 +7,4 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.22
 )
 
-require github.com/pelletier/go-toml v1.9.5 // indirect
+require github.com/pelletier/go-toml v1.9.5
@@ -10,6 +10,11 @@ type Config struct {
     Server ServerConfig `toml:"server"`
     Database DatabaseConfig `toml:"database"`
     Settings SettingsConfig `toml:"settings"`
+    RetryPolicies map[string]RetryPolicyConfig `toml:"retry_policies"`
+    RateLimits RateLimitConfig `toml:"rate_limits"`
+    DeviceEvents DeviceEventsConfig `toml:"device_events"`
+    Webhooks WebhooksConfig `toml:"webhooks"`
+    Events EventsConfig `toml:"events"`
 }
 
 type ServerConfig struct {
@@ -27,6 +32,93 @@ type SettingsConfig struct {
     CFRetrySeconds    int `toml:"cf_retry_seconds"`
     RelayLimit        int `toml:"relay_limit"`
     MaxRetries        int `toml:"max_retries"`
+    MaxSleepSeconds   int `toml:"max_sleep_seconds"`
+    ShutdownGraceSeconds int `toml:"shutdown_grace_seconds"`
+    LeaseSeconds      int `toml:"lease_seconds"`
+    ExpiredLeasePolicy string `toml:"expired_lease_policy"` // retry, fail or review
+    InstanceId        string `toml:"instance_id"`
+    OnlineFreshnessSeconds int `toml:"online_freshness_seconds"` // A device is pinged again once it was last seen online this long ago
+    IdempotencyKeySeconds int `toml:"idempotency_key_seconds"` // How long a relay creation request's idempotency key is kept
+}
+
+// Limits on calls to the Particle API, calls over the limit wait their turn. A rate of 0 is unlimited.
+type RateLimitConfig struct {
+    PingsPerSecond     float64 `toml:"pings_per_second"`
+    PingBurst          int     `toml:"ping_burst"`
+    FunctionsPerSecond float64 `toml:"functions_per_second"`
+    FunctionBurst      int     `toml:"function_burst"`
+    DeviceSpacingMs    int     `toml:"device_spacing_ms"` // Min time between calls to the same device
+}
+
+// Subscribes to Particle's spark/status events so that relays run as soon as their device comes online,
+// instead of waiting for the next ping
+type DeviceEventsConfig struct {
+    Enabled                 bool   `toml:"enabled"`
+    Url                     string `toml:"url"`
+    ReconnectInitialSeconds int    `toml:"reconnect_initial_seconds"` // Reconnect delays double from initial up to max
+    ReconnectMaxSeconds     int    `toml:"reconnect_max_seconds"`
+}
+
+// Delivery of relay events to webhook subscriptions and callback urls
+type WebhooksConfig struct {
+    Secret         string        `toml:"secret"`          // Signs deliveries to callback urls, which may only be used if it is set
+    PollSeconds    int           `toml:"poll_seconds"`    // How often new events and due deliveries are looked for
+    TimeoutSeconds int           `toml:"timeout_seconds"` // Max time to wait for a receiver to answer
+    Retry          BackoffConfig `toml:"retry"`           // Delays between attempts of a failed delivery
+}
+
+// The /api/events stream of relay and device events
+type EventsConfig struct {
+    PollMs           int `toml:"poll_ms"`           // How often streams look for new events
+    HeartbeatSeconds int `toml:"heartbeat_seconds"` // Idle streams send a comment this often so proxies keep them open
+    RetentionSeconds int `toml:"retention_seconds"` // How long events are kept for clients resuming with Last-Event-ID
+}
+
+// Name of the retry policy used by relays which don't pick one
+const DefaultRetryPolicy = "default"
+
+// How to retry a relay, kept separately for when the device is offline and when the cloud function call fails
+type RetryPolicyConfig struct {
+    Ping          BackoffConfig `toml:"ping"`
+    CloudFunction BackoffConfig `toml:"cloud_function"`
+}
+
+// The delay before attempt n+1 is initial_delay_seconds * multiplier^(n-1), capped at max_delay_seconds,
+// then randomly spread by +-jitter (a fraction of the delay). A max_attempts of 0 retries forever.
+type BackoffConfig struct {
+    InitialDelaySeconds int     `toml:"initial_delay_seconds"`
+    Multiplier          float64 `toml:"multiplier"`
+    MaxDelaySeconds     int     `toml:"max_delay_seconds"`
+    Jitter              float64 `toml:"jitter"`
+    MaxAttempts         int     `toml:"max_attempts"`
+}
+
+// Looks up a retry policy by name, the empty name is the default policy.
+// Unless configured, the default policy retries at a fixed rate based on the settings.
+func (c *Config) RetryPolicy(name string) (RetryPolicyConfig, bool) {
+    if name == "" {
+        name = DefaultRetryPolicy
+    }
+    policy, ok := c.RetryPolicies[name]
+    if ok {
+        return policy, true
+    }
+    if name != DefaultRetryPolicy {
+        return RetryPolicyConfig{}, false
+    }
+    return RetryPolicyConfig{
+        Ping: BackoffConfig{
+            InitialDelaySeconds: c.Settings.PingRetrySeconds,
+            Multiplier: 1,
+            MaxDelaySeconds: c.Settings.PingRetrySeconds,
+        },
+        CloudFunction: BackoffConfig{
+            InitialDelaySeconds: c.Settings.CFRetrySeconds,
+            Multiplier: 1,
+            MaxDelaySeconds: c.Settings.CFRetrySeconds,
+            MaxAttempts: c.Settings.MaxRetries,
+        },
+    }, true
 }
 
 func GetDefaultConfig() (Config) {
@@ -44,6 +136,33 @@ func GetDefaultConfig() (Config) {
             PingRetrySeconds: 60,
             CFRetrySeconds: 60,
             MaxRetries: 3,
+            MaxSleepSeconds: 60,
+            ShutdownGraceSeconds: 30,
+            LeaseSeconds: 300,
+            ExpiredLeasePolicy: "review",
+            OnlineFreshnessSeconds: 300,
+            IdempotencyKeySeconds: 86400,
+        },
+        DeviceEvents: DeviceEventsConfig{
+            Url: "https://api.particle.io/v1/devices/events/spark%2Fstatus",
+            ReconnectInitialSeconds: 1,
+            ReconnectMaxSeconds: 60,
+        },
+        Webhooks: WebhooksConfig{
+            PollSeconds: 1,
+            TimeoutSeconds: 10,
+            Retry: BackoffConfig{
+                InitialDelaySeconds: 10,
+                Multiplier: 2,
+                MaxDelaySeconds: 3600,
+                Jitter: 0.1,
+                MaxAttempts: 10,
+            },
+        },
+        Events: EventsConfig{
+            PollMs: 500,
+            HeartbeatSeconds: 15,
+            RetentionSeconds: 86400,
         },
     }
 }
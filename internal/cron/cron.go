@@ -0,0 +1,188 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A parsed 5 field cron expression: minute hour day-of-month month day-of-week
+// Fields support *, lists (1,2), ranges (1-5), steps (*/15, 1-30/5) and names for months (jan) and days (mon).
+// As in standard cron, when both day fields are restricted a day matches if either of them matches.
+type Schedule struct {
+	minutes  [60]bool
+	hours    [24]bool
+	days     [32]bool
+	months   [13]bool
+	weekdays [7]bool
+	// Whether the day of month or day of week field matches every value, ie * or */1
+	anyDay     bool
+	anyWeekday bool
+}
+
+type field struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField  = field{0, 59, nil}
+	hourField    = field{0, 23, nil}
+	dayField     = field{1, 31, nil}
+	monthField   = field{1, 12, map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}}
+	weekdayField = field{0, 7, map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+// Give up looking for the next occurrence after this many years, ie for 0 0 30 2 *
+const searchYears = 5
+
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron.Parse: want 5 fields, got %d in %q", len(fields), expr)
+	}
+
+	var s Schedule
+	var err error
+	if err = parseField(fields[0], minuteField, s.minutes[:]); err != nil {
+		return nil, fmt.Errorf("cron.Parse: minute: %w", err)
+	}
+	if err = parseField(fields[1], hourField, s.hours[:]); err != nil {
+		return nil, fmt.Errorf("cron.Parse: hour: %w", err)
+	}
+	if err = parseField(fields[2], dayField, s.days[:]); err != nil {
+		return nil, fmt.Errorf("cron.Parse: day of month: %w", err)
+	}
+	if err = parseField(fields[3], monthField, s.months[:]); err != nil {
+		return nil, fmt.Errorf("cron.Parse: month: %w", err)
+	}
+	var weekdays [8]bool
+	if err = parseField(fields[4], weekdayField, weekdays[:]); err != nil {
+		return nil, fmt.Errorf("cron.Parse: day of week: %w", err)
+	}
+	// Both 0 and 7 are sunday
+	copy(s.weekdays[:], weekdays[:7])
+	s.weekdays[0] = s.weekdays[0] || weekdays[7]
+
+	s.anyDay = all(s.days[dayField.min:])
+	s.anyWeekday = all(s.weekdays[:])
+	return &s, nil
+}
+
+func all(set []bool) bool {
+	for _, v := range set {
+		if !v {
+			return false
+		}
+	}
+	return true
+}
+
+// Sets the values matched by expr in set, which is indexed by value
+func parseField(expr string, f field, set []bool) error {
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepExpr)
+			if err != nil || step <= 0 {
+				return fmt.Errorf("invalid step %q", stepExpr)
+			}
+		}
+
+		start, end := f.min, f.max
+		if rangeExpr != "*" {
+			startExpr, endExpr, isRange := strings.Cut(rangeExpr, "-")
+			var err error
+			start, err = f.value(startExpr)
+			if err != nil {
+				return err
+			}
+			end = start
+			if isRange {
+				end, err = f.value(endExpr)
+				if err != nil {
+					return err
+				}
+			} else if hasStep {
+				// 5/15 means from 5 to the max every 15
+				end = f.max
+			}
+			if end < start {
+				return fmt.Errorf("invalid range %q", rangeExpr)
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+func (f field) value(expr string) (int, error) {
+	if v, ok := f.names[strings.ToLower(expr)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", expr)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	day := s.days[t.Day()]
+	weekday := s.weekdays[t.Weekday()]
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// Returns the first occurrence strictly after t, in t's location.
+// Returns the zero time if there is no occurrence in the next few years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	// Start from the next whole minute
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(searchYears, 0, 0)
+
+	for t.Before(end) {
+		if !s.months[t.Month()] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.hours[t.Hour()] {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			// Daylight saving time may repeat an hour, step over it
+			if !next.After(t) {
+				next = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			}
+			t = next
+			continue
+		}
+		if !s.minutes[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
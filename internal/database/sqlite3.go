@@ -9,7 +9,8 @@ import (
 
 // TODO: Add database operation retry logic
 func Setup(path string, walMode bool) (*sql.DB, error) {
-	path += "?cache=shared"
+	// Write transactions take the write lock up front, rather than failing to upgrade a read when another connection wrote
+	path += "?cache=shared&_txlock=immediate"
 
 	db, err := Connect(path)
 	if err != nil {
@@ -20,6 +20,362 @@ func CreateTables(db *sql.DB) error {
 	if err != nil {
 		return fmt.Errorf("SetupDatabase: %w", err)
 	}
+	err = CreateSchedulesTable(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	err = CreateRelayDependenciesTable(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	err = CreateRelayAttemptsTable(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	err = CreateIdempotencyKeysTable(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	err = CreateWebhooksTables(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	err = CreateEventsTable(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	err = MigrateTables(db)
+	if err != nil {
+		return fmt.Errorf("SetupDatabase: %w", err)
+	}
+	return nil
+}
+
+// Recurring relay definitions, each occurrence is materialized as a relay
+func CreateSchedulesTable(db *sql.DB) error {
+	const query string = `
+        CREATE TABLE IF NOT EXISTS schedules (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        device_key INTEGER NOT NULL,
+        cloud_function TEXT NOT NULL,
+        argument TEXT NOT NULL,
+        desired_return_code INTEGER NULL,
+        cron TEXT NOT NULL,
+        timezone TEXT NOT NULL,
+        overlap_policy TEXT NOT NULL,
+        retry_policy TEXT NOT NULL,
+        ttl_seconds INTEGER NULL,
+        paused INTEGER NOT NULL,
+        next_run_time DATETIME NULL,
+        last_relay_id INTEGER NULL,
+        FOREIGN KEY(device_key) REFERENCES devices(id)
+        )`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("CreateSchedulesTable: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// Parents which must complete before a relay runs
+func CreateRelayDependenciesTable(db *sql.DB) error {
+	const query string = `
+        CREATE TABLE IF NOT EXISTS relay_dependencies (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        relay_id INTEGER NOT NULL,
+        parent_id INTEGER NOT NULL,
+        UNIQUE(relay_id, parent_id),
+        FOREIGN KEY(relay_id) REFERENCES relays(id),
+        FOREIGN KEY(parent_id) REFERENCES relays(id)
+        )`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("CreateRelayDependenciesTable: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// Keys of relay creation requests, so that a repeated request returns the relay it created instead of a new one
+func CreateIdempotencyKeysTable(db *sql.DB) error {
+	const query string = `
+        CREATE TABLE IF NOT EXISTS idempotency_keys (
+        key TEXT PRIMARY KEY,
+        request_hash TEXT NOT NULL,
+        relay_id INTEGER NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(relay_id) REFERENCES relays(id)
+        )`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("CreateIdempotencyKeysTable: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// Webhook subscriptions, the relay events they are notified of and the outbox of deliveries.
+// Events are recorded by a trigger, in the same transaction as the status change, whichever code path or
+// instance makes it.
+func CreateWebhooksTables(db *sql.DB) error {
+	const eventsQuery string = `
+        CREATE TABLE IF NOT EXISTS relay_events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        relay_id INTEGER NOT NULL,
+        status INTEGER NOT NULL,
+        created_at DATETIME NOT NULL,
+        dispatched INTEGER NOT NULL DEFAULT 0,
+        FOREIGN KEY(relay_id) REFERENCES relays(id)
+        )`
+	_, err := db.Exec(eventsQuery)
+	if err != nil {
+		return fmt.Errorf("CreateWebhooksTables: db.Exec: %w", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS relay_events_dispatched ON relay_events(dispatched)`)
+	if err != nil {
+		return fmt.Errorf("CreateWebhooksTables: db.Exec: %w", err)
+	}
+
+	// Failed (1), complete (2), cancelled (3), expired (6) and superseded (7) are final
+	const triggerQuery string = `
+        CREATE TRIGGER IF NOT EXISTS relays_final_status
+        AFTER UPDATE OF status ON relays
+        WHEN NEW.status != OLD.status AND NEW.status IN (1, 2, 3, 6, 7)
+        BEGIN
+            INSERT INTO relay_events (relay_id, status, created_at)
+            VALUES (NEW.id, NEW.status, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+        END`
+	_, err = db.Exec(triggerQuery)
+	if err != nil {
+		return fmt.Errorf("CreateWebhooksTables: db.Exec: %w", err)
+	}
+
+	const webhooksQuery string = `
+        CREATE TABLE IF NOT EXISTS webhooks (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        relay_id INTEGER NULL,
+        events TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        FOREIGN KEY(relay_id) REFERENCES relays(id)
+        )`
+	_, err = db.Exec(webhooksQuery)
+	if err != nil {
+		return fmt.Errorf("CreateWebhooksTables: db.Exec: %w", err)
+	}
+
+	const deliveriesQuery string = `
+        CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        event_id INTEGER NOT NULL,
+        webhook_id INTEGER NULL,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        payload TEXT NOT NULL,
+        status TEXT NOT NULL,
+        attempts INTEGER NOT NULL,
+        next_attempt_at DATETIME NOT NULL,
+        last_status_code INTEGER NULL,
+        last_error TEXT NULL,
+        delivered_at DATETIME NULL,
+        FOREIGN KEY(event_id) REFERENCES relay_events(id)
+        )`
+	_, err = db.Exec(deliveriesQuery)
+	if err != nil {
+		return fmt.Errorf("CreateWebhooksTables: db.Exec: %w", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)`)
+	if err != nil {
+		return fmt.Errorf("CreateWebhooksTables: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// The sequence of relay and device events streamed by /api/events. Like the webhook events they are recorded
+// by triggers, so the id orders them across every instance sharing the database.
+func CreateEventsTable(db *sql.DB) error {
+	const query string = `
+        CREATE TABLE IF NOT EXISTS events (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        type TEXT NOT NULL,
+        device_id TEXT NOT NULL,
+        relay_id INTEGER NULL,
+        data TEXT NOT NULL,
+        created_at DATETIME NOT NULL
+        )`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("CreateEventsTable: db.Exec: %w", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS events_created_at ON events(created_at)`)
+	if err != nil {
+		return fmt.Errorf("CreateEventsTable: db.Exec: %w", err)
+	}
+
+	// Status names match models.RelayEventNames. A device comes online when it is seen online while it was
+	// not known to be, and goes offline when it is found offline while it was not known to be.
+	triggers := []string{`
+        CREATE TRIGGER IF NOT EXISTS relays_created_event
+        AFTER INSERT ON relays
+        BEGIN
+            INSERT INTO events (type, device_id, relay_id, data, created_at)
+            VALUES ('relay.created', (SELECT device_id FROM devices WHERE id = NEW.device_key), NEW.id,
+                json_object('cloud_function', NEW.cloud_function, 'scheduled_time', NEW.scheduled_time, 'status', NEW.status),
+                strftime('%Y-%m-%d %H:%M:%f', 'now'));
+        END`, `
+        CREATE TRIGGER IF NOT EXISTS relays_status_event
+        AFTER UPDATE OF status ON relays
+        WHEN NEW.status != OLD.status AND NEW.status IN (1, 2, 3, 6, 7)
+        BEGIN
+            INSERT INTO events (type, device_id, relay_id, data, created_at)
+            VALUES ('relay.' || CASE NEW.status
+                    WHEN 1 THEN 'failed' WHEN 2 THEN 'completed' WHEN 3 THEN 'cancelled'
+                    WHEN 6 THEN 'expired' ELSE 'superseded' END,
+                (SELECT device_id FROM devices WHERE id = NEW.device_key), NEW.id,
+                json_object('cloud_function', NEW.cloud_function, 'status', NEW.status),
+                strftime('%Y-%m-%d %H:%M:%f', 'now'));
+        END`, `
+        CREATE TRIGGER IF NOT EXISTS relay_attempts_event
+        AFTER INSERT ON relay_attempts
+        BEGIN
+            INSERT INTO events (type, device_id, relay_id, data, created_at)
+            VALUES ('relay.attempted',
+                (SELECT d.device_id FROM relays r JOIN devices d ON d.id = r.device_key WHERE r.id = NEW.relay_id), NEW.relay_id,
+                json_object('kind', NEW.kind, 'outcome', NEW.outcome, 'duration_ms', NEW.duration_ms),
+                strftime('%Y-%m-%d %H:%M:%f', 'now'));
+        END`, `
+        CREATE TRIGGER IF NOT EXISTS devices_online_event
+        AFTER UPDATE OF last_online ON devices
+        WHEN NEW.last_online IS NOT NULL AND (OLD.last_online IS NULL OR
+            (OLD.last_offline IS NOT NULL AND julianday(OLD.last_online) <= julianday(OLD.last_offline)))
+        BEGIN
+            INSERT INTO events (type, device_id, data, created_at)
+            VALUES ('device.online', NEW.device_id, json_object('last_online', NEW.last_online),
+                strftime('%Y-%m-%d %H:%M:%f', 'now'));
+        END`, `
+        CREATE TRIGGER IF NOT EXISTS devices_offline_event
+        AFTER UPDATE OF last_offline ON devices
+        WHEN NEW.last_offline IS NOT NULL AND NOT (OLD.last_offline IS NOT NULL AND
+            (OLD.last_online IS NULL OR julianday(OLD.last_online) <= julianday(OLD.last_offline)))
+        BEGIN
+            INSERT INTO events (type, device_id, data, created_at)
+            VALUES ('device.offline', NEW.device_id, json_object('last_offline', NEW.last_offline),
+                strftime('%Y-%m-%d %H:%M:%f', 'now'));
+        END`,
+	}
+	for _, trigger := range triggers {
+		_, err = db.Exec(trigger)
+		if err != nil {
+			return fmt.Errorf("CreateEventsTable: db.Exec: %w", err)
+		}
+	}
+	return nil
+}
+
+// History of the pings and cloud function calls made for each relay
+func CreateRelayAttemptsTable(db *sql.DB) error {
+	const query string = `
+        CREATE TABLE IF NOT EXISTS relay_attempts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        relay_id INTEGER NOT NULL,
+        kind TEXT NOT NULL,
+        started_at DATETIME NOT NULL,
+        duration_ms INTEGER NOT NULL,
+        http_status INTEGER NULL,
+        error_body TEXT NULL,
+        error TEXT NULL,
+        return_value INTEGER NULL,
+        outcome TEXT NOT NULL,
+        FOREIGN KEY(relay_id) REFERENCES relays(id)
+        )`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("CreateRelayAttemptsTable: db.Exec: %w", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS relay_attempts_relay_id ON relay_attempts(relay_id)`)
+	if err != nil {
+		return fmt.Errorf("CreateRelayAttemptsTable: db.Exec: %w", err)
+	}
+	return nil
+}
+
+type column struct {
+	name       string
+	definition string
+}
+
+// Columns added after a table was first released. They are added to existing databases by MigrateTables,
+// so new columns go at the end of the list. SQLite requires a default value for NOT NULL columns added this way.
+var relaysColumns = []column{
+	{"lease_owner", "TEXT NULL"},
+	{"lease_expires", "DATETIME NULL"},
+	{"retry_policy", "TEXT NOT NULL DEFAULT ''"},
+	{"pings", "INTEGER NOT NULL DEFAULT 0"},
+	{"expires_at", "DATETIME NULL"},
+	{"schedule_id", "INTEGER NULL"},
+	{"priority", "INTEGER NOT NULL DEFAULT 0"},
+	{"on_dependency_failure", "TEXT NOT NULL DEFAULT 'cancel'"},
+	{"success_conditions", "TEXT NOT NULL DEFAULT ''"},
+	{"max_tries", "INTEGER NULL"},
+	{"retry_of", "INTEGER NULL"},
+	{"version", "INTEGER NOT NULL DEFAULT 0"},
+	{"created_at", "DATETIME NULL"},
+	{"coalesce_key", "TEXT NULL"},
+	{"superseded_by", "INTEGER NULL"},
+	{"callback_url", "TEXT NULL"},
+}
+
+var devicesColumns = []column{
+	{"last_offline", "DATETIME NULL"},
+}
+
+func MigrateTables(db *sql.DB) error {
+	err := addColumns(db, "relays", relaysColumns)
+	if err != nil {
+		return fmt.Errorf("MigrateTables: %w", err)
+	}
+	err = addColumns(db, "devices", devicesColumns)
+	if err != nil {
+		return fmt.Errorf("MigrateTables: %w", err)
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS relays_coalesce_key ON relays(device_key, coalesce_key)`)
+	if err != nil {
+		return fmt.Errorf("MigrateTables: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// Adds the columns which are missing from the table
+func addColumns(db *sql.DB, table string, columns []column) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("addColumns: db.Query: %w", err)
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("addColumns: rows.Scan: %w", err)
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("addColumns: rows.Err: %w", err)
+	}
+
+	for _, column := range columns {
+		if existing[column.name] {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column.name, column.definition)
+		_, err := db.Exec(query)
+		if err != nil {
+			return fmt.Errorf("addColumns: db.Exec: %w on %s", err, query)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,125 @@
+package particle
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A spark/status event
+type DeviceStatusEvent struct {
+	DeviceId string
+	Online   bool
+	Time     time.Time
+}
+
+// Delays between reconnects, doubling from Initial up to Max while the stream keeps failing
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// Streams spark/status events from url to handle until ctx is done, reconnecting with backoff whenever the stream
+// drops or cannot be opened. Events are handled one at a time, in order.
+func SubscribeStatusEvents(ctx context.Context, url string, token string, backoff Backoff, handle func(DeviceStatusEvent)) {
+	delay := backoff.Initial
+	for ctx.Err() == nil {
+		connected, err := streamStatusEvents(ctx, url, token, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = backoff.Initial
+		}
+		log.Printf("SubscribeStatusEvents: %+v, reconnecting in %s\n", err, delay)
+		if sleep(ctx, delay) != nil {
+			return
+		}
+		delay = min(delay*2, backoff.Max)
+	}
+}
+
+// Reads events from a single connection until it ends. Returns whether the stream was opened.
+func streamStatusEvents(ctx context.Context, url string, token string, handle func(DeviceStatusEvent)) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return false, fmt.Errorf("streamStatusEvents: http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Accept", "text/event-stream")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("streamStatusEvents: client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("streamStatusEvents: status code: %d", resp.StatusCode)
+	}
+
+	// Events are blocks of "field: value" lines ended by a blank line, lines starting with : are keep alives
+	var name, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if name == "spark/status" && data != "" {
+				event, err := parseStatusEvent(data)
+				if err != nil {
+					log.Printf("streamStatusEvents: %+v\n", err)
+				} else {
+					handle(event)
+				}
+			}
+			name, data = "", ""
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, fmt.Errorf("streamStatusEvents: scanner.Err: %w", err)
+	}
+	return true, fmt.Errorf("streamStatusEvents: stream ended")
+}
+
+// data: {"data":"online","ttl":60,"published_at":"2024-05-14T20:17:32.897Z","coreid":"0123456789abcdef"}
+func parseStatusEvent(data string) (DeviceStatusEvent, error) {
+	type EventData struct {
+		Data        string    `json:"data"`
+		PublishedAt time.Time `json:"published_at"`
+		CoreId      string    `json:"coreid"`
+	}
+	var eventData EventData
+	err := json.Unmarshal([]byte(data), &eventData)
+	if err != nil {
+		return DeviceStatusEvent{}, fmt.Errorf("parseStatusEvent: json.Unmarshal: %w, data %s", err, data)
+	}
+	if eventData.CoreId == "" {
+		return DeviceStatusEvent{}, fmt.Errorf("parseStatusEvent: missing coreid in %s", data)
+	}
+
+	event := DeviceStatusEvent{DeviceId: eventData.CoreId, Time: eventData.PublishedAt.UTC()}
+	switch eventData.Data {
+	case "online":
+		event.Online = true
+	case "offline":
+		event.Online = false
+	default:
+		return DeviceStatusEvent{}, fmt.Errorf("parseStatusEvent: unknown status %s", eventData.Data)
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	return event, nil
+}
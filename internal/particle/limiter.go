@@ -0,0 +1,189 @@
+package particle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Returned when a call was given up before it was sent to Particle, or Particle refused it because its rate limit
+// was exceeded, so it certainly did not reach the device
+var ErrNotSent = errors.New("request was not sent")
+
+// How long calls are held back after Particle refused one without a Retry-After header
+const defaultRetryAfter = time.Second
+
+// A token bucket rate, a PerSecond of 0 or less is unlimited. Burst is the number of calls which may be made at once,
+// at least 1.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Wraps a ParticleAPI to keep calls within Particle's rate limits. Calls over the limit wait for their turn
+// instead of failing, until their context is done. If Particle still answers 429, the call fails with ErrNotSent
+// and the following calls wait for its Retry-After.
+type RateLimited struct {
+	api       ParticleAPI
+	pings     *tokenBucket
+	functions *tokenBucket
+	devices   *deviceLimiter
+}
+
+// Pings and cloud functions are limited separately, and calls to a single device are at least deviceSpacing apart
+func NewRateLimited(api ParticleAPI, pings Rate, functions Rate, deviceSpacing time.Duration) *RateLimited {
+	return &RateLimited{
+		api:       api,
+		pings:     newTokenBucket(pings),
+		functions: newTokenBucket(functions),
+		devices:   &deviceLimiter{spacing: deviceSpacing, next: make(map[string]time.Time)},
+	}
+}
+
+func (p *RateLimited) Ping(ctx context.Context, deviceId string) (bool, error) {
+	if err := p.wait(ctx, p.pings, deviceId); err != nil {
+		return false, fmt.Errorf("RateLimited.Ping: %w", err)
+	}
+	online, err := p.api.Ping(ctx, deviceId)
+	return online, p.refused(p.pings, err)
+}
+
+func (p *RateLimited) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
+	if err := p.wait(ctx, p.functions, deviceId); err != nil {
+		return 0, fmt.Errorf("RateLimited.CloudFunction: %w", err)
+	}
+	returnValue, err := p.api.CloudFunction(ctx, deviceId, cloudFunction, argument)
+	return returnValue, p.refused(p.functions, err)
+}
+
+// Marks a call Particle refused with 429 as not sent, and pauses the bucket for as long as Particle asked
+func (p *RateLimited) refused(bucket *tokenBucket, err error) error {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+		return err
+	}
+	retryAfter := apiErr.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+	bucket.pause(retryAfter)
+	return fmt.Errorf("%w: %w", ErrNotSent, err)
+}
+
+func (p *RateLimited) wait(ctx context.Context, bucket *tokenBucket, deviceId string) error {
+	if err := p.devices.wait(ctx, deviceId); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotSent, err)
+	}
+	if err := bucket.wait(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrNotSent, err)
+	}
+	return nil
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// No tokens are handed out until then
+	pausedUntil time.Time
+}
+
+func newTokenBucket(rate Rate) *tokenBucket {
+	burst := float64(max(rate.Burst, 1))
+	return &tokenBucket{rate: rate.PerSecond, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until := time.Now().Add(d); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// Takes a token, waiting until one is available or ctx is done
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		paused := time.Until(b.pausedUntil)
+		b.mu.Unlock()
+		if paused <= 0 {
+			break
+		}
+		if err := sleep(ctx, paused); err != nil {
+			return err
+		}
+	}
+	if b.rate <= 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Spaces out calls to each device
+type deviceLimiter struct {
+	mu      sync.Mutex
+	spacing time.Duration
+	// Earliest time of the next call to each device
+	next map[string]time.Time
+}
+
+// Reserves the device's next slot and waits for it, the slot is kept if ctx is done while waiting
+func (d *deviceLimiter) wait(ctx context.Context, deviceId string) error {
+	if d.spacing <= 0 {
+		return nil
+	}
+	d.mu.Lock()
+	now := time.Now()
+	at := now
+	if next, ok := d.next[deviceId]; ok && next.After(now) {
+		at = next
+	}
+	d.next[deviceId] = at.Add(d.spacing)
+	// Forget devices which have not been called for a while
+	if len(d.next) > 1000 {
+		for id, next := range d.next {
+			if next.Before(now) {
+				delete(d.next, id)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	return sleep(ctx, at.Sub(now))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
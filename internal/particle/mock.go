@@ -1,29 +1,55 @@
 package particle
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const DevicePingError = "|1"
 const DevicePingOffline = "|2"
 
-const DeviceCFError = 1
-const DeviceCFBadRV = 2
-const DeviceCFSuccess = 3
+// Answers pings, but its cloud functions time out
+const DeviceCFTimeout = "|3"
 
-type MockParticle struct{}
+// Cloud functions called with this argument fail
+const DeviceCFError = "error"
+
+type MockParticle struct {
+	// Latency added to every call
+	Latency time.Duration
+}
 
 func NewMock() MockParticle {
 	return MockParticle{}
 }
 
+// Waits for the mock latency, returns early with an error if ctx is cancelled
+func (p MockParticle) wait(ctx context.Context) error {
+	if p.Latency == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(p.Latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Return is decided by the last 2 letters of the device id
-func (p MockParticle) Ping(deviceId string) (bool, error) {
+func (p MockParticle) Ping(ctx context.Context, deviceId string) (bool, error) {
+	if err := p.wait(ctx); err != nil {
+		return false, fmt.Errorf("MockParticle.Ping: %w", err)
+	}
 	if len(deviceId) < 2 {
 		return true, nil
 	}
 
-	// TODO: add latency
 	// TODO: make this random instead
 	switch deviceId[len(deviceId)-2:] {
 	case DevicePingError:
@@ -35,19 +61,20 @@ func (p MockParticle) Ping(deviceId string) (bool, error) {
 	}
 }
 
-// Return is decided by the value returnValue
-func (p MockParticle) CloudFunction(deviceId string, cloudFunction string, argument string, returnValue *int) (bool, error) {
-	if returnValue == nil {
-		return true, nil
+// Returns the argument when it is a number, 0 otherwise
+func (p MockParticle) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
+	if err := p.wait(ctx); err != nil {
+		return 0, fmt.Errorf("MockParticle.CloudFunction: %w", err)
 	}
-	// TODO: add latency
-	// TODO: make this random instead
-	switch *returnValue {
-	case DeviceCFError:
-		return false, fmt.Errorf("MockParticle.CloudFunction: error")
-	case DeviceCFBadRV:
-		return false, nil
-	default: // good return value
-		return true, nil
+	if strings.HasSuffix(deviceId, DeviceCFTimeout) {
+		return 0, fmt.Errorf("MockParticle.CloudFunction: %w", ErrTimeout)
+	}
+	if argument == DeviceCFError {
+		return 0, fmt.Errorf("MockParticle.CloudFunction: error")
+	}
+	returnValue, err := strconv.Atoi(argument)
+	if err != nil {
+		return 0, nil
 	}
+	return returnValue, nil
 }
@@ -1,16 +1,49 @@
 package particle
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ParticleAPI interface {
-	Ping(deviceId string) (bool, error)
-	CloudFunction(deviceId string, cloudFunction string, argument string, returnValue *int) (bool, error)
+	Ping(ctx context.Context, deviceId string) (bool, error)
+	// Returns the value returned by the device's function
+	CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error)
+}
+
+// Returned by CloudFunction when the device did not answer in time, which usually means it is offline
+var ErrTimeout = errors.New("device timed out")
+
+// An error response from Particle
+type APIError struct {
+	StatusCode int
+	Body       string
+	// How long Particle asked to wait before calling again, from the Retry-After header of a 429 response
+	RetryAfter time.Duration
+}
+
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+	retryAfter := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(retryAfter); err == nil {
+		apiErr.RetryAfter = time.Until(at)
+	}
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("status code: %d, response body: %s", e.StatusCode, e.Body)
 }
 
 type Particle struct {
@@ -31,16 +64,16 @@ func NewParticle(token string) (*Particle, error) {
 // https://docs.particle.io/reference/cloud-apis/api/#errors
 // 408 is not actually used?
 
-func (p Particle) Ping(deviceId string) (bool, error) {
+func (p Particle) Ping(ctx context.Context, deviceId string) (bool, error) {
 	queryParams := url.Values{}
 	queryParams.Set("access_token", p.token)
 
 	url := fmt.Sprintf("https://api.particle.io/v1/devices/%s/ping", deviceId)
 	url += "?" + queryParams.Encode()
 
-	req, err := http.NewRequest("PUT", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, nil)
 	if err != nil {
-		return false, fmt.Errorf("particle.Ping: http.NewRequest: %w", err)
+		return false, fmt.Errorf("particle.Ping: http.NewRequestWithContext: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
@@ -59,7 +92,7 @@ func (p Particle) Ping(deviceId string) (bool, error) {
 	// TODO: handle device offline error code as none error
 	if resp.StatusCode != 200 {
 		// This isnt really any error
-		return false, fmt.Errorf("particle.Ping: status code: %d, response body: %s", resp.StatusCode, string(body))
+		return false, fmt.Errorf("particle.Ping: %w", newAPIError(resp, body))
 	}
 
 	type ResponseData struct {
@@ -75,29 +108,42 @@ func (p Particle) Ping(deviceId string) (bool, error) {
 	return response.Online, nil
 }
 
-func (p Particle) CloudFunction(deviceId string, cloudFunction string, argument string, returnValue *int) (bool, error) {
+func (p Particle) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
 	params := url.Values{}
 	params.Add("access_token", p.token)
 	params.Add("arg", argument)
 
 	url := fmt.Sprintf("https://api.particle.io/v1/devices/%s/%s", deviceId, cloudFunction)
 
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return 0, fmt.Errorf("particle.CloudFunction: http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
 	// This can block for a long time
-	resp, err := http.PostForm(url, params)
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("particle.CloudFunction: http.NewRequest: %w", err)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil {
+			return 0, fmt.Errorf("particle.CloudFunction: client.Do: %w: %w", ErrTimeout, err)
+		}
+		return 0, fmt.Errorf("particle.CloudFunction: client.Do: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return false, fmt.Errorf("particle.CloudFunction: io.ReadAll: %w,  body %s", err, body)
+		return 0, fmt.Errorf("particle.CloudFunction: io.ReadAll: %w,  body %s", err, body)
 	}
 
-	// TODO: Find a way to treat this differently?
-	if resp.StatusCode != 200 {
+	if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "Timed out") {
 		// time out response status code: 400, response body: {"ok":false,"error":"Timed out."}
-		return false, fmt.Errorf("particle.CloudFunction: status code: %d, response body: %s", resp.StatusCode, string(body))
+		return 0, fmt.Errorf("particle.CloudFunction: %w: %w", ErrTimeout, newAPIError(resp, body))
+	}
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("particle.CloudFunction: %w", newAPIError(resp, body))
 	}
 
 	type ResponseData struct {
@@ -109,10 +155,10 @@ func (p Particle) CloudFunction(deviceId string, cloudFunction string, argument
 	var data ResponseData
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		return false, fmt.Errorf("particle.Ping: json.Unmarshal: %w, body %s", err, body)
+		return 0, fmt.Errorf("particle.CloudFunction: json.Unmarshal: %w, body %s", err, body)
 	}
 
-	return true, nil
+	return data.ReturnValue, nil
 }
 
 // Makes a test request to particle to see if the token is valid, should get a 200 on a list device request
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func HandleGetRelayAttempts(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetRelayAttempts(dbConn, w, r)
+		},
+	)
+}
+
+func handleGetRelayAttempts(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	relayIdStr := r.PathValue("id")
+	relayId, err := strconv.Atoi(relayIdStr)
+	if err != nil {
+		log.Println("handleGetRelayAttempts: invalid relay id: ", relayIdStr)
+		http.Error(w, "Invalid relay id", http.StatusBadRequest)
+		return
+	}
+
+	relay, err := models.SelectRelay(dbConn, relayId)
+	if err != nil {
+		log.Println("handleGetRelayAttempts: ", err)
+		http.Error(w, "Error in getting relay", http.StatusInternalServerError)
+		return
+	}
+	if relay == nil {
+		msg := fmt.Sprintf("handleGetRelayAttempts: relay %d does not exist", relayId)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	attempts, err := models.SelectAttempts(dbConn, relayId)
+	if err != nil {
+		log.Println("handleGetRelayAttempts: ", err)
+		http.Error(w, "Error in getting attempts", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleGetRelayAttempts", attempts)
+}
+
+// Records a call to Particle in the relay's history, failing to do so does not affect the relay
+func recordAttempt(dbConn *sql.DB, relayId int, kind string, startedAt time.Time, outcome string, returnValue *int, callErr error) {
+	attempt := models.Attempt{
+		RelayId:     relayId,
+		Kind:        kind,
+		StartedAt:   startedAt.UTC(),
+		DurationMs:  time.Since(startedAt).Milliseconds(),
+		ReturnValue: returnValue,
+		Outcome:     outcome,
+	}
+	var apiErr *particle.APIError
+	if errors.As(callErr, &apiErr) {
+		attempt.HttpStatus = &apiErr.StatusCode
+		attempt.ErrorBody = &apiErr.Body
+	} else if callErr == nil {
+		// Particle answered
+		status := http.StatusOK
+		attempt.HttpStatus = &status
+	}
+	if callErr != nil {
+		msg := callErr.Error()
+		attempt.Error = &msg
+	}
+
+	_, err := models.InsertAttempt(dbConn, attempt)
+	if err != nil {
+		log.Printf("recordAttempt: relay id=%d, %+v\n", relayId, err)
+	}
+}
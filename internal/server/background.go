@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -12,23 +14,70 @@ import (
 	"github.com/RadekPudelko/relay/internal/config"
 )
 
-// TODO: make backgroundTask sleep when there are no relays, wake by new relay post?
+// Processes relays until ctx is cancelled. No new relays are loaded after that and the ones in flight
+// are given ShutdownGraceSeconds to finish before their particle calls are cancelled.
+// Relays are processed by a pool of MaxRoutines workers, which is refilled as soon as a worker is free.
 // TODO: reduce logs
-func BackgroundTask(config *config.Config, dbConn *sql.DB, particle particle.ParticleAPI) {
-	var sem = make(chan int, config.Settings.MaxRoutines)
-	lastRelayId := 0
+func BackgroundTask(ctx context.Context, config *config.Config, dbConn *sql.DB, particle particle.ParticleAPI, wakeup *Wakeup) {
+	// Relays in flight get their own context, so that they are not interrupted as soon as ctx is cancelled
+	workCtx, cancelWork := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelWork()
+
+	owner := InstanceId(config)
+	log.Printf("backgroundTask: running as instance %s\n", owner)
+	pool := startRelayPool(config.Settings.MaxRoutines, wakeup, func(job relayJob) {
+		processRelay(workCtx, config, dbConn, particle, owner, job.id, job.leaseExpires)
+	})
 	lastNRelays := -1
-	for true {
+	for ctx.Err() == nil {
 		err := ProcessCancellations(dbConn)
 		if err != nil {
 			// Fatal?
 			log.Fatal("backgroundTask: ", err)
 		}
 
-		// Get ready relays, starting from the lastRelayId, limited 1 per device
-		// This implementation does not care about the order of relays
-		// To take into account order, would first need to get list of devices with ready relays, then query the min for each
-		relayIds, err := GetReadyRelays(dbConn, lastRelayId, config.Settings.RelayLimit, time.Now().UTC())
+		// Also runs on startup, to deal with relays left running by a crash
+		_, err = RecoverExpiredLeases(config, dbConn, time.Now().UTC())
+		if err != nil {
+			log.Fatal("backgroundTask: ", err)
+		}
+
+		_, err = ExpireRelays(dbConn, time.Now().UTC())
+		if err != nil {
+			log.Fatal("backgroundTask: ", err)
+		}
+
+		_, err = MaterializeSchedules(dbConn, time.Now().UTC())
+		if err != nil {
+			log.Fatal("backgroundTask: ", err)
+		}
+
+		_, err = CancelDependents(dbConn)
+		if err != nil {
+			log.Fatal("backgroundTask: ", err)
+		}
+
+		_, err = PruneIdempotencyKeys(config, dbConn, time.Now().UTC())
+		if err != nil {
+			log.Fatal("backgroundTask: ", err)
+		}
+
+		_, err = PruneEvents(config, dbConn, time.Now().UTC())
+		if err != nil {
+			log.Fatal("backgroundTask: ", err)
+		}
+
+		// All workers are busy, each one wakes the task once it is done
+		free := pool.free()
+		if free == 0 {
+			wakeup.Sleep(ctx, time.Duration(config.Settings.MaxSleepSeconds)*time.Second)
+			continue
+		}
+
+		// Get ready relays for the free workers, limited 1 per device, highest priority first.
+		// Relays in flight are running, so neither they nor other relays of their devices are loaded again
+		limit := min(free, config.Settings.RelayLimit)
+		relayIds, err := GetReadyRelays(dbConn, 0, limit, time.Now().UTC())
 		if err != nil {
 			// Fatal?
 			log.Fatal("backgroundTask: ", err)
@@ -40,28 +89,95 @@ func BackgroundTask(config *config.Config, dbConn *sql.DB, particle particle.Par
 		}
 		lastNRelays = nRelays
 		if nRelays == 0 {
-			lastRelayId = 0
+			err = sleepUntilNextRelay(ctx, config, dbConn, wakeup)
+			if err != nil {
+				log.Fatal("backgroundTask: ", err)
+			}
 			continue
 		}
-		lastRelayId = relayIds[nRelays-1]
 
-		// TODO: Load additional requests in the background as relays are processed - need to be careful with this to ignore already loaded relays, otherwise may load already completed relays
-		i := 0
-		var wg sync.WaitGroup
 		for _, relayId := range relayIds {
-			sem <- 1
-			wg.Add(1)
-			go func(id int) {
-				processRelay(config, dbConn, particle, id)
-				<-sem
-				wg.Done()
-			}(relayId)
-			i++
+			if pool.isInFlight(relayId) {
+				continue
+			}
+			// Claimed right before it is processed, so that the lease is not spent waiting for a worker.
+			// Another instance sharing the database may have claimed the relay or another for the device first
+			leaseExpires := time.Now().Add(time.Duration(config.Settings.LeaseSeconds) * time.Second).UTC()
+			claimed, err := models.ClaimRelay(dbConn, relayId, owner, leaseExpires)
+			if err != nil {
+				log.Printf("backgroundTask: %+v\n", err)
+				continue
+			}
+			if claimed {
+				pool.dispatch(relayJob{id: relayId, leaseExpires: leaseExpires})
+			}
 		}
+	}
+	pool.close()
+	waitForRelays(ctx, config, &pool.wg, cancelWork)
+	log.Println("backgroundTask: stopped")
+}
+
+// Waits for the relays in flight to finish. Once ctx is cancelled, they have ShutdownGraceSeconds
+// to finish before cancelWork is called to abort them.
+func waitForRelays(ctx context.Context, config *config.Config, wg *sync.WaitGroup, cancelWork context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
 		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	grace := time.Duration(config.Settings.ShutdownGraceSeconds) * time.Second
+	log.Printf("waitForRelays: shutting down, waiting up to %s for relays in flight\n", grace)
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Println("waitForRelays: grace period expired, cancelling relays in flight")
+		cancelWork()
+		<-done
 	}
 }
 
+// Sleeps until the earliest scheduled ready relay is due or expires, or a schedule is due, or until woken by a handler.
+// The sleep is capped by MaxSleepSeconds to pick up changes made outside of this process
+func sleepUntilNextRelay(ctx context.Context, config *config.Config, dbConn *sql.DB, wakeup *Wakeup) error {
+	sleep := time.Duration(config.Settings.MaxSleepSeconds) * time.Second
+	nextScheduled, err := models.SelectNextScheduledTime(dbConn, models.RelayReady)
+	if err != nil {
+		return fmt.Errorf("sleepUntilNextRelay: %w", err)
+	}
+	nextExpiry, err := models.SelectNextExpiry(dbConn, models.RelayReady)
+	if err != nil {
+		return fmt.Errorf("sleepUntilNextRelay: %w", err)
+	}
+	nextScheduleRun, err := models.SelectNextScheduleRunTime(dbConn)
+	if err != nil {
+		return fmt.Errorf("sleepUntilNextRelay: %w", err)
+	}
+	for _, next := range []*time.Time{nextScheduled, nextExpiry, nextScheduleRun} {
+		if next == nil {
+			continue
+		}
+		until := time.Until(*next)
+		if until < sleep {
+			sleep = until
+		}
+	}
+	if sleep <= 0 {
+		return nil
+	}
+	wakeup.Sleep(ctx, sleep)
+	return nil
+}
+
 func ProcessCancellations(dbConn *sql.DB) error {
 	// Handle cancellations 100 at a time until they are all processed
 	for {
@@ -73,10 +189,14 @@ func ProcessCancellations(dbConn *sql.DB) error {
 			return nil
 		}
 		for _, cancellation := range cancellations {
-			err := models.UpdateRelayStatus(dbConn, cancellation.RelayId, models.RelayCancelled)
+			// A relay which started running or finished since the cancellation was requested is left alone
+			cancelled, err := models.TransitionRelayStatus(dbConn, cancellation.RelayId, models.RelayReady, models.RelayCancelled)
 			if err != nil {
 				return fmt.Errorf("ProcessCancellations: %w on cancellation %+v", err, cancellation)
 			}
+			if !cancelled {
+				log.Printf("ProcessCancellations: relay %d is no longer ready, dropping cancellation\n", cancellation.RelayId)
+			}
 			err = models.DeleteCancellation(dbConn, cancellation.Id)
 			if err != nil {
 				return fmt.Errorf("ProcessCancellations: %w on cancellation %+v", err, cancellation)
@@ -85,55 +205,144 @@ func ProcessCancellations(dbConn *sql.DB) error {
 	}
 }
 
+// The relay must be claimed by owner, which marks it as running before the device is contacted,
+// so that a crash mid call leaves it to the expired lease policy instead of running it again
 // TODO: Update the schedule time of the relay if its been recently pinged and offline, ping fails or device is offile
-func processRelay(config *config.Config, dbConn *sql.DB, particle particle.ParticleAPI, id int) {
+func processRelay(ctx context.Context, config *config.Config, dbConn *sql.DB, particle particle.ParticleAPI, owner string, id int, leaseExpires time.Time) {
 	relay, err := models.SelectRelay(dbConn, id)
 	if err != nil {
 		log.Printf("processRelay: id=%d, %+v\n", id, err)
 		return
 	}
-	// Consider pinging a device if its been more than n seconds since last check
-	// TODO: define a config for how long a last ping is valid for
-	// TODO: update online time on good communication from cf
-	if relay.Device.LastOnline == nil {
-		// Only ping a device if we have not pinged in n seconds
+
+	if relay.ExpiresAt != nil && !time.Now().Before(*relay.ExpiresAt) {
+		log.Printf("processRelay: id=%d has expired\n", id)
+		err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayExpired, relay.Tries, relay.Pings)
+		if err != nil {
+			log.Printf("processRelay: id=%d, %+v\n", id, err)
+		}
+		return
+	}
+
+	policy := retryPolicy(config, relay.RetryPolicy)
+	if relay.MaxTries != nil {
+		policy.CloudFunction.MaxAttempts = *relay.MaxTries
+	}
+
+	// Particle calls may not outlive the lease
+	callCtx, cancel := context.WithDeadline(ctx, leaseExpires)
+	defer cancel()
+
+	// Ping the device unless it was seen online recently
+	freshness := time.Duration(config.Settings.OnlineFreshnessSeconds) * time.Second
+	if !relay.Device.IsOnline(time.Now(), freshness) {
 		log.Printf("processRelay: id=%d, pinging device %s\n", id, relay.Device.DeviceId)
-		online, err := particle.Ping(relay.Device.DeviceId)
+		pingedAt := time.Now()
+		online, err := particle.Ping(callCtx, relay.Device.DeviceId)
+		if isNotSent(err) {
+			// Refused by Particle's rate limit or cancelled while waiting on the rate limiter, the relay can safely be run again
+			log.Printf("processRelay: id=%d, %+v\n", id, err)
+			err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayReady, relay.Tries, relay.Pings)
+			if err != nil {
+				log.Printf("processRelay: id=%d, %+v\n", id, err)
+			}
+			return
+		}
+		if callCtx.Err() != nil {
+			// The cloud function has not been called, so the relay can safely be run again
+			log.Printf("processRelay: id=%d, cancelled while pinging device %s\n", id, relay.Device.DeviceId)
+			recordAttempt(dbConn, id, models.AttemptPing, pingedAt, models.AttemptCancelled, nil, err)
+			err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayReady, relay.Tries, relay.Pings)
+			if err != nil {
+				log.Printf("processRelay: id=%d, %+v\n", id, err)
+			}
+			return
+		}
 		if err != nil || !online {
 			if err != nil {
 				log.Printf("processRelay: %+v for relay id=%d, device %s \n", err, id, relay.Device.DeviceId)
+				recordAttempt(dbConn, id, models.AttemptPing, pingedAt, models.AttemptError, nil, err)
 			} else {
 				log.Printf("processRelay: id=%d, device %s is offline\n", id, relay.Device.DeviceId)
+				recordAttempt(dbConn, id, models.AttemptPing, pingedAt, models.AttemptOffline, nil, nil)
+				err = models.UpdateDeviceOffline(dbConn, relay.Device.Id, time.Now().UTC())
+				if err != nil {
+					log.Printf("processRelay: id=%d, %+v\n", id, err)
+				}
+			}
+			pings := relay.Pings + 1
+			if canRetry(policy.Ping, pings) {
+				later := time.Now().Add(backoffDelay(policy.Ping, pings)).UTC()
+				err = models.ReleaseRelay(dbConn, id, owner, later, models.RelayReady, relay.Tries, pings)
+			} else {
+				log.Printf("processRelay: id=%d has failed due to max offline pings\n", id)
+				err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayFailed, relay.Tries, pings)
 			}
-			later := time.Now().Add(time.Duration(config.Settings.PingRetrySeconds) * time.Second).UTC()
-			err = models.UpdateRelay(dbConn, id, later, relay.Status, relay.Tries)
 			if err != nil {
 				// TODO: This and many places like this should never fail, so should the server crash here??
 				log.Printf("processRelay: id=%d, %+v\n", id, err)
 			}
 			return
 		}
+		recordAttempt(dbConn, id, models.AttemptPing, pingedAt, models.AttemptOnline, nil, nil)
 		now := time.Now().UTC()
 		err = models.UpdateDevice(dbConn, relay.Device.Id, &now)
 		if err != nil {
+			// The cloud function has not been called, so the relay can safely be run again
 			log.Printf("processRelay: relay id=%d, %+v\n", id, err)
+			err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayReady, relay.Tries, relay.Pings)
+			if err != nil {
+				log.Printf("processRelay: id=%d, %+v\n", id, err)
+			}
 			return
 		}
 	}
 
 	log.Printf("processRelay: id=%d, device %s is online\n", id, relay.Device.DeviceId)
-	// TODO: may want to get return value from function
-	// TODO: may want to add some way to store error history in the database
-	success, err := particle.CloudFunction(relay.Device.DeviceId, relay.CloudFunction, relay.Argument, relay.DesiredReturnCode)
-	later := time.Now().Add(time.Duration(config.Settings.CFRetrySeconds) * time.Second).UTC()
+	calledAt := time.Now()
+	returnValue, err := particle.CloudFunction(callCtx, relay.Device.DeviceId, relay.CloudFunction, relay.Argument)
+	if isNotSent(err) {
+		// Refused by Particle's rate limit or cancelled while waiting on the rate limiter, the relay can safely be run again
+		log.Printf("processRelay: id=%d, %+v\n", id, err)
+		err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayReady, relay.Tries, relay.Pings)
+		if err != nil {
+			log.Printf("processRelay: id=%d, %+v\n", id, err)
+		}
+		return
+	}
+	if callCtx.Err() != nil {
+		// It is unknown whether the device ran the function, the relay keeps its lease
+		// and the expired lease policy decides what happens to it
+		log.Printf("processRelay: id=%d, cancelled while calling %s on device %s\n", id, relay.CloudFunction, relay.Device.DeviceId)
+		recordAttempt(dbConn, id, models.AttemptCloudFunction, calledAt, models.AttemptCancelled, nil, err)
+		return
+	}
+	// The device answered, or did not answer in time and is pinged before the next try
+	var deviceErr error
+	if err == nil {
+		now := time.Now().UTC()
+		deviceErr = models.UpdateDevice(dbConn, relay.Device.Id, &now)
+	} else if isTimeout(err) {
+		log.Printf("processRelay: id=%d, device %s timed out, marking it offline\n", id, relay.Device.DeviceId)
+		deviceErr = models.UpdateDeviceOffline(dbConn, relay.Device.Id, time.Now().UTC())
+	}
+	if deviceErr != nil {
+		log.Printf("processRelay: id=%d, %+v\n", id, deviceErr)
+	}
 	if err != nil {
 		log.Printf("processRelay: id=%d, tries=%d, %+v", id, relay.Tries, err)
-		if relay.Tries >= config.Settings.MaxRetries-1 { // start from 0
+		if isTimeout(err) {
+			recordAttempt(dbConn, id, models.AttemptCloudFunction, calledAt, models.AttemptTimeout, nil, err)
+		} else {
+			recordAttempt(dbConn, id, models.AttemptCloudFunction, calledAt, models.AttemptError, nil, err)
+		}
+		if !canRetry(policy.CloudFunction, relay.Tries+1) {
 			log.Printf("processRelay: id=%d has failed due to max failed tries\n", id)
-			err = models.UpdateRelay(dbConn, id, relay.ScheduledTime, models.RelayFailed, relay.Tries+1)
+			err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayFailed, relay.Tries+1, relay.Pings)
 		} else {
+			later := time.Now().Add(backoffDelay(policy.CloudFunction, relay.Tries+1)).UTC()
 			log.Printf("processRelay: id=%d has failed, try again at %s\n", id, later)
-			err = models.UpdateRelay(dbConn, id, later, models.RelayReady, relay.Tries+1)
+			err = models.ReleaseRelay(dbConn, id, owner, later, models.RelayReady, relay.Tries+1, relay.Pings)
 		}
 		if err != nil {
 			log.Printf("processRelay: relay=%d, %+v\n", id, err)
@@ -142,19 +351,35 @@ func processRelay(config *config.Config, dbConn *sql.DB, particle particle.Parti
 		return
 	}
 
-	if !success {
-		log.Printf("processRelay: id=%d has failed due to mismatch in returned code\n", id)
-		err = models.UpdateRelay(dbConn, id, relay.ScheduledTime, models.RelayFailed, relay.Tries+1)
+	if condition := relay.FailedCondition(returnValue); condition != nil {
+		recordAttempt(dbConn, id, models.AttemptCloudFunction, calledAt, models.AttemptMismatch, &returnValue, nil)
+		if condition.OnMismatch == models.MismatchRetry && canRetry(policy.CloudFunction, relay.Tries+1) {
+			later := time.Now().Add(backoffDelay(policy.CloudFunction, relay.Tries+1)).UTC()
+			log.Printf("processRelay: id=%d returned %d, try again at %s\n", id, returnValue, later)
+			err = models.ReleaseRelay(dbConn, id, owner, later, models.RelayReady, relay.Tries+1, relay.Pings)
+		} else {
+			log.Printf("processRelay: id=%d has failed due to mismatch in returned code %d\n", id, returnValue)
+			err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayFailed, relay.Tries+1, relay.Pings)
+		}
 	} else {
 		log.Printf("processRelay: id=%d, success\n", id)
-		err = models.UpdateRelay(dbConn, id, relay.ScheduledTime, models.RelayComplete, relay.Tries+1)
+		recordAttempt(dbConn, id, models.AttemptCloudFunction, calledAt, models.AttemptSuccess, &returnValue, nil)
+		err = models.ReleaseRelay(dbConn, id, owner, relay.ScheduledTime, models.RelayComplete, relay.Tries+1, relay.Pings)
 	}
 	if err != nil {
 		log.Printf("processRelay: relay=%d, %+v\n", id, err)
 	}
 }
 
-// Queries for upto limit relays in the db that are scheduled after scheduled time from id to id - 1 (inclusive)
+func isTimeout(err error) bool {
+	return errors.Is(err, particle.ErrTimeout)
+}
+
+func isNotSent(err error) bool {
+	return errors.Is(err, particle.ErrNotSent)
+}
+
+// Queries for upto limit relays in the db that are scheduled after scheduled time from id onward, highest priority first
 func GetReadyRelays(dbConn *sql.DB, id, limit int, scheduledTime time.Time) ([]int, error) {
 	relayIds, err := models.SelectRelayIds(dbConn, models.RelayReady, &id, nil, &limit, scheduledTime)
 	if err != nil {
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Cancels ready relays whose parent failed, was cancelled, expired or was superseded, unless they are to run regardless.
+// Cancellations cascade down to their own dependents. Returns the number of relays cancelled.
+func CancelDependents(dbConn *sql.DB) (int, error) {
+	nCancelled := 0
+	for {
+		relayIds, err := models.SelectRelaysWithFailedParents(dbConn, 100)
+		if err != nil {
+			return nCancelled, fmt.Errorf("CancelDependents: %w", err)
+		}
+		if len(relayIds) == 0 {
+			return nCancelled, nil
+		}
+		for _, relayId := range relayIds {
+			cancelled, err := models.TransitionRelayStatus(dbConn, relayId, models.RelayReady, models.RelayCancelled)
+			if err != nil {
+				return nCancelled, fmt.Errorf("CancelDependents: %w on relay %d", err, relayId)
+			}
+			if cancelled {
+				log.Printf("CancelDependents: relay %d cancelled, a relay it depends on did not complete\n", relayId)
+				nCancelled++
+			}
+		}
+	}
+}
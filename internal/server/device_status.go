@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Follows the spark/status event stream until ctx is done, keeping the devices table current
+func SubscribeDeviceStatus(ctx context.Context, config *config.Config, dbConn *sql.DB, token string, wakeup *Wakeup) {
+	settings := config.DeviceEvents
+	backoff := particle.Backoff{
+		Initial: time.Duration(settings.ReconnectInitialSeconds) * time.Second,
+		Max:     time.Duration(settings.ReconnectMaxSeconds) * time.Second,
+	}
+	particle.SubscribeStatusEvents(ctx, settings.Url, token, backoff, func(event particle.DeviceStatusEvent) {
+		err := HandleDeviceStatus(dbConn, event, wakeup)
+		if err != nil {
+			log.Printf("SubscribeDeviceStatus: %+v\n", err)
+		}
+	})
+}
+
+// Records the device as online or offline. When it comes online, the relays waiting to ping it again are
+// moved up to now and the background task is woken to run them.
+// Devices without any relays are not tracked.
+func HandleDeviceStatus(dbConn *sql.DB, event particle.DeviceStatusEvent, wakeup *Wakeup) error {
+	device, err := models.SelectDeviceByDeviceId(dbConn, event.DeviceId)
+	if err != nil {
+		return fmt.Errorf("HandleDeviceStatus: %w", err)
+	}
+	if device == nil {
+		return nil
+	}
+
+	if !event.Online {
+		err = models.UpdateDeviceOffline(dbConn, device.Id, event.Time)
+		if err != nil {
+			return fmt.Errorf("HandleDeviceStatus: %w", err)
+		}
+		return nil
+	}
+
+	err = models.UpdateDevice(dbConn, device.Id, &event.Time)
+	if err != nil {
+		return fmt.Errorf("HandleDeviceStatus: %w", err)
+	}
+	nRescheduled, err := models.RescheduleOfflineRelays(dbConn, device.Id, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("HandleDeviceStatus: %w", err)
+	}
+	if nRescheduled > 0 {
+		log.Printf("HandleDeviceStatus: device %s is online, rescheduled %d relays\n", event.DeviceId, nRescheduled)
+		wakeup.Signal()
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func HandleGetDevices(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetDevices(dbConn, w, r)
+		},
+	)
+}
+
+func HandleGetDevice(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetDevice(dbConn, w, r)
+		},
+	)
+}
+
+func HandleListDeviceRelays(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleListDeviceRelays(dbConn, w, r)
+		},
+	)
+}
+
+// Lists every device with its relay counts, ?pending=true lists only the devices with a backlog
+func handleGetDevices(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	onlyPending, _ := strconv.ParseBool(r.URL.Query().Get("pending"))
+	devices, err := models.SelectDeviceSummaries(dbConn, nil, onlyPending)
+	if err != nil {
+		log.Println("handleGetDevices: ", err)
+		http.Error(w, "Error in getting devices", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleGetDevices", devices)
+}
+
+func handleGetDevice(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	device, ok := deviceFromPath(dbConn, w, r, "handleGetDevice")
+	if !ok {
+		return
+	}
+
+	devices, err := models.SelectDeviceSummaries(dbConn, &device.Id, false)
+	if err != nil {
+		log.Println("handleGetDevice: ", err)
+		http.Error(w, "Error in getting device", http.StatusInternalServerError)
+		return
+	}
+	if len(devices) != 1 {
+		log.Printf("handleGetDevice: expected 1 device, got %d\n", len(devices))
+		http.Error(w, "Error in getting device", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleGetDevice", devices[0])
+}
+
+// Lists the device's relays, taking the same query parameters as GET /api/relays
+func handleListDeviceRelays(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	device, ok := deviceFromPath(dbConn, w, r, "handleListDeviceRelays")
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("device_id", device.DeviceId)
+	r.URL.RawQuery = query.Encode()
+	handleListRelays(dbConn, w, r)
+}
+
+// Looks up the device named in the url, writes the error response and returns false if it does not exist
+func deviceFromPath(dbConn *sql.DB, w http.ResponseWriter, r *http.Request, caller string) (*models.Device, bool) {
+	deviceId := r.PathValue("device_id")
+	device, err := models.SelectDeviceByDeviceId(dbConn, deviceId)
+	if err != nil {
+		log.Printf("%s: %+v\n", caller, err)
+		http.Error(w, "Error in getting device", http.StatusInternalServerError)
+		return nil, false
+	}
+	if device == nil {
+		msg := fmt.Sprintf("%s: device %s does not exist", caller, deviceId)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return nil, false
+	}
+	return device, true
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Most events read from the database per poll
+const eventsBatchSize = 100
+
+func HandleEvents(config *config.Config, dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleEvents(config, dbConn, w, r)
+		},
+	)
+}
+
+// Streams events as Server-Sent Events until the client disconnects. Without Last-Event-ID only events
+// recorded after the request are sent, with it the stream resumes after that event.
+func handleEvents(config *config.Config, dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseEventFilter(query)
+	if err != nil {
+		log.Println("handleEvents:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// EventSource sends the header when it reconnects, the query parameter is for clients which can't set headers
+	lastEventIdStr := r.Header.Get("Last-Event-ID")
+	if lastEventIdStr == "" {
+		lastEventIdStr = query.Get("last_event_id")
+	}
+	var lastEventId int
+	if lastEventIdStr != "" {
+		lastEventId, err = strconv.Atoi(lastEventIdStr)
+		if err != nil || lastEventId < 0 {
+			log.Printf("handleEvents: invalid last event id: %s\n", lastEventIdStr)
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		lastEventId, err = models.SelectLastEventId(dbConn)
+		if err != nil {
+			log.Println("handleEvents:", err)
+			http.Error(w, "Error in getting events", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	err = rc.Flush()
+	if err != nil {
+		log.Println("handleEvents: rc.Flush:", err)
+		return
+	}
+
+	poll := time.NewTicker(time.Duration(config.Events.PollMs) * time.Millisecond)
+	defer poll.Stop()
+	heartbeat := time.Duration(config.Events.HeartbeatSeconds) * time.Second
+	lastWrite := time.Now()
+	for {
+		events, err := models.SelectEvents(dbConn, lastEventId, filter, eventsBatchSize)
+		if err != nil {
+			log.Println("handleEvents:", err)
+			return
+		}
+		for _, event := range events {
+			err = writeEvent(w, event)
+			if err != nil {
+				log.Println("handleEvents:", err)
+				return
+			}
+			lastEventId = event.Id
+		}
+		if len(events) > 0 {
+			lastWrite = time.Now()
+		} else if heartbeat > 0 && time.Since(lastWrite) >= heartbeat {
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				log.Println("handleEvents: fmt.Fprint:", err)
+				return
+			}
+			lastWrite = time.Now()
+		}
+		err = rc.Flush()
+		if err != nil {
+			log.Println("handleEvents: rc.Flush:", err)
+			return
+		}
+
+		// Catch up without waiting while there is a backlog
+		if len(events) == eventsBatchSize {
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// Writes the event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, event models.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("writeEvent: json.Marshal: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	if err != nil {
+		return fmt.Errorf("writeEvent: fmt.Fprintf: %w", err)
+	}
+	return nil
+}
+
+func parseEventFilter(query url.Values) (models.EventFilter, error) {
+	var filter models.EventFilter
+	if deviceId := query.Get("device_id"); deviceId != "" {
+		filter.DeviceId = &deviceId
+	}
+	if relayIdStr := query.Get("relay_id"); relayIdStr != "" {
+		relayId, err := strconv.Atoi(relayIdStr)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid relay_id %s", relayIdStr)
+		}
+		filter.RelayId = &relayId
+	}
+	return filter, nil
+}
+
+// Deletes the events which are past the retention window, returns the number of events deleted
+func PruneEvents(config *config.Config, dbConn *sql.DB, now time.Time) (int, error) {
+	cutoff := now.Add(-time.Duration(config.Events.RetentionSeconds) * time.Second)
+	deleted, err := models.DeleteEvents(dbConn, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("PruneEvents: %w", err)
+	}
+	if deleted > 0 {
+		log.Printf("PruneEvents: deleted %d events\n", deleted)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Moves ready relays which expired at or before now to expired, without contacting their devices.
+// Returns the number of relays expired.
+func ExpireRelays(dbConn *sql.DB, now time.Time) (int, error) {
+	nExpired := 0
+	for {
+		relayIds, err := models.SelectExpiredRelays(dbConn, models.RelayReady, now, 100)
+		if err != nil {
+			return nExpired, fmt.Errorf("ExpireRelays: %w", err)
+		}
+		if len(relayIds) == 0 {
+			return nExpired, nil
+		}
+		for _, relayId := range relayIds {
+			// The relay may have been claimed in the meantime, it is expired by its instance instead
+			expired, err := models.TransitionRelayStatus(dbConn, relayId, models.RelayReady, models.RelayExpired)
+			if err != nil {
+				return nExpired, fmt.Errorf("ExpireRelays: %w on relay %d", err, relayId)
+			}
+			if expired {
+				log.Printf("ExpireRelays: relay %d expired\n", relayId)
+				nExpired++
+			}
+		}
+	}
+}
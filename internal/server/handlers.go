@@ -7,9 +7,11 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 
+	"github.com/RadekPudelko/relay/internal/config"
 	"github.com/RadekPudelko/relay/pkg/models"
 )
 
@@ -65,6 +67,16 @@ func handleGetRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// ?attempts=true includes the relay's attempt history
+	if withAttempts, _ := strconv.ParseBool(r.URL.Query().Get("attempts")); withAttempts {
+		relay.Attempts, err = models.SelectAttempts(dbConn, relayId)
+		if err != nil {
+			log.Println("handleGetRelay: ", err)
+			http.Error(w, "Error in getting attempts", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	jsonData, err := json.Marshal(relay)
 	if err != nil {
 		log.Println("handleGetRelay: json.Marshal: ", err)
@@ -77,23 +89,23 @@ func handleGetRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonData)
 }
 
-func HandleCreateRelay(dbConn *sql.DB) http.Handler {
+func HandleCreateRelay(config *config.Config, dbConn *sql.DB, wakeup *Wakeup) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			handleCreateRelay(dbConn, w, r)
+			handleCreateRelay(config, dbConn, wakeup, w, r)
 		},
 	)
 }
 
-func HandleCancelRelay(dbConn *sql.DB) http.Handler {
+func HandleCancelRelay(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			handleCancelRelay(dbConn, w, r)
+			handleCancelRelay(dbConn, wakeup, w, r)
 		},
 	)
 }
 
-func handleCancelRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+func handleCancelRelay(dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
 	relayIdStr := r.PathValue("id")
 	log.Println("sadf: ", relayIdStr)
 
@@ -125,11 +137,38 @@ func handleCancelRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Nothing runs a relay needing review, so it is cancelled right away instead of by the background task
+	if relay.Status == models.RelayNeedsReview {
+		cancelled, err := models.TransitionRelayStatus(dbConn, relayId, models.RelayNeedsReview, models.RelayCancelled)
+		if err != nil {
+			log.Printf("handleCancelRelay: %+v for relay=%d\n", err, relayId)
+			http.Error(w, "Error in cancelling relay", http.StatusInternalServerError)
+			return
+		}
+		if !cancelled {
+			log.Printf("handleCancelRelay: relay id=%d no longer needs review\n", relayId)
+			http.Error(w, fmt.Sprintf("Relay %d no longer needs review", relayId), http.StatusUnprocessableEntity)
+			return
+		}
+		// Its dependents can be cancelled or run
+		wakeup.Signal()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
 	if relay.Status != models.RelayReady {
 		log.Printf("handleCancelRelay: relay id=%d is not cancellatble, status=%d\n", relayId, relay.Status)
-		if relay.Status == models.RelayFailed {
+		switch relay.Status {
+		case models.RelayFailed:
 			http.Error(w, fmt.Sprintf("Relay %d has already failed", relayId), http.StatusUnprocessableEntity)
-		} else {
+		case models.RelayRunning:
+			http.Error(w, fmt.Sprintf("Relay %d is running", relayId), http.StatusUnprocessableEntity)
+		case models.RelayExpired:
+			http.Error(w, fmt.Sprintf("Relay %d has expired", relayId), http.StatusUnprocessableEntity)
+		case models.RelaySuperseded:
+			http.Error(w, fmt.Sprintf("Relay %d was superseded by relay %d", relayId, *relay.SupersededBy), http.StatusUnprocessableEntity)
+		default:
 			http.Error(w, fmt.Sprintf("Relay %d has already succeeded", relayId), http.StatusUnprocessableEntity)
 		}
 		return
@@ -139,19 +178,22 @@ func handleCancelRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("handleCancelRelay: %+v for relay=%d\n", err, relayId)
 		http.Error(w, fmt.Sprintf("Relay %d does not exist", relayId), http.StatusUnprocessableEntity)
+		return
 	}
 
 	if id == 0 {
 		log.Printf("handleCancelRelay: cancellation request already exists for relay=%d\n", relayId)
 		http.Error(w, fmt.Sprintf("Cancellation already exists for relay %d", relayId), http.StatusUnprocessableEntity)
+		return
 	}
+	wakeup.Signal()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 }
 
 // TODO: Want to add some sort of id to these logs so that I can know whats going on if there are multiple requests at once
-func handleCreateRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+func handleCreateRelay(config *config.Config, dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Println("handleCreateRelay: io.ReadAll:", err)
@@ -169,32 +211,86 @@ func handleCreateRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("handleCreateRelay: received request body: %s\n", req)
-	if req.DeviceId == "" || req.CloudFunction == "" {
-		log.Println("handleCreateRelay: Atleast one field in the post payload was blank or invalid")
-		http.Error(w, "device_id and cloud_function are required fields",
-			http.StatusUnprocessableEntity)
+	key, msg := idempotencyKey(r, req)
+	if msg != "" {
+		log.Println("handleCreateRelay:", msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	hash, err := requestHash(req)
+	if err != nil {
+		log.Println("handleCreateRelay:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// TODO: validate the scheduled time
-	scheduledTime := time.Now().UTC()
-	if req.ScheduledTime != nil {
-		scheduledTime = *req.ScheduledTime
-		scheduledTime = scheduledTime.UTC()
+	// The relay, its dependencies and its idempotency key are created together
+	tx, err := dbConn.Begin()
+	if err != nil {
+		log.Println("handleCreateRelay: dbConn.Begin:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	argument := ""
-	if req.Argument != nil {
-		argument = *req.Argument
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if key != "" {
+		relayId, msg, err := findIdempotentRelay(config, tx, key, hash, now)
+		if err != nil {
+			log.Println("handleCreateRelay:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			log.Println("handleCreateRelay:", msg)
+			http.Error(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		if relayId != 0 {
+			log.Printf("handleCreateRelay: repeated request with idempotency key %s, relay id: %d\n", key, relayId)
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, fmt.Sprintf("%d", relayId))
+			return
+		}
 	}
 
-	relayId, err := CreateRelay(dbConn, req.DeviceId, req.CloudFunction, argument, req.DesiredReturnCode, scheduledTime)
+	relay, msg, err := validateCreateRelay(config, tx, req)
+	if err != nil {
+		log.Println("handleCreateRelay:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		log.Println("handleCreateRelay:", msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+
+	relayId, err := CreateRelay(tx, relay.deviceId, relay.cloudFunction, relay.argument, relay.desiredReturnCode, relay.scheduledTime, relay.options)
 	if err != nil {
 		log.Println("handleCreateRelay:", err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if key != "" {
+		err = models.InsertIdempotencyKey(tx, models.IdempotencyKey{Key: key, RequestHash: hash, RelayId: relayId, CreatedAt: now})
+		if err != nil {
+			log.Println("handleCreateRelay:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Println("handleCreateRelay: tx.Commit:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	log.Printf("handleCreateRelay: new relay created, id: %d scheduled for %s\n", relayId, scheduledTime.String())
+	log.Printf("handleCreateRelay: new relay created, id: %d scheduled for %s\n", relayId, relay.scheduledTime.String())
+	wakeup.Signal()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -202,16 +298,143 @@ func handleCreateRelay(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, fmt.Sprintf("%d", relayId))
 }
 
-func CreateRelay(dbConn *sql.DB, deviceId string, cloudFunction string, argument string, desiredReturnCode *int, scheduledTime time.Time) (int, error) {
+// The arguments to CreateRelay of a validated CreateRelayRequest
+type relayParams struct {
+	deviceId          string
+	cloudFunction     string
+	argument          string
+	desiredReturnCode *int
+	scheduledTime     time.Time
+	options           models.RelayOptions
+}
+
+// Checks the request and fills in its defaults. Returns why the request is invalid, empty if it is valid.
+func validateCreateRelay(config *config.Config, db models.DBTX, req models.CreateRelayRequest) (relayParams, string, error) {
+	if req.DeviceId == "" || req.CloudFunction == "" {
+		return relayParams{}, "device_id and cloud_function are required fields", nil
+	}
+
+	relay := relayParams{
+		deviceId:          req.DeviceId,
+		cloudFunction:     req.CloudFunction,
+		desiredReturnCode: req.DesiredReturnCode,
+	}
+	// TODO: validate the scheduled time
+	relay.scheduledTime = time.Now().UTC()
+	if req.ScheduledTime != nil {
+		relay.scheduledTime = req.ScheduledTime.UTC()
+	}
+	if req.Argument != nil {
+		relay.argument = *req.Argument
+	}
+
+	options := &relay.options
+	if req.RetryPolicy != nil {
+		if _, ok := config.RetryPolicy(*req.RetryPolicy); !ok {
+			return relayParams{}, fmt.Sprintf("Unknown retry policy %s", *req.RetryPolicy), nil
+		}
+		options.RetryPolicy = *req.RetryPolicy
+	}
+
+	if req.Priority != nil {
+		options.Priority = *req.Priority
+	}
+
+	if req.OnDependencyFailure != nil {
+		if *req.OnDependencyFailure != models.DependencyFailureCancel && *req.OnDependencyFailure != models.DependencyFailureRun {
+			return relayParams{}, fmt.Sprintf("Unknown on_dependency_failure %s, must be cancel or run", *req.OnDependencyFailure), nil
+		}
+		options.OnDependencyFailure = *req.OnDependencyFailure
+	}
+	for i, parentId := range req.DependsOn {
+		if slices.Contains(req.DependsOn[:i], parentId) {
+			return relayParams{}, fmt.Sprintf("Relay %d is repeated in depends_on", parentId), nil
+		}
+		parent, err := models.SelectRelay(db, parentId)
+		if err != nil {
+			return relayParams{}, "", fmt.Errorf("validateCreateRelay: %w", err)
+		}
+		if parent == nil {
+			return relayParams{}, fmt.Sprintf("Relay %d in depends_on does not exist", parentId), nil
+		}
+	}
+	options.DependsOn = req.DependsOn
+
+	for i, condition := range req.SuccessConditions {
+		if err := condition.Validate(); err != nil {
+			return relayParams{}, fmt.Sprintf("Invalid success condition %d: %s", i, err), nil
+		}
+	}
+	options.SuccessConditions = req.SuccessConditions
+
+	if req.CoalesceKey != nil && *req.CoalesceKey == "" {
+		return relayParams{}, "coalesce_key may not be empty", nil
+	}
+	options.CoalesceKey = req.CoalesceKey
+
+	if req.CallbackUrl != nil {
+		if msg := validateWebhookUrl(*req.CallbackUrl); msg != "" {
+			return relayParams{}, "Invalid callback_url: " + msg, nil
+		}
+		if config.Webhooks.Secret == "" {
+			return relayParams{}, "callback_url requires a webhook secret in the config", nil
+		}
+	}
+	options.CallbackUrl = req.CallbackUrl
+
+	if req.ExpiresAt != nil && req.TtlSeconds != nil {
+		return relayParams{}, "Only one of expires_at and ttl_seconds may be set", nil
+	}
+	if req.ExpiresAt != nil {
+		expiresAt := req.ExpiresAt.UTC()
+		options.ExpiresAt = &expiresAt
+	} else if req.TtlSeconds != nil {
+		expiresAt := relay.scheduledTime.Add(time.Duration(*req.TtlSeconds) * time.Second)
+		options.ExpiresAt = &expiresAt
+	}
+	if options.ExpiresAt != nil && !options.ExpiresAt.After(relay.scheduledTime) {
+		return relayParams{}, "The relay must expire after its scheduled time", nil
+	}
+	return relay, "", nil
+}
+
+func CreateRelay(dbConn models.DBTX, deviceId string, cloudFunction string, argument string, desiredReturnCode *int, scheduledTime time.Time, options models.RelayOptions) (int, error) {
 	deviceKey, err := models.InsertOrUpdateDevice(dbConn, deviceId)
 	if err != nil {
 		return 0, fmt.Errorf("CreateRelay: %w", err)
 	}
 
-	relayId, err := models.InsertRelay(dbConn, deviceKey, cloudFunction, argument, desiredReturnCode, scheduledTime)
+	relayId, err := createDeviceRelay(dbConn, deviceKey, cloudFunction, argument, desiredReturnCode, scheduledTime, options)
 	if err != nil {
 		return 0, fmt.Errorf("CreateRelay: %w", err)
 	}
+	return relayId, nil
+}
+
+// Creates the relay and its dependencies for a device which is already in the devices table.
+// The relay supersedes the device's ready relays with its coalesce key.
+func createDeviceRelay(dbConn models.DBTX, deviceKey int, cloudFunction string, argument string, desiredReturnCode *int, scheduledTime time.Time, options models.RelayOptions) (int, error) {
+	relayId, err := models.InsertRelay(dbConn, deviceKey, cloudFunction, argument, desiredReturnCode, scheduledTime, options)
+	if err != nil {
+		return 0, fmt.Errorf("createDeviceRelay: %w", err)
+	}
+
+	if options.CoalesceKey != nil {
+		superseded, err := models.SupersedeRelays(dbConn, deviceKey, *options.CoalesceKey, relayId)
+		if err != nil {
+			return 0, fmt.Errorf("createDeviceRelay: %w", err)
+		}
+		if superseded > 0 {
+			log.Printf("createDeviceRelay: relay %d superseded %d relays with coalesce key %s\n", relayId, superseded, *options.CoalesceKey)
+		}
+	}
+
+	for _, parentId := range options.DependsOn {
+		err = models.InsertRelayDependency(dbConn, relayId, parentId)
+		if err != nil {
+			return 0, fmt.Errorf("createDeviceRelay: %w", err)
+		}
+	}
 
 	return relayId, nil
 }
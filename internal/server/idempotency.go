@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// Set on the response to a repeated request, which returns the relay created by the first one
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// Returns the request's idempotency key from the header or the client_request_id field, empty if there is none,
+// and why the key is invalid, empty if it is valid
+func idempotencyKey(r *http.Request, req models.CreateRelayRequest) (string, string) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if req.ClientRequestId != nil {
+		if key != "" && key != *req.ClientRequestId {
+			return "", fmt.Sprintf("The %s header and client_request_id differ", idempotencyKeyHeader)
+		}
+		key = *req.ClientRequestId
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Sprintf("Idempotency keys may be at most %d characters", maxIdempotencyKeyLength)
+	}
+	return key, ""
+}
+
+// Identifies the payload of a request, whether its key came from the header or the body
+func requestHash(req models.CreateRelayRequest) (string, error) {
+	req.ClientRequestId = nil
+	data, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("requestHash: json.Marshal: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Looks up the relay created by an earlier request with the key within the retention window. Returns its id, 0 if there
+// was no such request, and why the request is rejected if it reuses the key with another payload.
+func findIdempotentRelay(config *config.Config, db models.DBTX, key string, hash string, now time.Time) (int, string, error) {
+	existing, err := models.SelectIdempotencyKey(db, key)
+	if err != nil {
+		return 0, "", fmt.Errorf("findIdempotentRelay: %w", err)
+	}
+	if existing == nil || existing.CreatedAt.Before(idempotencyCutoff(config, now)) {
+		return 0, "", nil
+	}
+	if existing.RequestHash != hash {
+		return 0, fmt.Sprintf("Idempotency key %s was used by a request with another payload", key), nil
+	}
+	return existing.RelayId, "", nil
+}
+
+// Keys created before the cutoff are expired
+func idempotencyCutoff(config *config.Config, now time.Time) time.Time {
+	return now.Add(-time.Duration(config.Settings.IdempotencyKeySeconds) * time.Second)
+}
+
+// Deletes the idempotency keys which are past the retention window, returns the number of keys deleted
+func PruneIdempotencyKeys(config *config.Config, dbConn *sql.DB, now time.Time) (int, error) {
+	deleted, err := models.DeleteIdempotencyKeys(dbConn, idempotencyCutoff(config, now))
+	if err != nil {
+		return 0, fmt.Errorf("PruneIdempotencyKeys: %w", err)
+	}
+	if deleted > 0 {
+		log.Printf("PruneIdempotencyKeys: deleted %d expired keys\n", deleted)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/RadekPudelko/relay/internal/config"
+)
+
+// Identifies this instance as the holder of relay leases. Instances sharing a database must have
+// unique ids, which defaults to the hostname and pid when not configured
+func InstanceId(config *config.Config) string {
+	if config.Settings.InstanceId != "" {
+		return config.Settings.InstanceId
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Statuses of the relays which may be retried by hand
+var retryableStatuses = []models.RelayStatus{models.RelayFailed, models.RelayExpired, models.RelayCancelled, models.RelayNeedsReview}
+
+// Returned by RetryRelay when the relay is not failed, expired, cancelled or needing review
+var errNotRetryable = errors.New("relay is not failed, expired, cancelled or needing review")
+
+// Most relays retried by one bulk request, a filter matching more is rejected
+const maxBulkRetries = 1000
+
+func HandleRetryRelay(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleRetryRelay(dbConn, wakeup, w, r)
+		},
+	)
+}
+
+func HandleRetryRelays(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleRetryRelays(dbConn, wakeup, w, r)
+		},
+	)
+}
+
+func handleRetryRelay(dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	relayIdStr := r.PathValue("id")
+	relayId, err := strconv.Atoi(relayIdStr)
+	if err != nil {
+		log.Println("handleRetryRelay: invalid relay id: ", relayIdStr)
+		http.Error(w, "Invalid relay id", http.StatusBadRequest)
+		return
+	}
+
+	var req models.RetryRelayRequest
+	if !readOptionalJson(w, r, "handleRetryRelay", &req) {
+		return
+	}
+	if msg := validateRetry(req); msg != "" {
+		log.Printf("handleRetryRelay: %s\n", msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+
+	relay, err := models.SelectRelay(dbConn, relayId)
+	if err != nil {
+		log.Println("handleRetryRelay: ", err)
+		http.Error(w, "Error in getting relay", http.StatusInternalServerError)
+		return
+	}
+	if relay == nil {
+		log.Printf("handleRetryRelay: relay id=%d does not exist\n", relayId)
+		http.Error(w, fmt.Sprintf("Relay %d does not exist", relayId), http.StatusUnprocessableEntity)
+		return
+	}
+
+	retryId, err := RetryRelay(dbConn, relayId, req)
+	if errors.Is(err, errNotRetryable) {
+		log.Printf("handleRetryRelay: relay id=%d, %+v\n", relayId, err)
+		http.Error(w, fmt.Sprintf("Relay %d is not failed, expired, cancelled or needing review", relayId), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("handleRetryRelay: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("handleRetryRelay: relay %d retried as relay %d\n", relayId, retryId)
+	wakeup.Signal()
+	writeJson(w, "handleRetryRelay", models.RetryRelayResponse{RelayId: retryId})
+}
+
+func handleRetryRelays(dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	var req models.RetryRelaysRequest
+	if !readOptionalJson(w, r, "handleRetryRelays", &req) {
+		return
+	}
+	if msg := validateRetry(req.RetryRelayRequest); msg != "" {
+		log.Printf("handleRetryRelays: %s\n", msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	// An empty filter would retry every failed relay of every device
+	if req.RelayFilter.IsEmpty() {
+		log.Println("handleRetryRelays: empty filter")
+		http.Error(w, "The filter must set at least one of device_id, cloud_function, statuses or a time range", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(req.Statuses) == 0 {
+		req.Statuses = []models.RelayStatus{models.RelayFailed}
+	}
+	for _, status := range req.Statuses {
+		if !slices.Contains(retryableStatuses, status) {
+			log.Printf("handleRetryRelays: status %d is not retryable\n", status)
+			http.Error(w, fmt.Sprintf("Relays with status %d can not be retried", status), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	relayIds, err := models.SelectRelayIdsByFilter(dbConn, req.RelayFilter, maxBulkRetries+1)
+	if err != nil {
+		log.Println("handleRetryRelays: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(relayIds) > maxBulkRetries {
+		log.Printf("handleRetryRelays: more than %d relays match\n", maxBulkRetries)
+		http.Error(w, fmt.Sprintf("More than %d relays match the filter, narrow it down", maxBulkRetries), http.StatusUnprocessableEntity)
+		return
+	}
+
+	retryIds := []int{}
+	for _, relayId := range relayIds {
+		retryId, err := RetryRelay(dbConn, relayId, req.RetryRelayRequest)
+		if errors.Is(err, errNotRetryable) {
+			// Retried by someone else in the meantime
+			continue
+		}
+		if err != nil {
+			log.Println("handleRetryRelays: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		retryIds = append(retryIds, retryId)
+	}
+
+	log.Printf("handleRetryRelays: retried %d relays\n", len(retryIds))
+	if len(retryIds) > 0 {
+		wakeup.Signal()
+	}
+	writeJson(w, "handleRetryRelays", models.RetryRelaysResponse{RelayIds: retryIds})
+}
+
+// Returns why the request is invalid, empty if it is valid
+func validateRetry(req models.RetryRelayRequest) string {
+	if req.Mode != nil && *req.Mode != models.RetryReset && *req.Mode != models.RetryClone {
+		return fmt.Sprintf("Unknown mode %s, must be reset or clone", *req.Mode)
+	}
+	// 0 would mean unlimited attempts to the retry policy
+	if req.MaxTries != nil && *req.MaxTries < 1 {
+		return "max_tries must be at least 1"
+	}
+	return ""
+}
+
+// Decodes the request body into out unless it is empty, writes the error response and returns false on failure
+func readOptionalJson(w http.ResponseWriter, r *http.Request, caller string, out any) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("%s: io.ReadAll: %+v\n", caller, err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return false
+	}
+	if len(body) == 0 {
+		return true
+	}
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		log.Printf("%s: json.Unmarshal: %+v\n", caller, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Runs a failed, expired or cancelled relay, or one needing review, again, either by making it ready or by cloning it.
+// Returns the id of the relay which will run. Clones do not depend on the original's parents.
+func RetryRelay(dbConn *sql.DB, relayId int, req models.RetryRelayRequest) (int, error) {
+	scheduledTime := time.Now().UTC()
+	if req.ScheduledTime != nil {
+		scheduledTime = req.ScheduledTime.UTC()
+	}
+
+	if req.Mode == nil || *req.Mode == models.RetryReset {
+		reset, err := models.ResetRelay(dbConn, relayId, retryableStatuses, scheduledTime, req.MaxTries)
+		if err != nil {
+			return 0, fmt.Errorf("RetryRelay: %w", err)
+		}
+		if !reset {
+			return 0, fmt.Errorf("RetryRelay: relay %d: %w", relayId, errNotRetryable)
+		}
+		return relayId, nil
+	}
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("RetryRelay: dbConn.Begin: %w", err)
+	}
+	defer tx.Rollback()
+	relay, err := models.SelectRelay(tx, relayId)
+	if err != nil {
+		return 0, fmt.Errorf("RetryRelay: %w", err)
+	}
+	if relay == nil || !slices.Contains(retryableStatuses, relay.Status) {
+		return 0, fmt.Errorf("RetryRelay: relay %d: %w", relayId, errNotRetryable)
+	}
+	options := models.RelayOptions{
+		RetryPolicy:         relay.RetryPolicy,
+		Priority:            relay.Priority,
+		OnDependencyFailure: relay.OnDependencyFailure,
+		SuccessConditions:   relay.SuccessConditions,
+		MaxTries:            req.MaxTries,
+		RetryOf:             &relayId,
+		CallbackUrl:         relay.CallbackUrl,
+	}
+	cloneId, err := models.InsertRelay(tx, relay.Device.Id, relay.CloudFunction, relay.Argument, relay.DesiredReturnCode, scheduledTime, options)
+	if err != nil {
+		return 0, fmt.Errorf("RetryRelay: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("RetryRelay: tx.Commit: %w", err)
+	}
+	return cloneId, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// A claimed relay handed to a worker
+type relayJob struct {
+	id           int
+	leaseExpires time.Time
+}
+
+// Long lived workers which process the relays handed to them by the dispatcher in BackgroundTask.
+// A relay stays in flight from when it is dispatched until its worker is done with it, so it is never
+// handed out twice. Devices are never run by two workers at once, because a relay is only dispatched once
+// claimed and the claim fails while another relay of the device is running.
+type relayPool struct {
+	size     int
+	jobs     chan relayJob
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	inFlight map[int]bool
+}
+
+// Starts size workers, which call process for every dispatched relay and signal wakeup once done,
+// so that the dispatcher refills the free slot
+func startRelayPool(size int, wakeup *Wakeup, process func(job relayJob)) *relayPool {
+	pool := &relayPool{
+		size:     size,
+		jobs:     make(chan relayJob),
+		inFlight: make(map[int]bool),
+	}
+	for i := 0; i < size; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for job := range pool.jobs {
+				process(job)
+				pool.mu.Lock()
+				delete(pool.inFlight, job.id)
+				pool.mu.Unlock()
+				wakeup.Signal()
+			}
+		}()
+	}
+	return pool
+}
+
+// Number of workers which are not processing a relay
+func (p *relayPool) free() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size - len(p.inFlight)
+}
+
+func (p *relayPool) isInFlight(id int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inFlight[id]
+}
+
+// Hands the relay to a worker, must only be called while a worker is free
+func (p *relayPool) dispatch(job relayJob) {
+	p.mu.Lock()
+	p.inFlight[job.id] = true
+	p.mu.Unlock()
+	p.jobs <- job
+}
+
+// No more relays may be dispatched after close, the workers exit once they are done with their relays
+func (p *relayPool) close() {
+	close(p.jobs)
+}
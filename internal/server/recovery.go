@@ -0,0 +1,51 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Applies the expired lease policy to running relays whose lease expired at or before now.
+// An expired lease means the process running the relay died or lost track of it mid call,
+// so the device may or may not have run the cloud function.
+// Returns the number of relays recovered.
+func RecoverExpiredLeases(config *config.Config, dbConn *sql.DB, now time.Time) (int, error) {
+	var status models.RelayStatus
+	switch config.Settings.ExpiredLeasePolicy {
+	case "retry":
+		status = models.RelayReady
+	case "fail":
+		status = models.RelayFailed
+	case "review":
+		status = models.RelayNeedsReview
+	default:
+		return 0, fmt.Errorf("RecoverExpiredLeases: unknown expired lease policy %s", config.Settings.ExpiredLeasePolicy)
+	}
+
+	nRecovered := 0
+	for {
+		relayIds, err := models.SelectExpiredLeases(dbConn, now, 100)
+		if err != nil {
+			return nRecovered, fmt.Errorf("RecoverExpiredLeases: %w", err)
+		}
+		if len(relayIds) == 0 {
+			return nRecovered, nil
+		}
+		for _, relayId := range relayIds {
+			recovered, err := models.TransitionRelayStatus(dbConn, relayId, models.RelayRunning, status)
+			if err != nil {
+				return nRecovered, fmt.Errorf("RecoverExpiredLeases: %w on relay %d", err, relayId)
+			}
+			// The lease holder may have finished in the meantime
+			if recovered {
+				log.Printf("RecoverExpiredLeases: relay %d lease expired, status=%d\n", relayId, status)
+				nRecovered++
+			}
+		}
+	}
+}
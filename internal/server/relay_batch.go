@@ -0,0 +1,132 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Most relays created by one batch request
+const maxBatchRelays = 10000
+
+func HandleCreateRelays(config *config.Config, dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCreateRelays(config, dbConn, wakeup, w, r)
+		},
+	)
+}
+
+// Validates and creates the relays in one transaction. An invalid relay rejects the whole batch unless the mode is
+// best effort, the response lists the id or the validation error of each relay either way.
+func handleCreateRelays(config *config.Config, dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("handleCreateRelays: io.ReadAll:", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	var req models.CreateRelaysRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		log.Println("handleCreateRelays: json.Unmarshal:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bestEffort := false
+	if req.Mode != nil {
+		switch *req.Mode {
+		case models.BatchAllOrNothing:
+		case models.BatchBestEffort:
+			bestEffort = true
+		default:
+			http.Error(w, fmt.Sprintf("Unknown mode %s, must be all_or_nothing or best_effort", *req.Mode), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if len(req.Relays) > maxBatchRelays {
+		log.Printf("handleCreateRelays: %d relays is over the limit\n", len(req.Relays))
+		http.Error(w, fmt.Sprintf("At most %d relays may be created at once", maxBatchRelays), http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Printf("handleCreateRelays: received %d relays\n", len(req.Relays))
+
+	tx, err := dbConn.Begin()
+	if err != nil {
+		log.Println("handleCreateRelays: dbConn.Begin:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	results := make([]models.CreateRelayResult, len(req.Relays))
+	relays := make([]relayParams, len(req.Relays))
+	nInvalid := 0
+	for i, relayReq := range req.Relays {
+		relay, msg, err := validateCreateRelay(config, tx, relayReq)
+		if err != nil {
+			log.Println("handleCreateRelays:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if msg != "" {
+			results[i].Error = &msg
+			nInvalid++
+			continue
+		}
+		relays[i] = relay
+	}
+
+	if nInvalid > 0 && !bestEffort {
+		log.Printf("handleCreateRelays: rejected, %d relays are invalid\n", nInvalid)
+		writeJsonStatus(w, "handleCreateRelays", http.StatusUnprocessableEntity, models.CreateRelaysResponse{Results: results})
+		return
+	}
+
+	deviceKeys := make(map[string]int)
+	nCreated := 0
+	for i, relay := range relays {
+		if results[i].Error != nil {
+			continue
+		}
+		deviceKey, ok := deviceKeys[relay.deviceId]
+		if !ok {
+			deviceKey, err = models.InsertOrUpdateDevice(tx, relay.deviceId)
+			if err != nil {
+				log.Println("handleCreateRelays:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			deviceKeys[relay.deviceId] = deviceKey
+		}
+		relayId, err := createDeviceRelay(tx, deviceKey, relay.cloudFunction, relay.argument, relay.desiredReturnCode, relay.scheduledTime, relay.options)
+		if err != nil {
+			log.Println("handleCreateRelays:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results[i].RelayId = &relayId
+		nCreated++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Println("handleCreateRelays: tx.Commit:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("handleCreateRelays: created %d relays, %d invalid\n", nCreated, nInvalid)
+	if nCreated > 0 {
+		wakeup.Signal()
+	}
+	writeJson(w, "handleCreateRelays", models.CreateRelaysResponse{Results: results})
+}
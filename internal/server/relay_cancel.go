@@ -0,0 +1,83 @@
+package server
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func HandleCancelRelays(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCancelRelays(dbConn, wakeup, w, r)
+		},
+	)
+}
+
+func HandleCancelDeviceRelays(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCancelDeviceRelays(dbConn, wakeup, w, r)
+		},
+	)
+}
+
+// Cancels every ready relay matching the filter in the body, which must set more than its statuses
+func handleCancelRelays(dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	var filter models.RelayFilter
+	if !readOptionalJson(w, r, "handleCancelRelays", &filter) {
+		return
+	}
+	// Only ready relays are cancelled whatever the statuses, so without any other field
+	// the filter would cancel every ready relay of every device
+	narrowed := filter
+	narrowed.Statuses = nil
+	if narrowed.IsEmpty() {
+		log.Println("handleCancelRelays: empty filter")
+		http.Error(w, "The filter must set at least one of device_id, cloud_function or a time range", http.StatusUnprocessableEntity)
+		return
+	}
+	cancelRelays(dbConn, wakeup, w, "handleCancelRelays", filter)
+}
+
+// Cancels the device's ready relays, optionally narrowed down by the query parameters of GET /api/relays
+func handleCancelDeviceRelays(dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	device, ok := deviceFromPath(dbConn, w, r, "handleCancelDeviceRelays")
+	if !ok {
+		return
+	}
+	req, err := parseListRelaysQuery(r.URL.Query())
+	if err != nil {
+		log.Println("handleCancelDeviceRelays: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.DeviceId = &device.DeviceId
+	cancelRelays(dbConn, wakeup, w, "handleCancelDeviceRelays", req.RelayFilter)
+}
+
+// Requests the cancellation of the matching relays, only ready relays can be cancelled
+func cancelRelays(dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, caller string, filter models.RelayFilter) {
+	for _, status := range filter.Statuses {
+		if status != models.RelayReady {
+			log.Printf("%s: status %d is not cancellable\n", caller, status)
+			http.Error(w, "Only ready relays can be cancelled", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	cancelled, err := models.InsertCancellationsByFilter(dbConn, filter)
+	if err != nil {
+		log.Printf("%s: %+v\n", caller, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("%s: requested the cancellation of %d relays\n", caller, cancelled)
+	if cancelled > 0 {
+		wakeup.Signal()
+	}
+	writeJsonStatus(w, caller, http.StatusAccepted, models.CancelRelaysResponse{Cancelled: cancelled})
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// Encoded into the opaque cursor of a page, along with the order so that a cursor is not used with another order
+type listCursor struct {
+	models.RelayCursor
+	Sort string `json:"sort"`
+	Desc bool   `json:"desc"`
+}
+
+func HandleListRelays(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleListRelays(dbConn, w, r)
+		},
+	)
+}
+
+// Lists the relays matching the query's filters a page at a time, the next page is requested with the cursor of the
+// previous page
+func handleListRelays(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req, err := parseListRelaysQuery(query)
+	if err != nil {
+		log.Println("handleListRelays: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	order := models.RelayOrder{Sort: req.Sort, Desc: req.Desc}
+
+	var after *models.RelayCursor
+	if token := query.Get("cursor"); token != "" {
+		cursor, err := decodeListCursor(token)
+		if err != nil || cursor.Sort != order.Sort || cursor.Desc != order.Desc {
+			log.Printf("handleListRelays: invalid cursor %s\n", token)
+			http.Error(w, "Invalid cursor, cursors must be used with the same sort and order", http.StatusBadRequest)
+			return
+		}
+		after = &cursor.RelayCursor
+	}
+
+	// One more than the limit tells whether there is another page
+	relayIds, err := models.SelectRelayIdsPage(dbConn, req.RelayFilter, order, after, req.Limit+1)
+	if err != nil {
+		log.Println("handleListRelays: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	more := len(relayIds) > req.Limit
+	if more {
+		relayIds = relayIds[:req.Limit]
+	}
+
+	resp := models.ListRelaysResponse{Relays: []models.Relay{}}
+	for _, relayId := range relayIds {
+		relay, err := models.SelectRelay(dbConn, relayId)
+		if err != nil {
+			log.Println("handleListRelays: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if relay != nil {
+			resp.Relays = append(resp.Relays, *relay)
+		}
+	}
+	if more && len(resp.Relays) > 0 {
+		last := resp.Relays[len(resp.Relays)-1]
+		resp.NextCursor, err = encodeListCursor(listCursor{
+			RelayCursor: models.RelayCursor{Id: last.Id, ScheduledTime: last.ScheduledTime},
+			Sort:        order.Sort,
+			Desc:        order.Desc,
+		})
+		if err != nil {
+			log.Println("handleListRelays: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	log.Printf("handleListRelays: listed %d relays\n", len(resp.Relays))
+	writeJson(w, "handleListRelays", resp)
+}
+
+// Reads the filters, order and limit from the query, times are RFC 3339 and statuses may be repeated
+func parseListRelaysQuery(query url.Values) (models.ListRelaysRequest, error) {
+	var req models.ListRelaysRequest
+	if query.Has("device_id") {
+		deviceId := query.Get("device_id")
+		req.DeviceId = &deviceId
+	}
+	if query.Has("cloud_function") {
+		cloudFunction := query.Get("cloud_function")
+		req.CloudFunction = &cloudFunction
+	}
+	for _, statusStr := range query["status"] {
+		status, err := strconv.Atoi(statusStr)
+		if err != nil {
+			return req, fmt.Errorf("parseListRelaysQuery: invalid status %s", statusStr)
+		}
+		req.Statuses = append(req.Statuses, models.RelayStatus(status))
+	}
+
+	times := []struct {
+		name  string
+		value **time.Time
+	}{
+		{"scheduled_after", &req.ScheduledAfter},
+		{"scheduled_before", &req.ScheduledBefore},
+		{"created_after", &req.CreatedAfter},
+		{"created_before", &req.CreatedBefore},
+	}
+	for _, t := range times {
+		if !query.Has(t.name) {
+			continue
+		}
+		value, err := time.Parse(time.RFC3339, query.Get(t.name))
+		if err != nil {
+			return req, fmt.Errorf("parseListRelaysQuery: invalid %s: %w", t.name, err)
+		}
+		*t.value = &value
+	}
+
+	req.Sort = query.Get("sort")
+	if req.Sort == "" {
+		req.Sort = models.RelaySortId
+	}
+	if req.Sort != models.RelaySortId && req.Sort != models.RelaySortScheduledTime {
+		return req, fmt.Errorf("parseListRelaysQuery: unknown sort %s, must be id or scheduled_time", req.Sort)
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		req.Desc = true
+	default:
+		return req, fmt.Errorf("parseListRelaysQuery: unknown order %s, must be asc or desc", query.Get("order"))
+	}
+
+	req.Limit = defaultListLimit
+	if query.Has("limit") {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return req, fmt.Errorf("parseListRelaysQuery: limit must be between 1 and %d", maxListLimit)
+		}
+		req.Limit = limit
+	}
+	return req, nil
+}
+
+func encodeListCursor(cursor listCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("encodeListCursor: json.Marshal: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeListCursor(token string) (listCursor, error) {
+	var cursor listCursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("decodeListCursor: base64.DecodeString: %w", err)
+	}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return cursor, fmt.Errorf("decodeListCursor: json.Unmarshal: %w", err)
+	}
+	return cursor, nil
+}
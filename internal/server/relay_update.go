@@ -0,0 +1,145 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func HandleUpdateRelay(config *config.Config, dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleUpdateRelay(config, dbConn, wakeup, w, r)
+		},
+	)
+}
+
+// Only ready relays can be updated. The update is conditional on the relay's version, so it fails if the scheduler
+// claimed the relay or anyone else changed it since it was read.
+func handleUpdateRelay(config *config.Config, dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	relayIdStr := r.PathValue("id")
+	relayId, err := strconv.Atoi(relayIdStr)
+	if err != nil {
+		log.Println("handleUpdateRelay: invalid relay id: ", relayIdStr)
+		http.Error(w, "Invalid relay id", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("handleUpdateRelay: io.ReadAll:", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	var req models.UpdateRelayRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		log.Println("handleUpdateRelay: json.Unmarshal:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.ClearDesiredReturnCode && req.DesiredReturnCode != nil {
+		http.Error(w, "Only one of desired_return_code and clear_desired_return_code may be set", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.ClearExpiresAt && req.ExpiresAt != nil {
+		http.Error(w, "Only one of expires_at and clear_expires_at may be set", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.RetryPolicy != nil {
+		if _, ok := config.RetryPolicy(*req.RetryPolicy); !ok {
+			log.Printf("handleUpdateRelay: unknown retry policy %s\n", *req.RetryPolicy)
+			http.Error(w, fmt.Sprintf("Unknown retry policy %s", *req.RetryPolicy), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	for i, condition := range req.SuccessConditions {
+		if err := condition.Validate(); err != nil {
+			log.Printf("handleUpdateRelay: success condition %d: %+v\n", i, err)
+			http.Error(w, fmt.Sprintf("Invalid success condition %d: %s", i, err), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	relay, err := models.SelectRelay(dbConn, relayId)
+	if err != nil {
+		log.Println("handleUpdateRelay: ", err)
+		http.Error(w, "Error in getting relay", http.StatusInternalServerError)
+		return
+	}
+	if relay == nil {
+		log.Printf("handleUpdateRelay: relay id=%d does not exist\n", relayId)
+		http.Error(w, fmt.Sprintf("Relay %d does not exist", relayId), http.StatusUnprocessableEntity)
+		return
+	}
+	if relay.Status != models.RelayReady {
+		log.Printf("handleUpdateRelay: relay id=%d is not ready, status=%d\n", relayId, relay.Status)
+		http.Error(w, fmt.Sprintf("Relay %d is not ready, status=%d", relayId, relay.Status), http.StatusConflict)
+		return
+	}
+	if req.Version != nil && *req.Version != relay.Version {
+		log.Printf("handleUpdateRelay: relay id=%d is at version %d, not %d\n", relayId, relay.Version, *req.Version)
+		http.Error(w, fmt.Sprintf("Relay %d was changed, it is at version %d, not %d", relayId, relay.Version, *req.Version), http.StatusConflict)
+		return
+	}
+
+	update := models.RelayUpdate{
+		ScheduledTime:        req.ScheduledTime,
+		Argument:             req.Argument,
+		SetDesiredReturnCode: req.DesiredReturnCode != nil || req.ClearDesiredReturnCode,
+		DesiredReturnCode:    req.DesiredReturnCode,
+		SetExpiresAt:         req.ExpiresAt != nil || req.ClearExpiresAt,
+		Priority:             req.Priority,
+		RetryPolicy:          req.RetryPolicy,
+		SuccessConditions:    req.SuccessConditions,
+	}
+	scheduledTime := relay.ScheduledTime
+	if req.ScheduledTime != nil {
+		scheduledTime = req.ScheduledTime.UTC()
+		update.ScheduledTime = &scheduledTime
+	}
+	expiresAt := relay.ExpiresAt
+	if req.ExpiresAt != nil {
+		utc := req.ExpiresAt.UTC()
+		update.ExpiresAt = &utc
+		expiresAt = &utc
+	} else if req.ClearExpiresAt {
+		expiresAt = nil
+	}
+	if expiresAt != nil && !expiresAt.After(scheduledTime) {
+		log.Printf("handleUpdateRelay: expiry %s is not after the scheduled time %s\n", expiresAt, scheduledTime)
+		http.Error(w, "The relay must expire after its scheduled time", http.StatusUnprocessableEntity)
+		return
+	}
+
+	updated, err := models.UpdateReadyRelay(dbConn, relayId, relay.Version, update)
+	if err != nil {
+		log.Println("handleUpdateRelay: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		log.Printf("handleUpdateRelay: relay id=%d changed while it was being updated\n", relayId)
+		http.Error(w, fmt.Sprintf("Relay %d was changed or started running while it was being updated", relayId), http.StatusConflict)
+		return
+	}
+	log.Printf("handleUpdateRelay: relay %d updated\n", relayId)
+	// The relay may now be due sooner
+	wakeup.Signal()
+
+	relay, err = models.SelectRelay(dbConn, relayId)
+	if err != nil {
+		log.Println("handleUpdateRelay: ", err)
+		http.Error(w, "Error in getting relay", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleUpdateRelay", relay)
+}
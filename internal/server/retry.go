@@ -0,0 +1,44 @@
+package server
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+)
+
+// Returns the relay's retry policy, falling back to the default policy if it was removed from the config
+func retryPolicy(config *config.Config, name string) config.RetryPolicyConfig {
+	policy, ok := config.RetryPolicy(name)
+	if !ok {
+		log.Printf("retryPolicy: unknown retry policy %s, using the default policy\n", name)
+		policy, _ = config.RetryPolicy("")
+	}
+	return policy
+}
+
+// Returns how long to wait after the nth failed attempt (starting from 1) before trying again
+func backoffDelay(backoff config.BackoffConfig, attempt int) time.Duration {
+	multiplier := backoff.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(backoff.InitialDelaySeconds) * math.Pow(multiplier, float64(attempt-1))
+	if backoff.MaxDelaySeconds > 0 && delay > float64(backoff.MaxDelaySeconds) {
+		delay = float64(backoff.MaxDelaySeconds)
+	}
+	if backoff.Jitter > 0 {
+		delay += delay * backoff.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+// Returns true if there are attempts left after the nth failed attempt
+func canRetry(backoff config.BackoffConfig, attempt int) bool {
+	return backoff.MaxAttempts <= 0 || attempt < backoff.MaxAttempts
+}
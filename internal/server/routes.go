@@ -3,14 +3,40 @@ package server
 import (
 	"database/sql"
 	"net/http"
+
+	"github.com/RadekPudelko/relay/internal/config"
 )
 
 func addRoutes(
 	mux *http.ServeMux,
+	config *config.Config,
 	dbConn *sql.DB,
+	wakeup *Wakeup,
 ) {
 	mux.Handle("GET /{$}", HandleGetRoot())
-	mux.Handle("POST /api/relays", HandleCreateRelay(dbConn))
+	mux.Handle("GET /api/relays", HandleListRelays(dbConn))
+	mux.Handle("POST /api/relays", HandleCreateRelay(config, dbConn, wakeup))
+	mux.Handle("POST /api/relays/batch", HandleCreateRelays(config, dbConn, wakeup))
 	mux.Handle("GET /api/relays/{id}", HandleGetRelay(dbConn))
-	mux.Handle("DELETE /api/relays/{id}", HandleCancelRelay(dbConn))
+	mux.Handle("PATCH /api/relays/{id}", HandleUpdateRelay(config, dbConn, wakeup))
+	mux.Handle("DELETE /api/relays/{id}", HandleCancelRelay(dbConn, wakeup))
+	mux.Handle("GET /api/relays/{id}/attempts", HandleGetRelayAttempts(dbConn))
+	mux.Handle("POST /api/relays/{id}/retry", HandleRetryRelay(dbConn, wakeup))
+	mux.Handle("POST /api/relays/retry", HandleRetryRelays(dbConn, wakeup))
+	mux.Handle("POST /api/relays/cancel", HandleCancelRelays(dbConn, wakeup))
+	mux.Handle("GET /api/devices", HandleGetDevices(dbConn))
+	mux.Handle("GET /api/devices/{device_id}", HandleGetDevice(dbConn))
+	mux.Handle("GET /api/devices/{device_id}/relays", HandleListDeviceRelays(dbConn))
+	mux.Handle("DELETE /api/devices/{device_id}/relays", HandleCancelDeviceRelays(dbConn, wakeup))
+	mux.Handle("POST /api/webhooks", HandleCreateWebhook(dbConn))
+	mux.Handle("GET /api/webhooks", HandleGetWebhooks(dbConn))
+	mux.Handle("DELETE /api/webhooks/{id}", HandleDeleteWebhook(dbConn))
+	mux.Handle("GET /api/webhooks/{id}/deliveries", HandleGetWebhookDeliveries(dbConn))
+	mux.Handle("GET /api/events", HandleEvents(config, dbConn))
+	mux.Handle("POST /api/schedules", HandleCreateSchedule(config, dbConn, wakeup))
+	mux.Handle("GET /api/schedules", HandleGetSchedules(dbConn))
+	mux.Handle("GET /api/schedules/{id}", HandleGetSchedule(dbConn))
+	mux.Handle("DELETE /api/schedules/{id}", HandleDeleteSchedule(dbConn))
+	mux.Handle("POST /api/schedules/{id}/pause", HandlePauseSchedule(dbConn, wakeup))
+	mux.Handle("POST /api/schedules/{id}/resume", HandleResumeSchedule(dbConn, wakeup))
 }
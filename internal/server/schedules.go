@@ -0,0 +1,402 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/cron"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func HandleCreateSchedule(config *config.Config, dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCreateSchedule(config, dbConn, wakeup, w, r)
+		},
+	)
+}
+
+func HandleGetSchedules(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetSchedules(dbConn, w, r)
+		},
+	)
+}
+
+func HandleGetSchedule(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetSchedule(dbConn, w, r)
+		},
+	)
+}
+
+func HandleDeleteSchedule(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleDeleteSchedule(dbConn, w, r)
+		},
+	)
+}
+
+func HandlePauseSchedule(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSetSchedulePaused(dbConn, wakeup, true, w, r)
+		},
+	)
+}
+
+func HandleResumeSchedule(dbConn *sql.DB, wakeup *Wakeup) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleSetSchedulePaused(dbConn, wakeup, false, w, r)
+		},
+	)
+}
+
+func handleCreateSchedule(config *config.Config, dbConn *sql.DB, wakeup *Wakeup, w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("handleCreateSchedule: io.ReadAll:", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	var req models.CreateScheduleRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		log.Println("handleCreateSchedule: json.Unmarshal:", err)
+		log.Println("request body:", string(body))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("handleCreateSchedule: received request body: %s\n", req)
+	if req.DeviceId == "" || req.CloudFunction == "" || req.Cron == "" {
+		log.Println("handleCreateSchedule: Atleast one field in the post payload was blank or invalid")
+		http.Error(w, "device_id, cloud_function and cron are required fields", http.StatusUnprocessableEntity)
+		return
+	}
+
+	schedule := models.Schedule{
+		CloudFunction:     req.CloudFunction,
+		DesiredReturnCode: req.DesiredReturnCode,
+		Cron:              req.Cron,
+		Timezone:          "UTC",
+		OverlapPolicy:     models.OverlapSkip,
+		TtlSeconds:        req.TtlSeconds,
+	}
+	if req.Argument != nil {
+		schedule.Argument = *req.Argument
+	}
+	if req.Timezone != nil {
+		schedule.Timezone = *req.Timezone
+	}
+	if req.OverlapPolicy != nil {
+		if *req.OverlapPolicy != models.OverlapSkip && *req.OverlapPolicy != models.OverlapAllow {
+			log.Printf("handleCreateSchedule: unknown overlap policy %s\n", *req.OverlapPolicy)
+			http.Error(w, fmt.Sprintf("Unknown overlap policy %s, must be skip or allow", *req.OverlapPolicy), http.StatusUnprocessableEntity)
+			return
+		}
+		schedule.OverlapPolicy = *req.OverlapPolicy
+	}
+	if req.RetryPolicy != nil {
+		if _, ok := config.RetryPolicy(*req.RetryPolicy); !ok {
+			log.Printf("handleCreateSchedule: unknown retry policy %s\n", *req.RetryPolicy)
+			http.Error(w, fmt.Sprintf("Unknown retry policy %s", *req.RetryPolicy), http.StatusUnprocessableEntity)
+			return
+		}
+		schedule.RetryPolicy = *req.RetryPolicy
+	}
+	if req.TtlSeconds != nil && *req.TtlSeconds <= 0 {
+		log.Printf("handleCreateSchedule: invalid ttl seconds %d\n", *req.TtlSeconds)
+		http.Error(w, "ttl_seconds must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+
+	schedule.NextRunTime, err = nextScheduleRun(schedule.Cron, schedule.Timezone, time.Now())
+	if err != nil {
+		log.Println("handleCreateSchedule:", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if schedule.NextRunTime == nil {
+		log.Printf("handleCreateSchedule: cron expression %s never occurs\n", schedule.Cron)
+		http.Error(w, fmt.Sprintf("Cron expression %s never occurs", schedule.Cron), http.StatusUnprocessableEntity)
+		return
+	}
+
+	deviceKey, err := models.InsertOrUpdateDevice(dbConn, req.DeviceId)
+	if err != nil {
+		log.Println("handleCreateSchedule:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scheduleId, err := models.InsertSchedule(dbConn, deviceKey, schedule)
+	if err != nil {
+		log.Println("handleCreateSchedule:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("handleCreateSchedule: new schedule created, id: %d first run at %s\n", scheduleId, schedule.NextRunTime)
+	wakeup.Signal()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, fmt.Sprintf("%d", scheduleId))
+}
+
+func handleGetSchedules(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	schedules, err := models.SelectSchedules(dbConn)
+	if err != nil {
+		log.Println("handleGetSchedules: ", err)
+		http.Error(w, "Error in getting schedules", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleGetSchedules", schedules)
+}
+
+func handleGetSchedule(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	scheduleId, ok := scheduleIdFromPath(w, r, "handleGetSchedule")
+	if !ok {
+		return
+	}
+
+	schedule, err := models.SelectSchedule(dbConn, scheduleId)
+	if err != nil {
+		log.Println("handleGetSchedule: ", err)
+		http.Error(w, "Error in getting schedule", http.StatusInternalServerError)
+		return
+	}
+	if schedule == nil {
+		msg := fmt.Sprintf("handleGetSchedule: schedule %d does not exist", scheduleId)
+		log.Println(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	writeJson(w, "handleGetSchedule", schedule)
+}
+
+// Relays already created by the schedule are left alone, they can be cancelled on their own
+func handleDeleteSchedule(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	scheduleId, ok := scheduleIdFromPath(w, r, "handleDeleteSchedule")
+	if !ok {
+		return
+	}
+
+	deleted, err := models.DeleteSchedule(dbConn, scheduleId)
+	if err != nil {
+		log.Println("handleDeleteSchedule: ", err)
+		http.Error(w, "Error in deleting schedule", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		log.Printf("handleDeleteSchedule: schedule id=%d does not exist\n", scheduleId)
+		http.Error(w, fmt.Sprintf("Schedule %d does not exist", scheduleId), http.StatusUnprocessableEntity)
+		return
+	}
+
+	log.Printf("handleDeleteSchedule: schedule %d deleted\n", scheduleId)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+}
+
+// Pausing clears the next run, resuming picks up from the next occurrence after now
+// so that occurrences missed while paused are not run
+func handleSetSchedulePaused(dbConn *sql.DB, wakeup *Wakeup, paused bool, w http.ResponseWriter, r *http.Request) {
+	scheduleId, ok := scheduleIdFromPath(w, r, "handleSetSchedulePaused")
+	if !ok {
+		return
+	}
+
+	schedule, err := models.SelectSchedule(dbConn, scheduleId)
+	if err != nil {
+		log.Println("handleSetSchedulePaused: ", err)
+		http.Error(w, "Error in getting schedule", http.StatusInternalServerError)
+		return
+	}
+	if schedule == nil {
+		log.Printf("handleSetSchedulePaused: schedule id=%d does not exist\n", scheduleId)
+		http.Error(w, fmt.Sprintf("Schedule %d does not exist", scheduleId), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var nextRunTime *time.Time
+	if !paused {
+		nextRunTime, err = nextScheduleRun(schedule.Cron, schedule.Timezone, time.Now())
+		if err != nil {
+			log.Println("handleSetSchedulePaused: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	err = models.UpdateSchedulePaused(dbConn, scheduleId, paused, nextRunTime)
+	if err != nil {
+		log.Println("handleSetSchedulePaused: ", err)
+		http.Error(w, "Error in updating schedule", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("handleSetSchedulePaused: schedule %d paused=%t\n", scheduleId, paused)
+	if !paused {
+		wakeup.Signal()
+	}
+	schedule.Paused = paused
+	schedule.NextRunTime = nextRunTime
+	writeJson(w, "handleSetSchedulePaused", schedule)
+}
+
+func scheduleIdFromPath(w http.ResponseWriter, r *http.Request, caller string) (int, bool) {
+	scheduleIdStr := r.PathValue("id")
+	if scheduleIdStr == "" {
+		log.Printf("%s: missing schedule id in url: %s\n", caller, r.URL.Path)
+		http.Error(w, "Missing schedule id", http.StatusBadRequest)
+		return 0, false
+	}
+
+	scheduleId, err := strconv.Atoi(scheduleIdStr)
+	if err != nil {
+		log.Printf("%s: invalid schedule id: %s\n", caller, scheduleIdStr)
+		http.Error(w, "Invalid schedule id", http.StatusBadRequest)
+		return 0, false
+	}
+	return scheduleId, true
+}
+
+func writeJson(w http.ResponseWriter, caller string, v any) {
+	writeJsonStatus(w, caller, http.StatusOK, v)
+}
+
+func writeJsonStatus(w http.ResponseWriter, caller string, statusCode int, v any) {
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("%s: json.Marshal: %+v\n", caller, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(jsonData)
+}
+
+// Returns the first occurrence of the cron expression in timezone strictly after after, in UTC.
+// Returns nil if it never occurs again.
+func nextScheduleRun(cronExpr string, timezone string, after time.Time) (*time.Time, error) {
+	schedule, err := cron.Parse(cronExpr)
+	if err != nil {
+		return nil, fmt.Errorf("nextScheduleRun: %w", err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("nextScheduleRun: %w", err)
+	}
+	next := schedule.Next(after.In(loc))
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// Creates a relay for every schedule occurrence due at or before now. Each schedule then moves on to its
+// next occurrence after now, so occurrences missed while the app was down are collapsed into one.
+// Returns the number of relays created.
+func MaterializeSchedules(dbConn *sql.DB, now time.Time) (int, error) {
+	nCreated := 0
+	for {
+		scheduleIds, err := models.SelectDueScheduleIds(dbConn, now, 100)
+		if err != nil {
+			return nCreated, fmt.Errorf("MaterializeSchedules: %w", err)
+		}
+		if len(scheduleIds) == 0 {
+			return nCreated, nil
+		}
+		for _, scheduleId := range scheduleIds {
+			created, err := materializeSchedule(dbConn, scheduleId, now)
+			if err != nil {
+				return nCreated, fmt.Errorf("MaterializeSchedules: %w on schedule %d", err, scheduleId)
+			}
+			if created {
+				nCreated++
+			}
+		}
+	}
+}
+
+// Creates the relay for the due occurrence of a schedule and advances it, in one transaction so that
+// instances sharing the database create the relay once. Returns whether a relay was created.
+func materializeSchedule(dbConn *sql.DB, id int, now time.Time) (bool, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return false, fmt.Errorf("materializeSchedule: dbConn.Begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	schedule, err := models.SelectSchedule(tx, id)
+	if err != nil {
+		return false, fmt.Errorf("materializeSchedule: %w", err)
+	}
+	// Deleted, paused or handled by another instance since it was selected
+	if schedule == nil || schedule.Paused || schedule.NextRunTime == nil || schedule.NextRunTime.After(now) {
+		return false, nil
+	}
+	runTime := *schedule.NextRunTime
+
+	nextRunTime, err := nextScheduleRun(schedule.Cron, schedule.Timezone, now)
+	if err != nil {
+		return false, fmt.Errorf("materializeSchedule: %w", err)
+	}
+
+	skip := false
+	if schedule.OverlapPolicy == models.OverlapSkip && schedule.LastRelayId != nil {
+		last, err := models.SelectRelay(tx, *schedule.LastRelayId)
+		if err != nil {
+			return false, fmt.Errorf("materializeSchedule: %w", err)
+		}
+		skip = last != nil && (last.Status == models.RelayReady || last.Status == models.RelayRunning)
+	}
+
+	var relayId *int
+	if skip {
+		log.Printf("materializeSchedule: schedule %d skipped occurrence at %s, relay %d is still pending\n", id, runTime, *schedule.LastRelayId)
+	} else {
+		options := models.RelayOptions{
+			RetryPolicy: schedule.RetryPolicy,
+			ScheduleId:  &schedule.Id,
+		}
+		if schedule.TtlSeconds != nil {
+			expiresAt := runTime.Add(time.Duration(*schedule.TtlSeconds) * time.Second)
+			options.ExpiresAt = &expiresAt
+		}
+		newId, err := CreateRelay(tx, schedule.Device.DeviceId, schedule.CloudFunction, schedule.Argument, schedule.DesiredReturnCode, runTime, options)
+		if err != nil {
+			return false, fmt.Errorf("materializeSchedule: %w", err)
+		}
+		relayId = &newId
+		log.Printf("materializeSchedule: schedule %d created relay %d for %s\n", id, newId, runTime)
+	}
+
+	advanced, err := models.AdvanceSchedule(tx, id, runTime, nextRunTime, relayId)
+	if err != nil {
+		return false, fmt.Errorf("materializeSchedule: %w", err)
+	}
+	if !advanced {
+		return false, nil
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("materializeSchedule: tx.Commit: %w", err)
+	}
+	return relayId != nil, nil
+}
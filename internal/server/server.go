@@ -1,33 +1,63 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"os"
+	"time"
 
+	"github.com/RadekPudelko/relay/internal/config"
 	"github.com/RadekPudelko/relay/internal/middleware"
 )
 
-func NewServer(db *sql.DB) http.Handler {
+func NewServer(config *config.Config, db *sql.DB, wakeup *Wakeup) http.Handler {
 	mux := http.NewServeMux()
-	addRoutes(mux, db)
+	addRoutes(mux, config, db, wakeup)
 	var handler http.Handler = mux
 	handler = middleware.Logging(mux)
 	return handler
 }
 
-func Run(db *sql.DB, host string, port string) error {
-	srv := NewServer(db)
+// Serves the api until ctx is cancelled, then stops accepting new requests and gives the
+// ones in progress up to ShutdownGraceSeconds to complete
+func Run(ctx context.Context, config *config.Config, db *sql.DB, wakeup *Wakeup) error {
+	srv := NewServer(config, db, wakeup)
+	// Event streams never finish on their own, so request contexts are cancelled as soon as shutdown starts
+	// to end them. Other handlers don't use their request's context and get the whole grace period.
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 	httpServer := &http.Server{
-		Addr:    net.JoinHostPort(host, port),
-		Handler: srv,
+		Addr:        net.JoinHostPort(config.Server.Host, fmt.Sprintf("%d", config.Server.Port)),
+		Handler:     srv,
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
 	}
+	httpServer.RegisterOnShutdown(cancelRequests)
 
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		fmt.Fprintf(os.Stderr, "error listening and serving: %s\n", err)
+	errChan := make(chan error, 1)
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "error listening and serving: %s\n", err)
+			errChan <- err
+		}
+		close(errChan)
+	}()
+
+	select {
+	case err := <-errChan:
 		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Run: shutting down the http server")
+	shutdownGrace := time.Duration(config.Settings.ShutdownGraceSeconds) * time.Second
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("Run: httpServer.Shutdown: %w", err)
 	}
 	return nil
 }
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// Wakeup lets the handlers interrupt the background task while it is sleeping,
+// so that new relays and cancellations are picked up right away
+type Wakeup struct {
+	ch chan struct{}
+}
+
+func NewWakeup() *Wakeup {
+	return &Wakeup{ch: make(chan struct{}, 1)}
+}
+
+// Signal never blocks, signals sent while the background task is busy are merged into one
+func (w *Wakeup) Signal() {
+	select {
+	case w.ch <- struct{}{}:
+	default:
+	}
+}
+
+// Sleep blocks until d has passed, Signal is called or ctx is cancelled, returns true if woken by a signal
+func (w *Wakeup) Sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-w.ch:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Headers of a delivery. The signature is t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">.
+const (
+	webhookEventHeader     = "X-Relay-Event"
+	webhookEventIdHeader   = "X-Relay-Event-Id"
+	webhookSignatureHeader = "X-Relay-Signature"
+)
+
+// Most deliveries kept per webhook in the deliveries response
+const webhookDeliveriesLimit = 100
+
+func HandleCreateWebhook(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleCreateWebhook(dbConn, w, r)
+		},
+	)
+}
+
+func HandleGetWebhooks(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetWebhooks(dbConn, w, r)
+		},
+	)
+}
+
+func HandleDeleteWebhook(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleDeleteWebhook(dbConn, w, r)
+		},
+	)
+}
+
+func HandleGetWebhookDeliveries(dbConn *sql.DB) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleGetWebhookDeliveries(dbConn, w, r)
+		},
+	)
+}
+
+func handleCreateWebhook(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	var req models.CreateWebhookRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("handleCreateWebhook: io.ReadAll:", err)
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		log.Println("handleCreateWebhook: json.Unmarshal:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if msg := validateWebhookUrl(req.Url); msg != "" {
+		log.Println("handleCreateWebhook:", msg)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(eventNames(), event) {
+			log.Printf("handleCreateWebhook: unknown event %s\n", event)
+			http.Error(w, fmt.Sprintf("Unknown event %s, must be one of %v", event, eventNames()), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if req.RelayId != nil {
+		relay, err := models.SelectRelay(dbConn, *req.RelayId)
+		if err != nil {
+			log.Println("handleCreateWebhook:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if relay == nil {
+			log.Printf("handleCreateWebhook: relay %d does not exist\n", *req.RelayId)
+			http.Error(w, fmt.Sprintf("Relay %d does not exist", *req.RelayId), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	webhook := models.Webhook{Url: req.Url, RelayId: req.RelayId, Events: req.Events, CreatedAt: time.Now().UTC()}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	if req.Secret != nil && *req.Secret != "" {
+		webhook.Secret = *req.Secret
+	} else {
+		webhook.Secret, err = newWebhookSecret()
+		if err != nil {
+			log.Println("handleCreateWebhook:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	webhook.Id, err = models.InsertWebhook(dbConn, webhook)
+	if err != nil {
+		log.Println("handleCreateWebhook:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("handleCreateWebhook: webhook %d created for %s\n", webhook.Id, webhook.Url)
+	writeJson(w, "handleCreateWebhook", models.CreateWebhookResponse{Webhook: webhook, Secret: webhook.Secret})
+}
+
+func handleGetWebhooks(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	webhooks, err := models.SelectWebhooks(dbConn, nil)
+	if err != nil {
+		log.Println("handleGetWebhooks: ", err)
+		http.Error(w, "Error in getting webhooks", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleGetWebhooks", webhooks)
+}
+
+func handleDeleteWebhook(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	webhookId, ok := webhookIdFromPath(w, r, "handleDeleteWebhook")
+	if !ok {
+		return
+	}
+	deleted, err := models.DeleteWebhook(dbConn, webhookId)
+	if err != nil {
+		log.Println("handleDeleteWebhook: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		log.Printf("handleDeleteWebhook: webhook %d does not exist\n", webhookId)
+		http.Error(w, fmt.Sprintf("Webhook %d does not exist", webhookId), http.StatusUnprocessableEntity)
+		return
+	}
+	log.Printf("handleDeleteWebhook: webhook %d deleted\n", webhookId)
+	w.WriteHeader(http.StatusOK)
+}
+
+// The webhook's latest deliveries, newest first
+func handleGetWebhookDeliveries(dbConn *sql.DB, w http.ResponseWriter, r *http.Request) {
+	webhookId, ok := webhookIdFromPath(w, r, "handleGetWebhookDeliveries")
+	if !ok {
+		return
+	}
+	deliveries, err := models.SelectWebhookDeliveries(dbConn, webhookId, webhookDeliveriesLimit)
+	if err != nil {
+		log.Println("handleGetWebhookDeliveries: ", err)
+		http.Error(w, "Error in getting deliveries", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, "handleGetWebhookDeliveries", deliveries)
+}
+
+func webhookIdFromPath(w http.ResponseWriter, r *http.Request, caller string) (int, bool) {
+	webhookIdStr := r.PathValue("id")
+	webhookId, err := strconv.Atoi(webhookIdStr)
+	if err != nil {
+		log.Printf("%s: invalid webhook id: %s\n", caller, webhookIdStr)
+		http.Error(w, "Invalid webhook id", http.StatusBadRequest)
+		return 0, false
+	}
+	return webhookId, true
+}
+
+// Returns why the url can not receive deliveries, empty if it can
+func validateWebhookUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err.Error()
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Sprintf("%s is not an absolute http or https url", rawUrl)
+	}
+	return ""
+}
+
+func eventNames() []string {
+	names := []string{}
+	for _, name := range models.RelayEventNames {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("newWebhookSecret: rand.Read: %w", err)
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Signs the body of a delivery sent at the time
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", t, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Dispatches webhooks every poll interval until ctx is done
+func RunWebhookDispatcher(ctx context.Context, config *config.Config, dbConn *sql.DB) {
+	ticker := time.NewTicker(time.Duration(config.Webhooks.PollSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		_, err := DispatchWebhooks(ctx, config, dbConn, time.Now().UTC())
+		if err != nil {
+			log.Printf("RunWebhookDispatcher: %+v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Queues a delivery of each new relay event to the webhooks subscribed to it and the relay's callback url,
+// then attempts the deliveries which are due. Returns the number of deliveries made.
+func DispatchWebhooks(ctx context.Context, config *config.Config, dbConn *sql.DB, now time.Time) (int, error) {
+	for {
+		queued, err := queueWebhookDeliveries(config, dbConn, now)
+		if err != nil {
+			return 0, fmt.Errorf("DispatchWebhooks: %w", err)
+		}
+		if queued == 0 {
+			break
+		}
+	}
+
+	nDelivered := 0
+	for ctx.Err() == nil {
+		deliveries, err := models.SelectDueDeliveries(dbConn, now, 100)
+		if err != nil {
+			return nDelivered, fmt.Errorf("DispatchWebhooks: %w", err)
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+		for _, delivery := range deliveries {
+			delivered, err := attemptDelivery(ctx, config, dbConn, delivery, now)
+			if err != nil {
+				return nDelivered, fmt.Errorf("DispatchWebhooks: %w", err)
+			}
+			if delivered {
+				nDelivered++
+			}
+		}
+	}
+	return nDelivered, nil
+}
+
+// Turns a batch of new events into deliveries, returns the number of events handled
+func queueWebhookDeliveries(config *config.Config, dbConn *sql.DB, now time.Time) (int, error) {
+	tx, err := dbConn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("queueWebhookDeliveries: dbConn.Begin: %w", err)
+	}
+	defer tx.Rollback()
+
+	events, err := models.SelectUndispatchedEvents(tx, 100)
+	if err != nil {
+		return 0, fmt.Errorf("queueWebhookDeliveries: %w", err)
+	}
+	for _, event := range events {
+		err = queueEventDeliveries(config, tx, event, now)
+		if err != nil {
+			return 0, fmt.Errorf("queueWebhookDeliveries: %w", err)
+		}
+		err = models.MarkEventDispatched(tx, event.Id)
+		if err != nil {
+			return 0, fmt.Errorf("queueWebhookDeliveries: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("queueWebhookDeliveries: tx.Commit: %w", err)
+	}
+	return len(events), nil
+}
+
+func queueEventDeliveries(config *config.Config, tx *sql.Tx, event models.RelayEvent, now time.Time) error {
+	name := models.RelayEventNames[event.Status]
+	relay, err := models.SelectRelay(tx, event.RelayId)
+	if err != nil {
+		return fmt.Errorf("queueEventDeliveries: %w", err)
+	}
+	if relay == nil {
+		return nil
+	}
+	webhooks, err := models.SelectWebhooks(tx, &event.RelayId)
+	if err != nil {
+		return fmt.Errorf("queueEventDeliveries: %w", err)
+	}
+	if relay.CallbackUrl == nil && len(webhooks) == 0 {
+		return nil
+	}
+
+	// The relay may have moved on since, ie been retried
+	relay.Status = event.Status
+	payload, err := json.Marshal(models.WebhookPayload{EventId: event.Id, Event: name, OccurredAt: event.CreatedAt, Relay: *relay})
+	if err != nil {
+		return fmt.Errorf("queueEventDeliveries: json.Marshal: %w", err)
+	}
+
+	delivery := models.WebhookDelivery{
+		EventId:       event.Id,
+		Payload:       string(payload),
+		Status:        models.DeliveryPending,
+		NextAttemptAt: now,
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event.RelayId, name) {
+			continue
+		}
+		delivery.WebhookId, delivery.Url, delivery.Secret = &webhook.Id, webhook.Url, webhook.Secret
+		_, err = models.InsertWebhookDelivery(tx, delivery)
+		if err != nil {
+			return fmt.Errorf("queueEventDeliveries: %w", err)
+		}
+	}
+	if relay.CallbackUrl != nil {
+		delivery.WebhookId, delivery.Url, delivery.Secret = nil, *relay.CallbackUrl, config.Webhooks.Secret
+		_, err = models.InsertWebhookDelivery(tx, delivery)
+		if err != nil {
+			return fmt.Errorf("queueEventDeliveries: %w", err)
+		}
+	}
+	return nil
+}
+
+// Posts the delivery unless another instance claimed it first, and schedules a retry with backoff if it fails.
+// Returns whether it was delivered.
+func attemptDelivery(ctx context.Context, config *config.Config, dbConn *sql.DB, delivery models.WebhookDelivery, now time.Time) (bool, error) {
+	timeout := time.Duration(config.Webhooks.TimeoutSeconds) * time.Second
+	claimed, err := models.ClaimDelivery(dbConn, delivery.Id, now, time.Now().Add(2*timeout).UTC())
+	if err != nil {
+		return false, fmt.Errorf("attemptDelivery: %w", err)
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	statusCode, postErr := postDelivery(ctx, timeout, delivery)
+	if postErr != nil && ctx.Err() != nil {
+		// Shutting down, the delivery is released to be attempted again on the next start
+		delivery.NextAttemptAt = now
+		err = models.UpdateDelivery(dbConn, delivery)
+		if err != nil {
+			return false, fmt.Errorf("attemptDelivery: %w", err)
+		}
+		return false, nil
+	}
+	delivery.Attempts++
+	if statusCode != 0 {
+		delivery.LastStatusCode = &statusCode
+	}
+	if postErr == nil {
+		deliveredAt := time.Now().UTC()
+		delivery.Status, delivery.DeliveredAt, delivery.LastError = models.DeliveryDelivered, &deliveredAt, nil
+	} else {
+		lastError := postErr.Error()
+		delivery.LastError = &lastError
+		if canRetry(config.Webhooks.Retry, delivery.Attempts) {
+			delivery.NextAttemptAt = time.Now().Add(backoffDelay(config.Webhooks.Retry, delivery.Attempts)).UTC()
+			log.Printf("attemptDelivery: delivery %d to %s failed, retrying at %s: %s\n", delivery.Id, delivery.Url, delivery.NextAttemptAt, lastError)
+		} else {
+			delivery.Status = models.DeliveryFailed
+			log.Printf("attemptDelivery: delivery %d to %s failed after %d attempts: %s\n", delivery.Id, delivery.Url, delivery.Attempts, lastError)
+		}
+	}
+
+	err = models.UpdateDelivery(dbConn, delivery)
+	if err != nil {
+		return false, fmt.Errorf("attemptDelivery: %w", err)
+	}
+	return postErr == nil, nil
+}
+
+// Posts the signed payload, any 2xx response is a success. Returns the response's status code, 0 if there was none.
+func postDelivery(ctx context.Context, timeout time.Duration, delivery models.WebhookDelivery) (int, error) {
+	var payload models.WebhookPayload
+	err := json.Unmarshal([]byte(delivery.Payload), &payload)
+	if err != nil {
+		return 0, fmt.Errorf("postDelivery: json.Unmarshal: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("postDelivery: http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, payload.Event)
+	req.Header.Set(webhookEventIdHeader, strconv.Itoa(delivery.EventId))
+	req.Header.Set(webhookSignatureHeader, SignWebhook(delivery.Secret, time.Now(), body))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("postDelivery: client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("postDelivery: response status code=%d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -1,12 +1,18 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/RadekPudelko/relay/pkg/models"
@@ -59,6 +65,45 @@ func (c Client) GetRelay(id int) (*models.Relay, error) {
 	return &relay, nil
 }
 
+func (c Client) GetRelayAttempts(id int) ([]models.Attempt, error) {
+	var attempts []models.Attempt
+	err := c.doJson("GetRelayAttempts", "GET", fmt.Sprintf("%s/api/relays/%d/attempts", c.url, id), &attempts)
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// Changes a ready relay, returns the updated relay
+func (c Client) UpdateRelay(id int, data models.UpdateRelayRequest) (*models.Relay, error) {
+	var relay models.Relay
+	err := c.sendJson("UpdateRelay", "PATCH", fmt.Sprintf("%s/api/relays/%d", c.url, id), data, &relay)
+	if err != nil {
+		return nil, err
+	}
+	return &relay, nil
+}
+
+// Runs a failed, expired or cancelled relay again, returns the id of the relay which will run
+func (c Client) RetryRelay(id int, data models.RetryRelayRequest) (int, error) {
+	var resp models.RetryRelayResponse
+	err := c.sendJson("RetryRelay", "POST", fmt.Sprintf("%s/api/relays/%d/retry", c.url, id), data, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.RelayId, nil
+}
+
+// Retries every relay matching the filter in data, returns the ids of the relays which will run
+func (c Client) RetryRelays(data models.RetryRelaysRequest) ([]int, error) {
+	var resp models.RetryRelaysResponse
+	err := c.sendJson("RetryRelays", "POST", fmt.Sprintf("%s/api/relays/retry", c.url), data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.RelayIds, nil
+}
+
 func (c Client) CreateRelay(deviceId string, cloudFunction string, argument string, desiredReturnCode *int, scheduledTime *time.Time) (int, error) {
 	data := models.CreateRelayRequest{
 		DeviceId:          deviceId,
@@ -67,41 +112,234 @@ func (c Client) CreateRelay(deviceId string, cloudFunction string, argument stri
 		DesiredReturnCode: desiredReturnCode,
 		ScheduledTime:     scheduledTime,
 	}
+	return c.CreateRelayFromRequest(data)
+}
 
+// Creates a relay with the optional fields which CreateRelay does not take, ie the retry policy.
+// The request is sent with an idempotency key, data's client request id or a new key, and is sent again with the same
+// key if it fails to reach the server or the server fails, so that the relay is created at most once.
+func (c Client) CreateRelayFromRequest(data models.CreateRelayRequest) (int, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return 0, fmt.Errorf("CreateRelay: json.Marshal: %w", err)
 	}
+	key := NewIdempotencyKey()
+	if data.ClientRequestId != nil {
+		key = *data.ClientRequestId
+	}
+
+	var body []byte
+	for attempt := 1; ; attempt++ {
+		var statusCode int
+		statusCode, body, err = c.createRelay(jsonData, key)
+		if err == nil && statusCode == http.StatusOK {
+			break
+		}
+		if attempt == createRelayAttempts || (err == nil && statusCode < http.StatusInternalServerError) {
+			if err != nil {
+				return 0, err
+			}
+			return 0, fmt.Errorf("CreateRelay: response status code=%d, body=%s", statusCode, body)
+		}
+		time.Sleep(time.Duration(attempt) * createRelayRetryDelay)
+	}
 
+	id, err := strconv.ParseInt(string(body), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("CreateRelay: strconv.ParseInt: %w on %s", err, string(body))
+	}
+	return int(id), nil
+}
+
+const (
+	createRelayAttempts   = 3
+	createRelayRetryDelay = 500 * time.Millisecond
+)
+
+func (c Client) createRelay(jsonData []byte, key string) (int, []byte, error) {
 	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/relays", c.url), bytes.NewBuffer(jsonData))
 	if err != nil {
-		return 0, fmt.Errorf("CreateRelay: http.NewRequest: %w", err)
+		return 0, nil, fmt.Errorf("CreateRelay: http.NewRequest: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("CreateRelay: client.Do: %w", err)
+		return 0, nil, fmt.Errorf("CreateRelay: client.Do: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return 0, fmt.Errorf("CreateRelay: io.ReadAll: %w", err)
+		return 0, nil, fmt.Errorf("CreateRelay: io.ReadAll: %w", err)
 	}
+	return resp.StatusCode, body, nil
+}
 
-	// Check the response status code
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("CreateRelay: response status code=%d, body=%s", resp.StatusCode, body)
+// A random key which identifies a relay creation request, for requests which may be sent more than once
+func NewIdempotencyKey() string {
+	key := make([]byte, 16)
+	// Only fails if the system's random number generator is unavailable
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("NewIdempotencyKey: rand.Read: %+v", err))
 	}
+	return hex.EncodeToString(key)
+}
 
-	id, err := strconv.ParseInt(string(body), 10, 64)
+// Lists the relays matching data's filters, fetching a page at a time as the iterator advances
+//
+//	relays := client.ListRelays(models.ListRelaysRequest{Statuses: []models.RelayStatus{models.RelayFailed}})
+//	for relays.Next() {
+//		relay := relays.Relay()
+//	}
+//	if err := relays.Err(); err != nil {
+func (c Client) ListRelays(data models.ListRelaysRequest) *RelayIterator {
+	return c.listRelays(fmt.Sprintf("%s/api/relays", c.url), data)
+}
+
+// Lists the device's relays like ListRelays, data's device id is ignored
+func (c Client) ListDeviceRelays(deviceId string, data models.ListRelaysRequest) *RelayIterator {
+	data.DeviceId = nil
+	return c.listRelays(fmt.Sprintf("%s/api/devices/%s/relays", c.url, url.PathEscape(deviceId)), data)
+}
+
+// Lists every device with its relay counts, or only those with pending relays
+func (c Client) GetDevices(onlyPending bool) ([]models.DeviceSummary, error) {
+	var devices []models.DeviceSummary
+	err := c.doJson("GetDevices", "GET", fmt.Sprintf("%s/api/devices?pending=%t", c.url, onlyPending), &devices)
 	if err != nil {
-		return 0, fmt.Errorf("CreateRelay: strconv.ParseInt: %w on %s", err, string(body))
+		return nil, err
 	}
-	return int(id), nil
+	return devices, nil
+}
+
+func (c Client) GetDevice(deviceId string) (*models.DeviceSummary, error) {
+	var device models.DeviceSummary
+	err := c.doJson("GetDevice", "GET", fmt.Sprintf("%s/api/devices/%s", c.url, url.PathEscape(deviceId)), &device)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (c Client) listRelays(listUrl string, data models.ListRelaysRequest) *RelayIterator {
+	query := url.Values{}
+	if data.DeviceId != nil {
+		query.Set("device_id", *data.DeviceId)
+	}
+	if data.CloudFunction != nil {
+		query.Set("cloud_function", *data.CloudFunction)
+	}
+	for _, status := range data.Statuses {
+		query.Add("status", strconv.Itoa(int(status)))
+	}
+	times := []struct {
+		name  string
+		value *time.Time
+	}{
+		{"scheduled_after", data.ScheduledAfter},
+		{"scheduled_before", data.ScheduledBefore},
+		{"created_after", data.CreatedAfter},
+		{"created_before", data.CreatedBefore},
+	}
+	for _, t := range times {
+		if t.value != nil {
+			query.Set(t.name, t.value.Format(time.RFC3339Nano))
+		}
+	}
+	if data.Sort != "" {
+		query.Set("sort", data.Sort)
+	}
+	if data.Desc {
+		query.Set("order", "desc")
+	}
+	if data.Limit > 0 {
+		query.Set("limit", strconv.Itoa(data.Limit))
+	}
+	return &RelayIterator{client: c, url: listUrl, query: query}
+}
+
+// Iterates over the relays of ListRelays, like bufio.Scanner. Next stops at the end of the list or on an error.
+type RelayIterator struct {
+	client Client
+	url    string
+	query  url.Values
+	page   []models.Relay
+	// Index of the current relay in page
+	i      int
+	cursor string
+	last   bool
+	err    error
+}
+
+// Advances to the next relay, fetching the next page if needed. Returns false once there are no more relays or
+// a page could not be fetched.
+func (it *RelayIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.i++
+	for it.i >= len(it.page) {
+		if it.last {
+			return false
+		}
+		query := url.Values{}
+		for k, v := range it.query {
+			query[k] = v
+		}
+		if it.cursor != "" {
+			query.Set("cursor", it.cursor)
+		}
+		var resp models.ListRelaysResponse
+		err := it.client.doJson("ListRelays", "GET", fmt.Sprintf("%s?%s", it.url, query.Encode()), &resp)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.page, it.i = resp.Relays, 0
+		it.cursor = resp.NextCursor
+		it.last = resp.NextCursor == ""
+	}
+	return true
+}
+
+// The current relay, only valid after Next returned true
+func (it *RelayIterator) Relay() models.Relay {
+	return it.page[it.i]
+}
+
+// The error which stopped the iteration, if any
+func (it *RelayIterator) Err() error {
+	return it.err
+}
+
+// Creates the relays in one transaction, returns a result for each of them in order. If the batch was rejected because
+// of invalid relays, the results hold the validation errors along with an error.
+func (c Client) CreateRelays(data models.CreateRelaysRequest) ([]models.CreateRelayResult, error) {
+	statusCode, body, err := c.send("CreateRelays", "POST", fmt.Sprintf("%s/api/relays/batch", c.url), data)
+	if err != nil {
+		return nil, err
+	}
+	if statusCode != http.StatusOK && statusCode != http.StatusUnprocessableEntity {
+		return nil, fmt.Errorf("CreateRelays: response status code=%d, body=%s", statusCode, body)
+	}
+
+	var resp models.CreateRelaysResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		// Unprocessable requests which are not about any one relay, ie an unknown mode, are plain text
+		if statusCode != http.StatusOK {
+			return nil, fmt.Errorf("CreateRelays: response status code=%d, body=%s", statusCode, body)
+		}
+		return nil, fmt.Errorf("CreateRelays: json.Unmarshal: %w", err)
+	}
+	if statusCode != http.StatusOK {
+		return resp.Results, fmt.Errorf("CreateRelays: response status code=%d, batch rejected", statusCode)
+	}
+	return resp.Results, nil
 }
 
 func (c Client) CancelRelay(id int) error {
@@ -130,3 +368,272 @@ func (c Client) CancelRelay(id int) error {
 	}
 	return nil
 }
+
+// Cancels every ready relay matching the filter, returns the number of relays whose cancellation was requested
+func (c Client) CancelRelays(filter models.RelayFilter) (int, error) {
+	return c.cancelRelays("CancelRelays", "POST", fmt.Sprintf("%s/api/relays/cancel", c.url), filter)
+}
+
+// Cancels the device's ready relays, returns the number of relays whose cancellation was requested
+func (c Client) CancelDeviceRelays(deviceId string) (int, error) {
+	return c.cancelRelays("CancelDeviceRelays", "DELETE", fmt.Sprintf("%s/api/devices/%s/relays", c.url, url.PathEscape(deviceId)), nil)
+}
+
+func (c Client) cancelRelays(caller string, method string, url string, in any) (int, error) {
+	statusCode, body, err := c.send(caller, method, url, in)
+	if err != nil {
+		return 0, err
+	}
+	if statusCode != http.StatusAccepted {
+		return 0, fmt.Errorf("%s: response status code=%d, body=%s", caller, statusCode, body)
+	}
+	var resp models.CancelRelaysResponse
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		return 0, fmt.Errorf("%s: json.Unmarshal: %w", caller, err)
+	}
+	return resp.Cancelled, nil
+}
+
+func (c Client) CreateSchedule(data models.CreateScheduleRequest) (int, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return 0, fmt.Errorf("CreateSchedule: json.Marshal: %w", err)
+	}
+
+	resp, err := http.Post(fmt.Sprintf("%s/api/schedules", c.url), "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, fmt.Errorf("CreateSchedule: http.Post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("CreateSchedule: io.ReadAll: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("CreateSchedule: response status code=%d, body=%s", resp.StatusCode, body)
+	}
+
+	id, err := strconv.ParseInt(string(body), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("CreateSchedule: strconv.ParseInt: %w on %s", err, string(body))
+	}
+	return int(id), nil
+}
+
+func (c Client) GetSchedules() ([]models.Schedule, error) {
+	var schedules []models.Schedule
+	err := c.doJson("GetSchedules", "GET", fmt.Sprintf("%s/api/schedules", c.url), &schedules)
+	if err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func (c Client) GetSchedule(id int) (*models.Schedule, error) {
+	var schedule models.Schedule
+	err := c.doJson("GetSchedule", "GET", fmt.Sprintf("%s/api/schedules/%d", c.url, id), &schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (c Client) PauseSchedule(id int) (*models.Schedule, error) {
+	var schedule models.Schedule
+	err := c.doJson("PauseSchedule", "POST", fmt.Sprintf("%s/api/schedules/%d/pause", c.url, id), &schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (c Client) ResumeSchedule(id int) (*models.Schedule, error) {
+	var schedule models.Schedule
+	err := c.doJson("ResumeSchedule", "POST", fmt.Sprintf("%s/api/schedules/%d/resume", c.url, id), &schedule)
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func (c Client) DeleteSchedule(id int) error {
+	return c.doJson("DeleteSchedule", "DELETE", fmt.Sprintf("%s/api/schedules/%d", c.url, id), nil)
+}
+
+// Subscribes the url to relay events, the returned webhook holds the secret the deliveries are signed with
+func (c Client) CreateWebhook(data models.CreateWebhookRequest) (*models.CreateWebhookResponse, error) {
+	var webhook models.CreateWebhookResponse
+	err := c.sendJson("CreateWebhook", "POST", fmt.Sprintf("%s/api/webhooks", c.url), data, &webhook)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func (c Client) GetWebhooks() ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+	err := c.doJson("GetWebhooks", "GET", fmt.Sprintf("%s/api/webhooks", c.url), &webhooks)
+	if err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (c Client) DeleteWebhook(id int) error {
+	return c.doJson("DeleteWebhook", "DELETE", fmt.Sprintf("%s/api/webhooks/%d", c.url, id), nil)
+}
+
+// The webhook's latest deliveries, newest first
+func (c Client) GetWebhookDeliveries(id int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+	err := c.doJson("GetWebhookDeliveries", "GET", fmt.Sprintf("%s/api/webhooks/%d/deliveries", c.url, id), &deliveries)
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Opens the stream of relay and device events matching the filter. If lastEventId is set the stream resumes
+// after that event, otherwise it starts with the next event. Cancel ctx or call Close to end the stream.
+func (c Client) StreamEvents(ctx context.Context, filter models.EventFilter, lastEventId *int) (*EventStream, error) {
+	query := url.Values{}
+	if filter.DeviceId != nil {
+		query.Set("device_id", *filter.DeviceId)
+	}
+	if filter.RelayId != nil {
+		query.Set("relay_id", strconv.Itoa(*filter.RelayId))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/api/events?%s", c.url, query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("StreamEvents: http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventId != nil {
+		req.Header.Set("Last-Event-ID", strconv.Itoa(*lastEventId))
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("StreamEvents: client.Do: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("StreamEvents: response status code=%d, body=%s", resp.StatusCode, body)
+	}
+	return &EventStream{body: resp.Body, scanner: bufio.NewScanner(resp.Body)}, nil
+}
+
+// Reads the events of StreamEvents, like bufio.Scanner. Next blocks until the next event arrives.
+type EventStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	event   models.Event
+	err     error
+}
+
+// Waits for the next event. Returns false once the stream ended or an event could not be read.
+func (s *EventStream) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	var data string
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		// A blank line ends an event, lines starting with a colon are comments
+		if line == "" {
+			if data == "" {
+				continue
+			}
+			var event models.Event
+			err := json.Unmarshal([]byte(data), &event)
+			if err != nil {
+				s.err = fmt.Errorf("EventStream: json.Unmarshal: %w", err)
+				return false
+			}
+			s.event = event
+			return true
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data += strings.TrimPrefix(value, " ")
+		}
+	}
+	s.err = s.scanner.Err()
+	return false
+}
+
+// The current event, only valid after Next returned true
+func (s *EventStream) Event() models.Event {
+	return s.event
+}
+
+// The error which ended the stream, if any. Cancelling the stream's context also ends it with an error.
+func (s *EventStream) Err() error {
+	return s.err
+}
+
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+// Sends a request without a body and decodes the json response into out, unless out is nil
+func (c Client) doJson(caller string, method string, url string, out any) error {
+	return c.sendJson(caller, method, url, nil, out)
+}
+
+// Sends in as the json body of the request, unless in is nil, and decodes the json response into out, unless out is nil
+func (c Client) sendJson(caller string, method string, url string, in any, out any) error {
+	statusCode, body, err := c.send(caller, method, url, in)
+	if err != nil {
+		return err
+	}
+
+	if statusCode != http.StatusOK {
+		return fmt.Errorf("%s: response status code=%d, body=%s", caller, statusCode, body)
+	}
+
+	if out == nil {
+		return nil
+	}
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		return fmt.Errorf("%s: json.Unmarshal: %w", caller, err)
+	}
+	return nil
+}
+
+// Sends in as the json body of the request, unless in is nil, and returns the response status code and body
+func (c Client) send(caller string, method string, url string, in any) (int, []byte, error) {
+	var reqBody io.Reader
+	if in != nil {
+		jsonData, err := json.Marshal(in)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%s: json.Marshal: %w", caller, err)
+		}
+		reqBody = bytes.NewBuffer(jsonData)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: http.NewRequest: %w", caller, err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: client.Do: %w", caller, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: io.ReadAll: %w", caller, err)
+	}
+	return resp.StatusCode, body, nil
+}
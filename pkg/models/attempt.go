@@ -0,0 +1,98 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// A ping or cloud function call made while running a relay
+type Attempt struct {
+	Id      int    `json:"id"`
+	RelayId int    `json:"relay_id"`
+	Kind    string `json:"kind"`
+	// When the call was sent and how long Particle took to answer
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+	// Status of Particle's response, nil if there was none
+	HttpStatus *int `json:"http_status"`
+	// Body of Particle's error response
+	ErrorBody *string `json:"error_body"`
+	Error     *string `json:"error"`
+	// Returned by the cloud function
+	ReturnValue *int   `json:"return_value"`
+	Outcome     string `json:"outcome"`
+}
+
+const (
+	AttemptPing          = "ping"
+	AttemptCloudFunction = "cloud_function"
+)
+
+// Attempt outcomes
+const (
+	AttemptOnline  = "online"
+	AttemptOffline = "offline"
+	AttemptSuccess = "success"
+	// The cloud function ran, but did not return the desired return code
+	AttemptMismatch = "mismatch"
+	AttemptTimeout  = "timeout"
+	AttemptError    = "error"
+	// Given up when the relay's lease expired or the app shut down
+	AttemptCancelled = "cancelled"
+)
+
+const attemptColumns string = `id, relay_id, kind, started_at, duration_ms, http_status, error_body, error, return_value, outcome`
+
+func InsertAttempt(db DBTX, attempt Attempt) (int, error) {
+	const query string = `
+        INSERT INTO relay_attempts (relay_id, kind, started_at, duration_ms, http_status, error_body, error, return_value, outcome)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("InsertAttempt: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(attempt.RelayId, attempt.Kind, attempt.StartedAt, attempt.DurationMs, attempt.HttpStatus,
+		attempt.ErrorBody, attempt.Error, attempt.ReturnValue, attempt.Outcome)
+	if err != nil {
+		return 0, fmt.Errorf("InsertAttempt: stmt.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("InsertAttempt: result.LastInsertId: %w", err)
+	}
+	return int(id), nil
+}
+
+// Selects the attempts of a relay, oldest first
+func SelectAttempts(db DBTX, relayId int) ([]Attempt, error) {
+	const query string = `SELECT ` + attemptColumns + ` FROM relay_attempts WHERE relay_id = ? ORDER BY id`
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectAttempts: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(relayId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectAttempts: stmt.Query: %w", err)
+	}
+	defer rows.Close()
+
+	attempts := []Attempt{}
+	for rows.Next() {
+		var attempt Attempt
+		err := rows.Scan(&attempt.Id, &attempt.RelayId, &attempt.Kind, &attempt.StartedAt, &attempt.DurationMs, &attempt.HttpStatus,
+			&attempt.ErrorBody, &attempt.Error, &attempt.ReturnValue, &attempt.Outcome)
+		if err != nil {
+			return nil, fmt.Errorf("SelectAttempts: rows.Scan: %w", err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectAttempts: rows.Err: %w", err)
+	}
+	return attempts, nil
+}
@@ -85,8 +85,31 @@ func DeleteCancellation(db *sql.DB, id int) error {
 		return fmt.Errorf("DeleteCancellation: result.RowsAffected: %w", err)
 	}
 
-	if rowsAffected != 1 {
+	// Another instance sharing the database may have processed it first
+	if rowsAffected > 1 {
 		return fmt.Errorf("DeleteCancellation: rowsAffect want=1, got=%d", rowsAffected)
 	}
 	return nil
 }
+
+// Requests the cancellation of every ready relay matching the filter, whose statuses are ignored.
+// Returns the number of relays whose cancellation was requested, not counting those already awaiting cancellation.
+func InsertCancellationsByFilter(db DBTX, filter RelayFilter) (int, error) {
+	filter.Statuses = []RelayStatus{RelayReady}
+	where, params := filter.where()
+	query := `
+        INSERT OR IGNORE INTO cancellations (relay_id)
+        SELECT r.id
+        FROM relays r
+        JOIN devices d ON d.id = r.device_key
+        WHERE ` + where
+	result, err := db.Exec(query, params...)
+	if err != nil {
+		return 0, fmt.Errorf("InsertCancellationsByFilter: db.Exec: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("InsertCancellationsByFilter: result.RowsAffected: %w", err)
+	}
+	return int(rowsAffected), nil
+}
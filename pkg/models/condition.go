@@ -0,0 +1,90 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// What happens to a relay when its cloud function's return value does not meet a condition
+const (
+	MismatchFail  = "fail"
+	MismatchRetry = "retry"
+)
+
+// A requirement on the value returned by a relay's cloud function. The value must be one of Codes, within Min and Max
+// and not one of Not, fields which are not set are ignored.
+type SuccessCondition struct {
+	Codes []int `json:"codes,omitempty"`
+	Min   *int  `json:"min,omitempty"`
+	Max   *int  `json:"max,omitempty"`
+	Not   []int `json:"not,omitempty"`
+	// fail (default) or retry, retries count against the cloud function retry policy
+	OnMismatch string `json:"on_mismatch,omitempty"`
+}
+
+func (c SuccessCondition) Matches(returnValue int) bool {
+	if len(c.Codes) > 0 && !slices.Contains(c.Codes, returnValue) {
+		return false
+	}
+	if c.Min != nil && returnValue < *c.Min {
+		return false
+	}
+	if c.Max != nil && returnValue > *c.Max {
+		return false
+	}
+	return !slices.Contains(c.Not, returnValue)
+}
+
+func (c SuccessCondition) Validate() error {
+	if len(c.Codes) == 0 && c.Min == nil && c.Max == nil && len(c.Not) == 0 {
+		return fmt.Errorf("condition must set at least one of codes, min, max and not")
+	}
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		return fmt.Errorf("condition min %d is greater than max %d", *c.Min, *c.Max)
+	}
+	if c.OnMismatch != "" && c.OnMismatch != MismatchFail && c.OnMismatch != MismatchRetry {
+		return fmt.Errorf("unknown on_mismatch %s, must be fail or retry", c.OnMismatch)
+	}
+	return nil
+}
+
+// Checks a cloud function's return value against the relay's desired return code and then its conditions, in order.
+// Returns the condition which was not met, nil if the relay succeeded.
+func (t Relay) FailedCondition(returnValue int) *SuccessCondition {
+	conditions := t.SuccessConditions
+	if t.DesiredReturnCode != nil {
+		desired := SuccessCondition{Codes: []int{*t.DesiredReturnCode}, OnMismatch: MismatchFail}
+		conditions = append([]SuccessCondition{desired}, conditions...)
+	}
+	for _, condition := range conditions {
+		if !condition.Matches(returnValue) {
+			return &condition
+		}
+	}
+	return nil
+}
+
+// Conditions are stored as json, an empty string for none
+func marshalConditions(conditions []SuccessCondition) (string, error) {
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(conditions)
+	if err != nil {
+		return "", fmt.Errorf("marshalConditions: json.Marshal: %w", err)
+	}
+	return string(data), nil
+}
+
+func unmarshalConditions(data string) ([]SuccessCondition, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var conditions []SuccessCondition
+	err := json.Unmarshal([]byte(data), &conditions)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalConditions: json.Unmarshal: %w", err)
+	}
+	return conditions, nil
+}
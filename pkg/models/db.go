@@ -0,0 +1,13 @@
+package models
+
+import (
+	"database/sql"
+)
+
+// Implemented by both *sql.DB and *sql.Tx, so that the functions taking it can run inside a transaction
+type DBTX interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
@@ -13,6 +13,25 @@ type CreateRelayRequest struct {
 	DesiredReturnCode *int    `json:"desired_return_code,omitempty"`
 	// TODO time comes in a as a string need to parse
 	ScheduledTime *time.Time `json:"scheduled_time,omitempty"`
+	// Name of a retry policy in the config, the default policy is used if not set
+	RetryPolicy *string `json:"retry_policy,omitempty"`
+	// The relay expires if it has not run by expires_at, or ttl_seconds after the scheduled time. Only one may be set
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	TtlSeconds *int       `json:"ttl_seconds,omitempty"`
+	// Higher priority relays run first, defaults to 0
+	Priority *int `json:"priority,omitempty"`
+	// Ids of relays which must complete before this one runs
+	DependsOn []int `json:"depends_on,omitempty"`
+	// cancel (default) or run, what happens to the relay if a parent fails, is cancelled or expires
+	OnDependencyFailure *string `json:"on_dependency_failure,omitempty"`
+	// Checked in order after desired_return_code, the first one the return value does not meet fails or retries the relay
+	SuccessConditions []SuccessCondition `json:"success_conditions,omitempty"`
+	// A new relay for the device with the same key supersedes ready relays with the key, so that only the latest runs
+	CoalesceKey *string `json:"coalesce_key,omitempty"`
+	// Posted the relay's final status like a webhook, signed with the configured webhook secret
+	CallbackUrl *string `json:"callback_url,omitempty"`
+	// Idempotency key, alternative to the Idempotency-Key header. Only used by POST /api/relays.
+	ClientRequestId *string `json:"client_request_id,omitempty"`
 }
 
 func (p CreateRelayRequest) String() string {
@@ -23,5 +42,181 @@ func (p CreateRelayRequest) String() string {
 	if p.DesiredReturnCode != nil {
 		str += fmt.Sprintf(", desired return code: %d", *p.DesiredReturnCode)
 	}
+	if p.RetryPolicy != nil {
+		str += fmt.Sprintf(", retry policy: %s", *p.RetryPolicy)
+	}
+	if p.ExpiresAt != nil {
+		str += fmt.Sprintf(", expires at: %s", *p.ExpiresAt)
+	}
+	if p.TtlSeconds != nil {
+		str += fmt.Sprintf(", ttl seconds: %d", *p.TtlSeconds)
+	}
+	if p.Priority != nil {
+		str += fmt.Sprintf(", priority: %d", *p.Priority)
+	}
+	if len(p.DependsOn) > 0 {
+		str += fmt.Sprintf(", depends on: %v", p.DependsOn)
+	}
+	if p.OnDependencyFailure != nil {
+		str += fmt.Sprintf(", on dependency failure: %s", *p.OnDependencyFailure)
+	}
+	if len(p.SuccessConditions) > 0 {
+		str += fmt.Sprintf(", success conditions: %+v", p.SuccessConditions)
+	}
+	if p.CoalesceKey != nil {
+		str += fmt.Sprintf(", coalesce key: %s", *p.CoalesceKey)
+	}
+	if p.CallbackUrl != nil {
+		str += fmt.Sprintf(", callback url: %s", *p.CallbackUrl)
+	}
+	return str
+}
+
+// Creates many relays in one transaction
+type CreateRelaysRequest struct {
+	Relays []CreateRelayRequest `json:"relays"`
+	// all_or_nothing (default) creates none of the relays if any of them is invalid, best_effort creates the valid ones
+	Mode *string `json:"mode,omitempty"`
+}
+
+const (
+	BatchAllOrNothing = "all_or_nothing"
+	BatchBestEffort   = "best_effort"
+)
+
+// One of the relay id or the reason the relay is invalid. The id is not set for valid relays if the batch was rejected.
+type CreateRelayResult struct {
+	RelayId *int    `json:"relay_id,omitempty"`
+	Error   *string `json:"error,omitempty"`
+}
+
+// Results are in the order of the requested relays
+type CreateRelaysResponse struct {
+	Results []CreateRelayResult `json:"results"`
+}
+
+// Subscribes url to relay events
+type CreateWebhookRequest struct {
+	Url string `json:"url"`
+	// Key of the deliveries' HMAC signature, generated if not set
+	Secret *string `json:"secret,omitempty"`
+	// Only deliver the events of this relay
+	RelayId *int `json:"relay_id,omitempty"`
+	// Names of the events to deliver: complete, failed, cancelled, expired or superseded. Every event if empty.
+	Events []string `json:"events,omitempty"`
+}
+
+// The created webhook along with its secret, which is not returned again when listing webhooks
+type CreateWebhookResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// Number of relays whose cancellation was requested, they are cancelled by the background task unless they start
+// running first
+type CancelRelaysResponse struct {
+	Cancelled int `json:"cancelled"`
+}
+
+// Query of GET /api/relays
+type ListRelaysRequest struct {
+	RelayFilter
+	// One of the RelaySort fields, defaults to id
+	Sort string
+	Desc bool
+	// Relays per page, defaults to 100
+	Limit int
+}
+
+// A page of relays, NextCursor is set if there are more
+type ListRelaysResponse struct {
+	Relays     []Relay `json:"relays"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// Changes to a ready relay, fields which are not set are left as they are
+type UpdateRelayRequest struct {
+	// The version of the relay the changes are based on, the update is rejected if the relay changed since
+	Version           *int       `json:"version,omitempty"`
+	ScheduledTime     *time.Time `json:"scheduled_time,omitempty"`
+	Argument          *string    `json:"argument,omitempty"`
+	DesiredReturnCode *int       `json:"desired_return_code,omitempty"`
+	// Removes the desired return code, so any return value succeeds
+	ClearDesiredReturnCode bool       `json:"clear_desired_return_code,omitempty"`
+	ExpiresAt              *time.Time `json:"expires_at,omitempty"`
+	// Removes the expiry, so the relay never expires
+	ClearExpiresAt bool    `json:"clear_expires_at,omitempty"`
+	Priority       *int    `json:"priority,omitempty"`
+	RetryPolicy    *string `json:"retry_policy,omitempty"`
+	// Replaces the success conditions, an empty list removes them
+	SuccessConditions []SuccessCondition `json:"success_conditions"`
+}
+
+// How to retry a relay which failed, expired or was cancelled
+type RetryRelayRequest struct {
+	// reset (default) makes the relay ready again under its id, clone creates a new relay with retry_of set to it
+	Mode *string `json:"mode,omitempty"`
+	// Defaults to now
+	ScheduledTime *time.Time `json:"scheduled_time,omitempty"`
+	// Cloud function attempts allowed, at least 1, the relay's retry policy decides if not set
+	MaxTries *int `json:"max_tries,omitempty"`
+}
+
+const (
+	RetryReset = "reset"
+	RetryClone = "clone"
+)
+
+type RetryRelayResponse struct {
+	// The relay which will run, the new relay when cloning
+	RelayId int `json:"relay_id"`
+}
+
+// Retries every relay matching the filter. Statuses default to failed and may only be failed, expired, cancelled or needs review.
+type RetryRelaysRequest struct {
+	RelayFilter
+	RetryRelayRequest
+}
+
+type RetryRelaysResponse struct {
+	RelayIds []int `json:"relay_ids"`
+}
+
+type CreateScheduleRequest struct {
+	DeviceId          string  `json:"device_id"`
+	CloudFunction     string  `json:"cloud_function"`
+	Argument          *string `json:"argument,omitempty"`
+	DesiredReturnCode *int    `json:"desired_return_code,omitempty"`
+	// 5 field cron expression, ie "0 3 * * *" for every night at 3am
+	Cron string `json:"cron"`
+	// IANA timezone the cron expression is evaluated in, UTC if not set
+	Timezone *string `json:"timezone,omitempty"`
+	// skip or allow, defaults to skip
+	OverlapPolicy *string `json:"overlap_policy,omitempty"`
+	RetryPolicy   *string `json:"retry_policy,omitempty"`
+	// Each relay expires this many seconds after its occurrence
+	TtlSeconds *int `json:"ttl_seconds,omitempty"`
+}
+
+func (p CreateScheduleRequest) String() string {
+	str := fmt.Sprintf("device: %s, function: %s, cron: %s", p.DeviceId, p.CloudFunction, p.Cron)
+	if p.Argument != nil {
+		str += fmt.Sprintf(", argument: %s", *p.Argument)
+	}
+	if p.DesiredReturnCode != nil {
+		str += fmt.Sprintf(", desired return code: %d", *p.DesiredReturnCode)
+	}
+	if p.Timezone != nil {
+		str += fmt.Sprintf(", timezone: %s", *p.Timezone)
+	}
+	if p.OverlapPolicy != nil {
+		str += fmt.Sprintf(", overlap policy: %s", *p.OverlapPolicy)
+	}
+	if p.RetryPolicy != nil {
+		str += fmt.Sprintf(", retry policy: %s", *p.RetryPolicy)
+	}
+	if p.TtlSeconds != nil {
+		str += fmt.Sprintf(", ttl seconds: %d", *p.TtlSeconds)
+	}
 	return str
 }
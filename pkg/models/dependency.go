@@ -0,0 +1,89 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// What happens to a relay when one of its parents does not complete
+const (
+	DependencyFailureCancel = "cancel"
+	DependencyFailureRun    = "run"
+)
+
+// True for a relay r which is waiting on a parent, or whose parent did not complete and which is to be cancelled.
+// A parent needing review blocks its dependents until it is resolved.
+var relayBlocked = fmt.Sprintf(`EXISTS (
+        SELECT 1
+        FROM relay_dependencies d
+        JOIN relays p ON p.id = d.parent_id
+        WHERE d.relay_id = r.id
+        AND (p.status IN (%d, %d, %d) OR (p.status != %d AND r.on_dependency_failure = '%s'))
+    )`, RelayReady, RelayRunning, RelayNeedsReview, RelayComplete, DependencyFailureCancel)
+
+func InsertRelayDependency(db DBTX, relayId int, parentId int) error {
+	const query string = `INSERT INTO relay_dependencies (relay_id, parent_id) VALUES (?, ?)`
+	_, err := db.Exec(query, relayId, parentId)
+	if err != nil {
+		return fmt.Errorf("InsertRelayDependency: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// Returns the ids of the relay's parents
+func SelectRelayDependencies(db DBTX, relayId int) ([]int, error) {
+	const query string = `SELECT parent_id FROM relay_dependencies WHERE relay_id = ? ORDER BY parent_id`
+	rows, err := db.Query(query, relayId)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRelayDependencies: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var parentIds []int
+	for rows.Next() {
+		var parentId int
+		if err := rows.Scan(&parentId); err != nil {
+			return nil, fmt.Errorf("SelectRelayDependencies: rows.Scan: %w", err)
+		}
+		parentIds = append(parentIds, parentId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectRelayDependencies: rows.Err: %w", err)
+	}
+	return parentIds, nil
+}
+
+// Selects ready relays which are to be cancelled because a parent failed, was cancelled, expired or was superseded
+func SelectRelaysWithFailedParents(db *sql.DB, limit int) ([]int, error) {
+	query := fmt.Sprintf(`
+        SELECT r.id
+        FROM relays r
+        WHERE r.status = %d AND r.on_dependency_failure = '%s'
+        AND EXISTS (
+            SELECT 1
+            FROM relay_dependencies d
+            JOIN relays p ON p.id = d.parent_id
+            WHERE d.relay_id = r.id AND p.status IN (%d, %d, %d, %d)
+        )
+        ORDER BY r.id
+        LIMIT ?
+        `, RelayReady, DependencyFailureCancel, RelayFailed, RelayCancelled, RelayExpired, RelaySuperseded)
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRelaysWithFailedParents: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var relayIds []int
+	for rows.Next() {
+		var relayId int
+		if err := rows.Scan(&relayId); err != nil {
+			return nil, fmt.Errorf("SelectRelaysWithFailedParents: rows.Scan: %w", err)
+		}
+		relayIds = append(relayIds, relayId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectRelaysWithFailedParents: rows.Err: %w", err)
+	}
+	return relayIds, nil
+}
@@ -10,10 +10,14 @@ type Device struct {
 	Id         int        `json:"id"`
 	DeviceId   string     `json:"device_id"`
 	LastOnline *time.Time `json:"last_online"`
+	// Last time the device was found offline or timed out
+	LastOffline *time.Time `json:"last_offline"`
 }
 
-func SelectDevice(db *sql.DB, key int) (*Device, error) {
-	const query string = `SELECT * FROM devices WHERE id = ?`
+const deviceColumns string = `id, device_id, last_online, last_offline`
+
+func SelectDevice(db DBTX, key int) (*Device, error) {
+	const query string = `SELECT ` + deviceColumns + ` FROM devices WHERE id = ?`
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, fmt.Errorf("SelectDevice: db.Prepare: %w", err)
@@ -22,7 +26,7 @@ func SelectDevice(db *sql.DB, key int) (*Device, error) {
 
 	row := stmt.QueryRow(key)
 	var device Device
-	err = row.Scan(&device.Id, &device.DeviceId, &device.LastOnline)
+	err = row.Scan(&device.Id, &device.DeviceId, &device.LastOnline, &device.LastOffline)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -32,8 +36,8 @@ func SelectDevice(db *sql.DB, key int) (*Device, error) {
 	return &device, nil
 }
 
-func SelectDeviceByDeviceId(db *sql.DB, deviceId string) (*Device, error) {
-	const query string = `SELECT * FROM devices WHERE device_id = ?`
+func SelectDeviceByDeviceId(db DBTX, deviceId string) (*Device, error) {
+	const query string = `SELECT ` + deviceColumns + ` FROM devices WHERE device_id = ?`
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, fmt.Errorf("SelectDeviceByDeviceId: db.Prepare: %w", err)
@@ -41,7 +45,7 @@ func SelectDeviceByDeviceId(db *sql.DB, deviceId string) (*Device, error) {
 	defer stmt.Close()
 
 	var device Device
-	err = stmt.QueryRow(deviceId).Scan(&device.Id, &device.DeviceId, &device.LastOnline)
+	err = stmt.QueryRow(deviceId).Scan(&device.Id, &device.DeviceId, &device.LastOnline, &device.LastOffline)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -78,7 +82,38 @@ func UpdateDevice(db *sql.DB, id int, onlineTime *time.Time) error {
 	return nil
 }
 
-func InsertDevice(db *sql.DB, deviceId string) (int, error) {
+func UpdateDeviceOffline(db *sql.DB, id int, offlineTime time.Time) error {
+	const query string = `
+        UPDATE devices
+        SET last_offline = ?
+        WHERE id = ?
+    `
+	result, err := db.Exec(query, offlineTime, id)
+	if err != nil {
+		return fmt.Errorf("UpdateDeviceOffline: db.Exec: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("UpdateDeviceOffline: result.rowsAffected: %w", err)
+	}
+	if rowsAffected != 1 {
+		return fmt.Errorf("UpdateDeviceOffline: expected to affect 1 row, affected %d", rowsAffected)
+	}
+	return nil
+}
+
+// Whether the device was last seen online within freshness, and not found offline since
+func (d Device) IsOnline(now time.Time, freshness time.Duration) bool {
+	if d.LastOnline == nil {
+		return false
+	}
+	if d.LastOffline != nil && !d.LastOnline.After(*d.LastOffline) {
+		return false
+	}
+	return now.Sub(*d.LastOnline) < freshness
+}
+
+func InsertDevice(db DBTX, deviceId string) (int, error) {
 	const query string = `INSERT INTO devices (device_id, last_online) VALUES (?, ?)`
 	stmt, err := db.Prepare(query)
 	if err != nil {
@@ -100,7 +135,7 @@ func InsertDevice(db *sql.DB, deviceId string) (int, error) {
 // Inserts a device into the devices table if it doesn't exist
 // Returns priamary key for the device
 // TODO: This can be 1 sql statement
-func InsertOrUpdateDevice(db *sql.DB, deviceId string) (int, error) {
+func InsertOrUpdateDevice(db DBTX, deviceId string) (int, error) {
 	device, err := SelectDeviceByDeviceId(db, deviceId)
 	if err != nil {
 		return -1, fmt.Errorf("InsertOrUpdateDevice: %w", err)
@@ -110,3 +145,90 @@ func InsertOrUpdateDevice(db *sql.DB, deviceId string) (int, error) {
 	}
 	return InsertDevice(db, deviceId)
 }
+
+// A device with counts of its relays, for an overview of which devices have work waiting
+type DeviceSummary struct {
+	Device
+	// Ready or running relays
+	PendingRelays   int `json:"pending_relays"`
+	FailedRelays    int `json:"failed_relays"`
+	CompletedRelays int `json:"completed_relays"`
+	// The ready relay which is scheduled first, nil if there is none
+	NextRelay *Relay `json:"next_relay"`
+}
+
+// Selects the summaries of every device ordered by device id, or only of the device with key deviceKey if it is not nil.
+// If onlyPending is set, devices without pending relays are left out.
+func SelectDeviceSummaries(db DBTX, deviceKey *int, onlyPending bool) ([]DeviceSummary, error) {
+	query := `
+        SELECT d.id, d.device_id, d.last_online, d.last_offline,
+        COALESCE(SUM(r.status IN (?, ?)), 0), COALESCE(SUM(r.status = ?), 0), COALESCE(SUM(r.status = ?), 0)
+        FROM devices d
+        LEFT JOIN relays r ON r.device_key = d.id
+        `
+	params := []interface{}{RelayReady, RelayRunning, RelayFailed, RelayComplete}
+	if deviceKey != nil {
+		query += " WHERE d.id = ?"
+		params = append(params, *deviceKey)
+	}
+	query += " GROUP BY d.id"
+	if onlyPending {
+		query += " HAVING SUM(r.status IN (?, ?)) > 0"
+		params = append(params, RelayReady, RelayRunning)
+	}
+	query += " ORDER BY d.device_id"
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectDeviceSummaries: db.Query: %w", err)
+	}
+	summaries := []DeviceSummary{}
+	for rows.Next() {
+		var s DeviceSummary
+		err := rows.Scan(&s.Id, &s.DeviceId, &s.LastOnline, &s.LastOffline, &s.PendingRelays, &s.FailedRelays, &s.CompletedRelays)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("SelectDeviceSummaries: rows.Scan: %w", err)
+		}
+		summaries = append(summaries, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectDeviceSummaries: rows.Err: %w", err)
+	}
+
+	// Selected once the rows are closed, an in memory database can not run a query while another one is open
+	for i := range summaries {
+		if summaries[i].PendingRelays == 0 {
+			continue
+		}
+		summaries[i].NextRelay, err = selectNextRelay(db, summaries[i].Id)
+		if err != nil {
+			return nil, fmt.Errorf("SelectDeviceSummaries: %w", err)
+		}
+	}
+	return summaries, nil
+}
+
+// Selects the device's ready relay which is scheduled first, the highest priority one on ties
+func selectNextRelay(db DBTX, deviceKey int) (*Relay, error) {
+	const query string = `
+        SELECT id FROM relays
+        WHERE device_key = ? AND status = ?
+        ORDER BY scheduled_time, priority DESC, id
+        LIMIT 1
+        `
+	var relayId int
+	err := db.QueryRow(query, deviceKey, RelayReady).Scan(&relayId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("selectNextRelay: db.QueryRow: %w", err)
+	}
+	relay, err := SelectRelay(db, relayId)
+	if err != nil {
+		return nil, fmt.Errorf("selectNextRelay: %w", err)
+	}
+	return relay, nil
+}
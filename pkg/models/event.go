@@ -0,0 +1,104 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event types
+const (
+	EventRelayCreated    = "relay.created"
+	EventRelayAttempted  = "relay.attempted"
+	EventRelayCompleted  = "relay.completed"
+	EventRelayFailed     = "relay.failed"
+	EventRelayCancelled  = "relay.cancelled"
+	EventRelayExpired    = "relay.expired"
+	EventRelaySuperseded = "relay.superseded"
+	EventDeviceOnline    = "device.online"
+	EventDeviceOffline   = "device.offline"
+)
+
+// A relay or device event, recorded by triggers on the relays, relay_attempts and devices tables
+type Event struct {
+	Id       int    `json:"id"`
+	Type     string `json:"type"`
+	DeviceId string `json:"device_id"`
+	// Not set for device events
+	RelayId *int `json:"relay_id"`
+	// Details of the event, ie the relay's status or the attempt's outcome
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// Limits events to those of a device or relay
+type EventFilter struct {
+	DeviceId *string `json:"device_id"`
+	RelayId  *int    `json:"relay_id"`
+}
+
+// Selects up to limit events after the event with id after, oldest first
+func SelectEvents(db DBTX, after int, filter EventFilter, limit int) ([]Event, error) {
+	query := `
+        SELECT id, type, device_id, relay_id, data, created_at
+        FROM events
+        WHERE id > ?`
+	params := []interface{}{after}
+	if filter.DeviceId != nil {
+		query += ` AND device_id = ?`
+		params = append(params, *filter.DeviceId)
+	}
+	if filter.RelayId != nil {
+		query += ` AND relay_id = ?`
+		params = append(params, *filter.RelayId)
+	}
+	query += ` ORDER BY id LIMIT ?`
+	params = append(params, limit)
+
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectEvents: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var event Event
+		var data string
+		if err := rows.Scan(&event.Id, &event.Type, &event.DeviceId, &event.RelayId, &data, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("SelectEvents: rows.Scan: %w", err)
+		}
+		event.Data = json.RawMessage(data)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectEvents: rows.Err: %w", err)
+	}
+	return events, nil
+}
+
+// Returns the id of the latest event, 0 if there are none
+func SelectLastEventId(db DBTX) (int, error) {
+	const query string = `SELECT COALESCE(MAX(id), 0) FROM events`
+	var id int
+	err := db.QueryRow(query).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("SelectLastEventId: row.Scan: %w", err)
+	}
+	return id, nil
+}
+
+// Deletes the events recorded before the time, returns the number deleted
+func DeleteEvents(db DBTX, before time.Time) (int, error) {
+	const query string = `DELETE FROM events WHERE created_at < ?`
+	// The triggers write created_at in UTC without a timezone, in the same format as strftime
+	result, err := db.Exec(query, before.UTC().Format("2006-01-02 15:04:05.000"))
+	if err != nil {
+		return 0, fmt.Errorf("DeleteEvents: db.Exec: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteEvents: result.RowsAffected: %w", err)
+	}
+	return int(deleted), nil
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Selects relays by their fields, fields which are not set match every relay
+type RelayFilter struct {
+	DeviceId      *string       `json:"device_id,omitempty"`
+	CloudFunction *string       `json:"cloud_function,omitempty"`
+	Statuses      []RelayStatus `json:"statuses,omitempty"`
+	// Scheduled at or after ScheduledAfter and before ScheduledBefore
+	ScheduledAfter  *time.Time `json:"scheduled_after,omitempty"`
+	ScheduledBefore *time.Time `json:"scheduled_before,omitempty"`
+	// Created at or after CreatedAfter and before CreatedBefore, relays created before created_at was recorded never match
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+}
+
+// Whether the filter has no fields set and so matches every relay
+func (f RelayFilter) IsEmpty() bool {
+	return f.DeviceId == nil && f.CloudFunction == nil && len(f.Statuses) == 0 &&
+		f.ScheduledAfter == nil && f.ScheduledBefore == nil && f.CreatedAfter == nil && f.CreatedBefore == nil
+}
+
+// Fields relays can be listed by, ties are broken by id. Ids are in the order the relays were created.
+const (
+	RelaySortId            = "id"
+	RelaySortScheduledTime = "scheduled_time"
+)
+
+// Order of a list of relays, Sort is one of the RelaySort fields, defaulting to id
+type RelayOrder struct {
+	Sort string
+	Desc bool
+}
+
+// Position of the last relay of a page, the next page starts after it
+type RelayCursor struct {
+	Id            int       `json:"id"`
+	ScheduledTime time.Time `json:"scheduled_time"`
+}
+
+// Returns the conditions of a WHERE clause on relays r joined with devices d, and their parameters
+func (f RelayFilter) where() (string, []interface{}) {
+	where := "1 = 1"
+	var params []interface{}
+	if f.DeviceId != nil {
+		where += " AND d.device_id = ?"
+		params = append(params, *f.DeviceId)
+	}
+	if f.CloudFunction != nil {
+		where += " AND r.cloud_function = ?"
+		params = append(params, *f.CloudFunction)
+	}
+	if len(f.Statuses) > 0 {
+		where += " AND r.status IN (" + placeholders(len(f.Statuses)) + ")"
+		for _, status := range f.Statuses {
+			params = append(params, int(status))
+		}
+	}
+	if f.ScheduledAfter != nil {
+		where += " AND r.scheduled_time >= ?"
+		params = append(params, f.ScheduledAfter.UTC())
+	}
+	if f.ScheduledBefore != nil {
+		where += " AND r.scheduled_time < ?"
+		params = append(params, f.ScheduledBefore.UTC())
+	}
+	if f.CreatedAfter != nil {
+		where += " AND r.created_at >= ?"
+		params = append(params, f.CreatedAfter.UTC())
+	}
+	if f.CreatedBefore != nil {
+		where += " AND r.created_at < ?"
+		params = append(params, f.CreatedBefore.UTC())
+	}
+	return where, params
+}
+
+// Selects the ids of up to limit relays matching the filter, oldest first
+func SelectRelayIdsByFilter(db DBTX, filter RelayFilter, limit int) ([]int, error) {
+	relayIds, err := SelectRelayIdsPage(db, filter, RelayOrder{}, nil, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRelayIdsByFilter: %w", err)
+	}
+	return relayIds, nil
+}
+
+// Selects the ids of up to limit relays matching the filter in order, starting after the cursor unless it is nil
+func SelectRelayIdsPage(db DBTX, filter RelayFilter, order RelayOrder, after *RelayCursor, limit int) ([]int, error) {
+	where, params := filter.where()
+	cmp, dir := ">", "ASC"
+	if order.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	var orderBy string
+	switch order.Sort {
+	case "", RelaySortId:
+		orderBy = "r.id " + dir
+		if after != nil {
+			where += " AND r.id " + cmp + " ?"
+			params = append(params, after.Id)
+		}
+	case RelaySortScheduledTime:
+		orderBy = "r.scheduled_time " + dir + ", r.id " + dir
+		if after != nil {
+			where += " AND (r.scheduled_time " + cmp + " ? OR (r.scheduled_time = ? AND r.id " + cmp + " ?))"
+			params = append(params, after.ScheduledTime.UTC(), after.ScheduledTime.UTC(), after.Id)
+		}
+	default:
+		return nil, fmt.Errorf("SelectRelayIdsPage: unknown sort %s", order.Sort)
+	}
+
+	query := `
+        SELECT r.id
+        FROM relays r
+        JOIN devices d ON d.id = r.device_key
+        WHERE ` + where + `
+        ORDER BY ` + orderBy + `
+        LIMIT ?
+        `
+	params = append(params, limit)
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRelayIdsPage: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var relayIds []int
+	for rows.Next() {
+		var relayId int
+		if err := rows.Scan(&relayId); err != nil {
+			return nil, fmt.Errorf("SelectRelayIdsPage: rows.Scan: %w", err)
+		}
+		relayIds = append(relayIds, relayId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectRelayIdsPage: rows.Err: %w", err)
+	}
+	return relayIds, nil
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The relay created by the request with Key, RequestHash identifies the request's payload
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string
+	RelayId     int
+	CreatedAt   time.Time
+}
+
+func SelectIdempotencyKey(db DBTX, key string) (*IdempotencyKey, error) {
+	const query string = `SELECT key, request_hash, relay_id, created_at FROM idempotency_keys WHERE key = ?`
+	var k IdempotencyKey
+	err := db.QueryRow(query, key).Scan(&k.Key, &k.RequestHash, &k.RelayId, &k.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SelectIdempotencyKey: db.QueryRow: %w", err)
+	}
+	return &k, nil
+}
+
+// Inserts the key, replacing an expired key of the same name
+func InsertIdempotencyKey(db DBTX, key IdempotencyKey) error {
+	const query string = `
+        INSERT OR REPLACE INTO idempotency_keys (key, request_hash, relay_id, created_at)
+        VALUES (?, ?, ?, ?)
+        `
+	_, err := db.Exec(query, key.Key, key.RequestHash, key.RelayId, key.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("InsertIdempotencyKey: db.Exec: %w", err)
+	}
+	return nil
+}
+
+// Deletes the keys created before the time, returns the number of keys deleted
+func DeleteIdempotencyKeys(db DBTX, before time.Time) (int, error) {
+	const query string = `DELETE FROM idempotency_keys WHERE created_at < ?`
+	result, err := db.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("DeleteIdempotencyKeys: db.Exec: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("DeleteIdempotencyKeys: result.RowsAffected: %w", err)
+	}
+	return int(rowsAffected), nil
+}
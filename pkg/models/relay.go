@@ -3,6 +3,7 @@ package models
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -16,6 +17,58 @@ type Relay struct {
 	ScheduledTime     time.Time   `json:"scheduled_time"`
 	Status            RelayStatus `json:"status"`
 	Tries             int         `json:"tries"`
+	// Set while the relay is running, identifies the process running it and until when
+	LeaseOwner   *string    `json:"lease_owner"`
+	LeaseExpires *time.Time `json:"lease_expires"`
+	// Name of the retry policy in the config, empty for the default policy
+	RetryPolicy string `json:"retry_policy"`
+	// Number of times the device was found offline
+	Pings int `json:"pings"`
+	// The relay expires if it has not run by then
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Set if the relay is an occurrence of a recurring schedule
+	ScheduleId *int `json:"schedule_id"`
+	// Higher priority relays run first, both among a device's relays and across devices
+	Priority int `json:"priority"`
+	// Relays which must complete before this one runs
+	DependsOn []int `json:"depends_on,omitempty"`
+	// cancel or run, what happens to the relay if a parent fails, is cancelled or expires
+	OnDependencyFailure string `json:"on_dependency_failure"`
+	// Checked in order after the desired return code, the relay completes if its return value meets all of them
+	SuccessConditions []SuccessCondition `json:"success_conditions,omitempty"`
+	// Overrides the max cloud function attempts of the retry policy, set when the relay is retried by hand
+	MaxTries *int `json:"max_tries"`
+	// The relay this one was cloned from to retry it
+	RetryOf *int `json:"retry_of"`
+	// Incremented on every change to the relay, so that an update can be made conditional on no changes since it was read
+	Version int `json:"version"`
+	// Not set for relays created before it was recorded
+	CreatedAt *time.Time `json:"created_at"`
+	// A new relay for the device with the same key supersedes this one while it is ready
+	CoalesceKey *string `json:"coalesce_key"`
+	// The relay which superseded this one
+	SupersededBy *int `json:"superseded_by"`
+	// Notified of the relay's final status like a webhook
+	CallbackUrl *string `json:"callback_url"`
+	// Only loaded when asked for
+	Attempts []Attempt `json:"attempts,omitempty"`
+}
+
+// Optional settings of a new relay
+type RelayOptions struct {
+	RetryPolicy string
+	ExpiresAt   *time.Time
+	ScheduleId  *int
+	Priority    int
+	// Ids of existing relays, these are inserted by server.CreateRelay
+	DependsOn []int
+	// Defaults to DependencyFailureCancel
+	OnDependencyFailure string
+	SuccessConditions   []SuccessCondition
+	MaxTries            *int
+	RetryOf             *int
+	CoalesceKey         *string
+	CallbackUrl         *string
 }
 
 func (t Relay) String() string {
@@ -29,10 +82,23 @@ const (
 	RelayFailed    RelayStatus = 1
 	RelayComplete  RelayStatus = 2
 	RelayCancelled RelayStatus = 3
+	// Leased by a process which is about to call or is calling the cloud function
+	RelayRunning RelayStatus = 4
+	// The lease expired, so it is unknown if the cloud function ran
+	RelayNeedsReview RelayStatus = 5
+	// Did not run before its expires_at deadline
+	RelayExpired RelayStatus = 6
+	// Replaced by a newer relay with the same coalesce key before it ran
+	RelaySuperseded RelayStatus = 7
 )
 
-func SelectRelay(db *sql.DB, id int) (*Relay, error) {
-	const query string = `SELECT * FROM relays WHERE id = ?`
+const relayColumns string = `id, device_key, cloud_function, argument, desired_return_code, scheduled_time, status, tries,
+        lease_owner, lease_expires, retry_policy, pings, expires_at, schedule_id, priority, on_dependency_failure,
+        success_conditions, max_tries, retry_of, version, created_at,
+        coalesce_key, superseded_by, callback_url`
+
+func SelectRelay(db DBTX, id int) (*Relay, error) {
+	const query string = `SELECT ` + relayColumns + ` FROM relays WHERE id = ?`
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, fmt.Errorf("SelectRelay: db.Prepare: %w", err)
@@ -42,31 +108,48 @@ func SelectRelay(db *sql.DB, id int) (*Relay, error) {
 	row := stmt.QueryRow(id)
 	var relay Relay
 	var deviceKey int
+	var conditions string
 	err = row.Scan(&relay.Id, &deviceKey, &relay.CloudFunction, &relay.Argument,
-		&relay.DesiredReturnCode, &relay.ScheduledTime, &relay.Status, &relay.Tries)
+		&relay.DesiredReturnCode, &relay.ScheduledTime, &relay.Status, &relay.Tries,
+		&relay.LeaseOwner, &relay.LeaseExpires, &relay.RetryPolicy, &relay.Pings, &relay.ExpiresAt, &relay.ScheduleId, &relay.Priority, &relay.OnDependencyFailure,
+		&conditions, &relay.MaxTries, &relay.RetryOf, &relay.Version, &relay.CreatedAt,
+		&relay.CoalesceKey, &relay.SupersededBy, &relay.CallbackUrl)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, fmt.Errorf("SelectRelay: row.Scan: %w", err)
 	}
+	relay.SuccessConditions, err = unmarshalConditions(conditions)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRelay: %w on relay %d", err, relay.Id)
+	}
 
 	relay.Device, err = SelectDevice(db, deviceKey)
 	if err != nil {
 		return nil, fmt.Errorf("SelectRelay: %w", err)
 	}
+	relay.DependsOn, err = SelectRelayDependencies(db, relay.Id)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRelay: %w", err)
+	}
 	return &relay, nil
 }
 
 // Select the relays with desired status between with ids betwween start and end (inclusive) occuring after scheduled time.
-// Max of 1 taks per device is reutrned (WHERE rn = 1)
+// Only the highest priority relay of each device is selected, the oldest one on ties, and devices without a running relay.
+// Relays blocked by their dependencies are skipped.
+// Devices are ordered by the priority of their selected relay, so that urgent relays make the cut when limit truncates the list.
 func SelectRelayIds(db *sql.DB, status RelayStatus, startId, endId, limit *int, scheduledTime time.Time) ([]int, error) {
-	params := []interface{}{status}
+	params := []interface{}{status, RelayRunning}
 	query := `
-        SELECT MIN(id)
-        FROM relays
-        WHERE status = ?
-    `
+        SELECT id
+        FROM (
+            SELECT id, priority, ROW_NUMBER() OVER (PARTITION BY device_key ORDER BY priority DESC, id) AS device_rank
+            FROM relays r
+            WHERE status = ?
+            AND device_key NOT IN (SELECT device_key FROM relays WHERE status = ?)
+            AND NOT ` + relayBlocked
 	if startId != nil {
 		query += ` AND id >= ?`
 		params = append(params, *startId)
@@ -77,16 +160,14 @@ func SelectRelayIds(db *sql.DB, status RelayStatus, startId, endId, limit *int,
 	}
 	query += ` AND scheduled_time <= ?`
 	params = append(params, scheduledTime)
-	query += ` GROUP BY device_key ORDER by id`
+	query += `)
+        WHERE device_rank = 1
+        ORDER BY priority DESC, id`
 	if limit != nil {
 		query += ` LIMIT ?`
 		params = append(params, *limit)
 	}
 
-	// TODO: figure out how to pretty print these dynamic queries
-	// fmt.Println(query)
-	// fmt.Println(params)
-
 	stmt, err := db.Prepare(query)
 	if err != nil {
 		return nil, fmt.Errorf("SelectRelayIds: db.Prepare: %w", err)
@@ -94,48 +175,120 @@ func SelectRelayIds(db *sql.DB, status RelayStatus, startId, endId, limit *int,
 	defer stmt.Close()
 
 	rows, err := stmt.Query(params...)
-	// Might have no rows, where does that error pop?
 	if err != nil {
 		return nil, fmt.Errorf("SelectRelayIds: stmt.Query: %w", err)
 	}
 	defer rows.Close()
 
 	var relayIds []int
-	if !rows.Next() {
-		return relayIds, nil
+	for rows.Next() {
+		var relayId int
+		if err := rows.Scan(&relayId); err != nil {
+			return nil, fmt.Errorf("SelectRelayIds: rows.Scan: %w", err)
+		}
+		relayIds = append(relayIds, relayId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectRelayIds: rows.Err: %w", err)
+	}
+	return relayIds, nil
+}
+
+// Returns the earliest scheduled time among relays with the desired status which are not blocked by their dependencies
+// or waiting on a running relay of their device, nil if there are no such relays
+func SelectNextScheduledTime(db *sql.DB, status RelayStatus) (*time.Time, error) {
+	query := `
+        SELECT scheduled_time
+        FROM relays r
+        WHERE status = ? AND NOT ` + relayBlocked + `
+        AND device_key NOT IN (SELECT device_key FROM relays WHERE status = ?)
+        ORDER BY scheduled_time
+        LIMIT 1
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectNextScheduledTime: db.Prepare: %w", err)
 	}
-	// SELECT MIN will return a null row if there aren't any relays instead of 0 rows
-	var relayId sql.NullInt32
-	if err := rows.Scan(&relayId); err != nil {
-		return nil, fmt.Errorf("SelectRelayIds: first row stmt.Query: %w", err)
+	defer stmt.Close()
+
+	var scheduledTime time.Time
+	err = stmt.QueryRow(int(status), RelayRunning).Scan(&scheduledTime)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SelectNextScheduledTime: row.Scan: %w", err)
+	}
+	return &scheduledTime, nil
+}
+
+// Returns the earliest expiry among relays with the desired status, nil if none of them expire
+func SelectNextExpiry(db *sql.DB, status RelayStatus) (*time.Time, error) {
+	const query string = `
+        SELECT expires_at
+        FROM relays
+        WHERE status = ? AND expires_at IS NOT NULL
+        ORDER BY expires_at
+        LIMIT 1
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectNextExpiry: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	var expiresAt time.Time
+	err = stmt.QueryRow(int(status)).Scan(&expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SelectNextExpiry: row.Scan: %w", err)
+	}
+	return &expiresAt, nil
+}
+
+// Selects the relays with the desired status which expired at or before expiredTime
+func SelectExpiredRelays(db *sql.DB, status RelayStatus, expiredTime time.Time, limit int) ([]int, error) {
+	const query string = `
+        SELECT id
+        FROM relays
+        WHERE status = ? AND expires_at <= ?
+        ORDER BY id
+        LIMIT ?
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectExpiredRelays: db.Prepare: %w", err)
 	}
-	// First row is NULL, so there are no relays
-	if !relayId.Valid {
-		return relayIds, nil
+	defer stmt.Close()
+
+	rows, err := stmt.Query(int(status), expiredTime, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectExpiredRelays: stmt.Query: %w", err)
 	}
+	defer rows.Close()
 
-	// There are relays
-	relayIds = append(relayIds, int(relayId.Int32))
+	var relayIds []int
 	for rows.Next() {
 		var relayId int
 		if err := rows.Scan(&relayId); err != nil {
-			return nil, fmt.Errorf("SelectRelayIds: rows.Scan: %w", err)
+			return nil, fmt.Errorf("SelectExpiredRelays: rows.Scan: %w", err)
 		}
-		fmt.Println("relay ", relayId)
 		relayIds = append(relayIds, relayId)
 	}
-	// Is this necessary?
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("SelectRelayIds: rows.Err: %w", err)
+		return nil, fmt.Errorf("SelectExpiredRelays: rows.Err: %w", err)
 	}
 	return relayIds, nil
 }
 
-func InsertRelay(db *sql.DB, deviceKey int, cloudFunction string, argument string, desiredReturnCode *int, scheduledTime time.Time) (int, error) {
+func InsertRelay(db DBTX, deviceKey int, cloudFunction string, argument string, desiredReturnCode *int, scheduledTime time.Time, options RelayOptions) (int, error) {
 	const query string = `
         INSERT INTO relays
-        (device_key, cloud_function, argument, desired_return_code, scheduled_time, status, tries)
-        VALUES (?, ?, ?, ?, ?, ?, ?)
+        (device_key, cloud_function, argument, desired_return_code, scheduled_time, status, tries, retry_policy, expires_at, schedule_id, priority,
+        on_dependency_failure, success_conditions, max_tries, retry_of, created_at, coalesce_key, callback_url)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
         `
 	stmt, err := db.Prepare(query)
 	if err != nil {
@@ -143,7 +296,16 @@ func InsertRelay(db *sql.DB, deviceKey int, cloudFunction string, argument strin
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(deviceKey, cloudFunction, argument, desiredReturnCode, scheduledTime, RelayReady, 0)
+	onDependencyFailure := options.OnDependencyFailure
+	if onDependencyFailure == "" {
+		onDependencyFailure = DependencyFailureCancel
+	}
+	conditions, err := marshalConditions(options.SuccessConditions)
+	if err != nil {
+		return 0, fmt.Errorf("InsertRelay: %w", err)
+	}
+	result, err := stmt.Exec(deviceKey, cloudFunction, argument, desiredReturnCode, scheduledTime, RelayReady, 0, options.RetryPolicy, options.ExpiresAt, options.ScheduleId, options.Priority,
+		onDependencyFailure, conditions, options.MaxTries, options.RetryOf, time.Now().UTC(), options.CoalesceKey, options.CallbackUrl)
 	if err != nil {
 		return 0, fmt.Errorf("InsertDevice: stmt.Exec: %w", err)
 	}
@@ -154,10 +316,29 @@ func InsertRelay(db *sql.DB, deviceKey int, cloudFunction string, argument strin
 	return int(id), nil
 }
 
+// Supersedes the device's ready relays with the coalesce key, other than the replacement.
+// Returns the number of relays superseded.
+func SupersedeRelays(db DBTX, deviceKey int, coalesceKey string, replacementId int) (int, error) {
+	const query string = `
+        UPDATE relays
+        SET version = version + 1, status = ?, superseded_by = ?
+        WHERE device_key = ? AND coalesce_key = ? AND status = ? AND id != ?
+        `
+	result, err := db.Exec(query, RelaySuperseded, replacementId, deviceKey, coalesceKey, RelayReady, replacementId)
+	if err != nil {
+		return 0, fmt.Errorf("SupersedeRelays: db.Exec: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("SupersedeRelays: result.RowsAffected: %w", err)
+	}
+	return int(rowsAffected), nil
+}
+
 func UpdateRelay(db *sql.DB, relayId int, scheduledTime time.Time, status RelayStatus, tries int) error {
 	const query string = `
         UPDATE relays
-        SET status = ?, tries = ?, scheduled_time = ?
+        SET version = version + 1, status = ?, tries = ?, scheduled_time = ?
         WHERE id = ?
         `
 	stmt, err := db.Prepare(query)
@@ -185,7 +366,7 @@ func UpdateRelay(db *sql.DB, relayId int, scheduledTime time.Time, status RelayS
 func UpdateRelayStatus(db *sql.DB, relayId int, status RelayStatus) error {
 	const query string = `
         UPDATE relays
-        SET status = ?
+        SET version = version + 1, status = ?
         WHERE id = ?
         `
 	stmt, err := db.Prepare(query)
@@ -209,3 +390,248 @@ func UpdateRelayStatus(db *sql.DB, relayId int, status RelayStatus) error {
 	}
 	return nil
 }
+
+// Claims a ready relay for owner, moving it to running under a lease which lasts until expires.
+// A device runs one relay at a time, so the claim fails if another relay of the device is running.
+// Returns false if the relay could not be claimed, ie it is no longer ready or was claimed by another instance.
+func ClaimRelay(db *sql.DB, relayId int, owner string, expires time.Time) (bool, error) {
+	const query string = `
+        UPDATE relays
+        SET version = version + 1, status = ?, lease_owner = ?, lease_expires = ?
+        WHERE id = ? AND status = ?
+        AND NOT EXISTS (
+            SELECT 1 FROM relays AS running
+            WHERE running.device_key = relays.device_key AND running.status = ?
+        )
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return false, fmt.Errorf("ClaimRelay: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(int(RelayRunning), owner, expires, relayId, int(RelayReady), int(RelayRunning))
+	if err != nil {
+		return false, fmt.Errorf("ClaimRelay: stmt.Exec: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ClaimRelay: result.RowsAffected: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// Ends the lease held by owner, setting the outcome of the run.
+// Fails if owner no longer holds the lease, ie it expired and the relay was recovered.
+func ReleaseRelay(db *sql.DB, relayId int, owner string, scheduledTime time.Time, status RelayStatus, tries int, pings int) error {
+	const query string = `
+        UPDATE relays
+        SET version = version + 1, status = ?, tries = ?, pings = ?, scheduled_time = ?, lease_owner = NULL, lease_expires = NULL
+        WHERE id = ? AND status = ? AND lease_owner = ?
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("ReleaseRelay: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(int(status), tries, pings, scheduledTime, relayId, int(RelayRunning), owner)
+	if err != nil {
+		return fmt.Errorf("ReleaseRelay: stmt.Exec: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ReleaseRelay: result.RowsAffected: %w", err)
+	}
+	if rows != 1 {
+		return fmt.Errorf("ReleaseRelay: relay %d is not leased by %s", relayId, owner)
+	}
+	return nil
+}
+
+// Selects the running relays whose lease expired at or before expiredTime
+func SelectExpiredLeases(db *sql.DB, expiredTime time.Time, limit int) ([]int, error) {
+	const query string = `
+        SELECT id
+        FROM relays
+        WHERE status = ? AND lease_expires <= ?
+        ORDER BY id
+        LIMIT ?
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectExpiredLeases: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(int(RelayRunning), expiredTime, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectExpiredLeases: stmt.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var relayIds []int
+	for rows.Next() {
+		var relayId int
+		if err := rows.Scan(&relayId); err != nil {
+			return nil, fmt.Errorf("SelectExpiredLeases: rows.Scan: %w", err)
+		}
+		relayIds = append(relayIds, relayId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectExpiredLeases: rows.Err: %w", err)
+	}
+	return relayIds, nil
+}
+
+// Moves a relay from one status to another, clearing any lease.
+// Returns false if the relay was not in the from status.
+func TransitionRelayStatus(db *sql.DB, relayId int, from RelayStatus, to RelayStatus) (bool, error) {
+	const query string = `
+        UPDATE relays
+        SET version = version + 1, status = ?, lease_owner = NULL, lease_expires = NULL
+        WHERE id = ? AND status = ?
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return false, fmt.Errorf("TransitionRelayStatus: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(int(to), relayId, int(from))
+	if err != nil {
+		return false, fmt.Errorf("TransitionRelayStatus: stmt.Exec: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("TransitionRelayStatus: result.RowsAffected: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// Moves the ready relays of a device which are waiting to ping it again up to scheduledTime.
+// Returns the number of relays moved.
+func RescheduleOfflineRelays(db *sql.DB, deviceKey int, scheduledTime time.Time) (int, error) {
+	const query string = `
+        UPDATE relays
+        SET version = version + 1, scheduled_time = ?
+        WHERE device_key = ? AND status = ? AND pings > 0 AND scheduled_time > ?
+        `
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return 0, fmt.Errorf("RescheduleOfflineRelays: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(scheduledTime, deviceKey, int(RelayReady), scheduledTime)
+	if err != nil {
+		return 0, fmt.Errorf("RescheduleOfflineRelays: stmt.Exec: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("RescheduleOfflineRelays: result.RowsAffected: %w", err)
+	}
+	return int(rows), nil
+}
+
+// Moves a relay which is in one of the from statuses back to ready at scheduledTime with no tries or pings.
+// Its expiry is kept only if it is after scheduledTime. Returns false if the relay was not in any of the from statuses.
+func ResetRelay(db DBTX, relayId int, from []RelayStatus, scheduledTime time.Time, maxTries *int) (bool, error) {
+	query := `
+        UPDATE relays
+        SET version = version + 1, status = ?, tries = 0, pings = 0, scheduled_time = ?, max_tries = ?,
+        expires_at = CASE WHEN expires_at > ? THEN expires_at ELSE NULL END,
+        lease_owner = NULL, lease_expires = NULL
+        WHERE id = ? AND status IN (` + placeholders(len(from)) + `)
+        `
+	params := []interface{}{int(RelayReady), scheduledTime, maxTries, scheduledTime, relayId}
+	for _, status := range from {
+		params = append(params, int(status))
+	}
+	result, err := db.Exec(query, params...)
+	if err != nil {
+		return false, fmt.Errorf("ResetRelay: db.Exec: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ResetRelay: result.RowsAffected: %w", err)
+	}
+	return rows == 1, nil
+}
+
+// Returns n comma separated ? for an IN clause
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// Changes to a ready relay, fields which are nil are left as they are
+type RelayUpdate struct {
+	ScheduledTime *time.Time
+	Argument      *string
+	// DesiredReturnCode and ExpiresAt are only changed if their Set flag is true, so that they can be cleared
+	SetDesiredReturnCode bool
+	DesiredReturnCode    *int
+	SetExpiresAt         bool
+	ExpiresAt            *time.Time
+	Priority             *int
+	RetryPolicy          *string
+	// An empty, non nil, list removes the conditions
+	SuccessConditions []SuccessCondition
+}
+
+// Applies the update to a relay which is ready and still at version.
+// Returns false if the relay changed since, or is no longer ready, ie it was claimed by the scheduler.
+func UpdateReadyRelay(db DBTX, relayId int, version int, update RelayUpdate) (bool, error) {
+	set := "version = version + 1"
+	var params []interface{}
+	if update.ScheduledTime != nil {
+		set += ", scheduled_time = ?"
+		params = append(params, update.ScheduledTime.UTC())
+	}
+	if update.Argument != nil {
+		set += ", argument = ?"
+		params = append(params, *update.Argument)
+	}
+	if update.SetDesiredReturnCode {
+		set += ", desired_return_code = ?"
+		params = append(params, update.DesiredReturnCode)
+	}
+	if update.SetExpiresAt {
+		set += ", expires_at = ?"
+		params = append(params, update.ExpiresAt)
+	}
+	if update.Priority != nil {
+		set += ", priority = ?"
+		params = append(params, *update.Priority)
+	}
+	if update.RetryPolicy != nil {
+		set += ", retry_policy = ?"
+		params = append(params, *update.RetryPolicy)
+	}
+	if update.SuccessConditions != nil {
+		conditions, err := marshalConditions(update.SuccessConditions)
+		if err != nil {
+			return false, fmt.Errorf("UpdateReadyRelay: %w", err)
+		}
+		set += ", success_conditions = ?"
+		params = append(params, conditions)
+	}
+
+	query := `UPDATE relays SET ` + set + ` WHERE id = ? AND status = ? AND version = ?`
+	params = append(params, relayId, int(RelayReady), version)
+	result, err := db.Exec(query, params...)
+	if err != nil {
+		return false, fmt.Errorf("UpdateReadyRelay: db.Exec: %w", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("UpdateReadyRelay: result.RowsAffected: %w", err)
+	}
+	return rows == 1, nil
+}
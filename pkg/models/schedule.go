@@ -0,0 +1,229 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A recurring relay, a relay is created for each occurrence of the cron expression
+type Schedule struct {
+	Id                int     `json:"id"`
+	Device            *Device `json:"device"`
+	CloudFunction     string  `json:"cloud_function"`
+	Argument          string  `json:"argument"`
+	DesiredReturnCode *int    `json:"desired_return_code"`
+	// 5 field cron expression, evaluated in the timezone
+	Cron          string `json:"cron"`
+	Timezone      string `json:"timezone"`
+	OverlapPolicy string `json:"overlap_policy"`
+	RetryPolicy   string `json:"retry_policy"`
+	// Relays expire this long after their occurrence
+	TtlSeconds *int `json:"ttl_seconds"`
+	Paused     bool `json:"paused"`
+	// Next occurrence, nil when paused or if the cron expression never occurs again
+	NextRunTime *time.Time `json:"next_run_time"`
+	LastRelayId *int       `json:"last_relay_id"`
+}
+
+const (
+	// Skip an occurrence while the relay of the previous one is ready or running
+	OverlapSkip = "skip"
+	// Create a relay for every occurrence
+	OverlapAllow = "allow"
+)
+
+const scheduleColumns string = `id, device_key, cloud_function, argument, desired_return_code, cron, timezone,
+        overlap_policy, retry_policy, ttl_seconds, paused, next_run_time, last_relay_id`
+
+// Scans a schedule without its device, returning the device's key
+func scanSchedule(row interface{ Scan(...any) error }) (*Schedule, int, error) {
+	var schedule Schedule
+	var deviceKey int
+	err := row.Scan(&schedule.Id, &deviceKey, &schedule.CloudFunction, &schedule.Argument, &schedule.DesiredReturnCode,
+		&schedule.Cron, &schedule.Timezone, &schedule.OverlapPolicy, &schedule.RetryPolicy, &schedule.TtlSeconds,
+		&schedule.Paused, &schedule.NextRunTime, &schedule.LastRelayId)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &schedule, deviceKey, nil
+}
+
+func SelectSchedule(db DBTX, id int) (*Schedule, error) {
+	const query string = `SELECT ` + scheduleColumns + ` FROM schedules WHERE id = ?`
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectSchedule: db.Prepare: %w", err)
+	}
+	defer stmt.Close()
+
+	schedule, deviceKey, err := scanSchedule(stmt.QueryRow(id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SelectSchedule: row.Scan: %w", err)
+	}
+	schedule.Device, err = SelectDevice(db, deviceKey)
+	if err != nil {
+		return nil, fmt.Errorf("SelectSchedule: %w", err)
+	}
+	return schedule, nil
+}
+
+func SelectSchedules(db DBTX) ([]Schedule, error) {
+	const query string = `SELECT ` + scheduleColumns + ` FROM schedules ORDER BY id`
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectSchedules: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	var deviceKeys []int
+	for rows.Next() {
+		schedule, deviceKey, err := scanSchedule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("SelectSchedules: rows.Scan: %w", err)
+		}
+		schedules = append(schedules, *schedule)
+		deviceKeys = append(deviceKeys, deviceKey)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectSchedules: rows.Err: %w", err)
+	}
+	rows.Close()
+
+	// Devices are selected once the rows are closed, so that a single connection is enough
+	for i := range schedules {
+		schedules[i].Device, err = SelectDevice(db, deviceKeys[i])
+		if err != nil {
+			return nil, fmt.Errorf("SelectSchedules: %w", err)
+		}
+	}
+	return schedules, nil
+}
+
+// Selects the schedules which are not paused and whose next occurrence is at or before now
+func SelectDueScheduleIds(db DBTX, now time.Time, limit int) ([]int, error) {
+	const query string = `
+        SELECT id
+        FROM schedules
+        WHERE paused = 0 AND next_run_time <= ?
+        ORDER BY next_run_time
+        LIMIT ?
+        `
+	rows, err := db.Query(query, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectDueScheduleIds: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var scheduleIds []int
+	for rows.Next() {
+		var scheduleId int
+		if err := rows.Scan(&scheduleId); err != nil {
+			return nil, fmt.Errorf("SelectDueScheduleIds: rows.Scan: %w", err)
+		}
+		scheduleIds = append(scheduleIds, scheduleId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectDueScheduleIds: rows.Err: %w", err)
+	}
+	return scheduleIds, nil
+}
+
+// Returns the earliest next occurrence among schedules which are not paused, nil if there are none
+func SelectNextScheduleRunTime(db DBTX) (*time.Time, error) {
+	const query string = `
+        SELECT next_run_time
+        FROM schedules
+        WHERE paused = 0 AND next_run_time IS NOT NULL
+        ORDER BY next_run_time
+        LIMIT 1
+        `
+	var nextRunTime time.Time
+	err := db.QueryRow(query).Scan(&nextRunTime)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SelectNextScheduleRunTime: row.Scan: %w", err)
+	}
+	return &nextRunTime, nil
+}
+
+// Inserts the schedule, its id and device are ignored in favor of deviceKey
+func InsertSchedule(db DBTX, deviceKey int, schedule Schedule) (int, error) {
+	const query string = `
+        INSERT INTO schedules
+        (device_key, cloud_function, argument, desired_return_code, cron, timezone, overlap_policy, retry_policy,
+        ttl_seconds, paused, next_run_time, last_relay_id)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        `
+	result, err := db.Exec(query, deviceKey, schedule.CloudFunction, schedule.Argument, schedule.DesiredReturnCode,
+		schedule.Cron, schedule.Timezone, schedule.OverlapPolicy, schedule.RetryPolicy, schedule.TtlSeconds,
+		schedule.Paused, schedule.NextRunTime, schedule.LastRelayId)
+	if err != nil {
+		return 0, fmt.Errorf("InsertSchedule: db.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("InsertSchedule: result.LastInsertId: %w", err)
+	}
+	return int(id), nil
+}
+
+// Moves the schedule from its occurrence at runTime onto nextRunTime, recording the relay created for it if any.
+// Returns false if the occurrence was already handled, ie by another instance, or the schedule was paused.
+func AdvanceSchedule(db DBTX, id int, runTime time.Time, nextRunTime *time.Time, relayId *int) (bool, error) {
+	const query string = `
+        UPDATE schedules
+        SET next_run_time = ?, last_relay_id = COALESCE(?, last_relay_id)
+        WHERE id = ? AND paused = 0 AND next_run_time = ?
+        `
+	result, err := db.Exec(query, nextRunTime, relayId, id, runTime)
+	if err != nil {
+		return false, fmt.Errorf("AdvanceSchedule: db.Exec: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("AdvanceSchedule: result.RowsAffected: %w", err)
+	}
+	return rows == 1, nil
+}
+
+func UpdateSchedulePaused(db DBTX, id int, paused bool, nextRunTime *time.Time) error {
+	const query string = `
+        UPDATE schedules
+        SET paused = ?, next_run_time = ?
+        WHERE id = ?
+        `
+	result, err := db.Exec(query, paused, nextRunTime, id)
+	if err != nil {
+		return fmt.Errorf("UpdateSchedulePaused: db.Exec: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("UpdateSchedulePaused: result.RowsAffected: %w", err)
+	}
+	if rows != 1 {
+		return fmt.Errorf("UpdateSchedulePaused: expected update to affect 1 row, affected %d rows", rows)
+	}
+	return nil
+}
+
+// Deletes the schedule, relays already created for it are left as they are.
+// Returns false if the schedule does not exist.
+func DeleteSchedule(db DBTX, id int) (bool, error) {
+	const query string = `DELETE FROM schedules WHERE id = ?`
+	result, err := db.Exec(query, id)
+	if err != nil {
+		return false, fmt.Errorf("DeleteSchedule: db.Exec: %w", err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("DeleteSchedule: result.RowsAffected: %w", err)
+	}
+	return rows == 1, nil
+}
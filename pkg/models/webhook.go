@@ -0,0 +1,308 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A final status change of a relay, recorded by a trigger on the relays table
+type RelayEvent struct {
+	Id        int         `json:"id"`
+	RelayId   int         `json:"relay_id"`
+	Status    RelayStatus `json:"status"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// Names of the final statuses, as used by webhook subscriptions and events
+var RelayEventNames = map[RelayStatus]string{
+	RelayComplete:   "complete",
+	RelayFailed:     "failed",
+	RelayCancelled:  "cancelled",
+	RelayExpired:    "expired",
+	RelaySuperseded: "superseded",
+}
+
+// A subscription to relay events
+type Webhook struct {
+	Id  int    `json:"id"`
+	Url string `json:"url"`
+	// Key of the HMAC signature of the deliveries, only returned by CreateWebhookResponse
+	Secret string `json:"-"`
+	// Only events of this relay are delivered if it is set
+	RelayId *int `json:"relay_id"`
+	// Names of the events delivered, every event if empty
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Whether the webhook is notified of the event
+func (w Webhook) Wants(relayId int, event string) bool {
+	if w.RelayId != nil && *w.RelayId != relayId {
+		return false
+	}
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, name := range w.Events {
+		if name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// The body of a delivery
+type WebhookPayload struct {
+	EventId    int       `json:"event_id"`
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// The relay when the event was dispatched, its status is the event's
+	Relay Relay `json:"relay"`
+}
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// Given up after the last attempt failed
+	DeliveryFailed = "failed"
+)
+
+// An event to be posted to a url, kept in an outbox until it is delivered or given up
+type WebhookDelivery struct {
+	Id      int `json:"id"`
+	EventId int `json:"event_id"`
+	// Not set for deliveries to a relay's callback url
+	WebhookId *int   `json:"webhook_id"`
+	Url       string `json:"url"`
+	Secret    string `json:"-"`
+	Payload   string `json:"-"`
+	Status    string `json:"status"`
+	Attempts  int    `json:"attempts"`
+	// When the next attempt is due while the delivery is pending
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	LastStatusCode *int       `json:"last_status_code"`
+	LastError      *string    `json:"last_error"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+func SelectUndispatchedEvents(db DBTX, limit int) ([]RelayEvent, error) {
+	const query string = `
+        SELECT id, relay_id, status, created_at
+        FROM relay_events
+        WHERE dispatched = 0
+        ORDER BY id
+        LIMIT ?
+        `
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("SelectUndispatchedEvents: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	var events []RelayEvent
+	for rows.Next() {
+		var event RelayEvent
+		if err := rows.Scan(&event.Id, &event.RelayId, &event.Status, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("SelectUndispatchedEvents: rows.Scan: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectUndispatchedEvents: rows.Err: %w", err)
+	}
+	return events, nil
+}
+
+func MarkEventDispatched(db DBTX, id int) error {
+	const query string = `UPDATE relay_events SET dispatched = 1 WHERE id = ?`
+	_, err := db.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("MarkEventDispatched: db.Exec: %w", err)
+	}
+	return nil
+}
+
+func InsertWebhook(db DBTX, webhook Webhook) (int, error) {
+	const query string = `
+        INSERT INTO webhooks (url, secret, relay_id, events, created_at)
+        VALUES (?, ?, ?, ?, ?)
+        `
+	result, err := db.Exec(query, webhook.Url, webhook.Secret, webhook.RelayId, strings.Join(webhook.Events, ","), webhook.CreatedAt)
+	if err != nil {
+		return 0, fmt.Errorf("InsertWebhook: db.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("InsertWebhook: result.LastInsertId: %w", err)
+	}
+	return int(id), nil
+}
+
+const webhookColumns string = `id, url, secret, relay_id, events, created_at`
+
+func scanWebhook(row interface{ Scan(...any) error }) (Webhook, error) {
+	var webhook Webhook
+	var events string
+	err := row.Scan(&webhook.Id, &webhook.Url, &webhook.Secret, &webhook.RelayId, &events, &webhook.CreatedAt)
+	if err != nil {
+		return webhook, err
+	}
+	webhook.Events = []string{}
+	if events != "" {
+		webhook.Events = strings.Split(events, ",")
+	}
+	return webhook, nil
+}
+
+func SelectWebhook(db DBTX, id int) (*Webhook, error) {
+	const query string = `SELECT ` + webhookColumns + ` FROM webhooks WHERE id = ?`
+	webhook, err := scanWebhook(db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("SelectWebhook: row.Scan: %w", err)
+	}
+	return &webhook, nil
+}
+
+// Selects every webhook, or only those which may be notified of the relay's events if relayId is set
+func SelectWebhooks(db DBTX, relayId *int) ([]Webhook, error) {
+	query := `SELECT ` + webhookColumns + ` FROM webhooks`
+	var params []interface{}
+	if relayId != nil {
+		query += ` WHERE relay_id IS NULL OR relay_id = ?`
+		params = append(params, *relayId)
+	}
+	query += ` ORDER BY id`
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("SelectWebhooks: db.Query: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("SelectWebhooks: rows.Scan: %w", err)
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SelectWebhooks: rows.Err: %w", err)
+	}
+	return webhooks, nil
+}
+
+// Deletes the webhook along with its pending deliveries, returns false if it does not exist
+func DeleteWebhook(db DBTX, id int) (bool, error) {
+	result, err := db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		return false, fmt.Errorf("DeleteWebhook: db.Exec: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("DeleteWebhook: result.RowsAffected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return false, nil
+	}
+	_, err = db.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ? AND status = ?`, id, DeliveryPending)
+	if err != nil {
+		return false, fmt.Errorf("DeleteWebhook: db.Exec: %w", err)
+	}
+	return true, nil
+}
+
+func InsertWebhookDelivery(db DBTX, delivery WebhookDelivery) (int, error) {
+	const query string = `
+        INSERT INTO webhook_deliveries (event_id, webhook_id, url, secret, payload, status, attempts, next_attempt_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        `
+	result, err := db.Exec(query, delivery.EventId, delivery.WebhookId, delivery.Url, delivery.Secret, delivery.Payload,
+		delivery.Status, delivery.Attempts, delivery.NextAttemptAt)
+	if err != nil {
+		return 0, fmt.Errorf("InsertWebhookDelivery: db.Exec: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("InsertWebhookDelivery: result.LastInsertId: %w", err)
+	}
+	return int(id), nil
+}
+
+const deliveryColumns string = `id, event_id, webhook_id, url, secret, payload, status, attempts, next_attempt_at,
+        last_status_code, last_error, delivered_at`
+
+func selectDeliveries(db DBTX, caller string, where string, params ...any) ([]WebhookDelivery, error) {
+	query := `SELECT ` + deliveryColumns + ` FROM webhook_deliveries WHERE ` + where
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: db.Query: %w", caller, err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		err := rows.Scan(&d.Id, &d.EventId, &d.WebhookId, &d.Url, &d.Secret, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.DeliveredAt)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rows.Scan: %w", caller, err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: rows.Err: %w", caller, err)
+	}
+	return deliveries, nil
+}
+
+// Selects up to limit pending deliveries whose next attempt is due at now, oldest first
+func SelectDueDeliveries(db DBTX, now time.Time, limit int) ([]WebhookDelivery, error) {
+	return selectDeliveries(db, "SelectDueDeliveries", `status = ? AND next_attempt_at <= ? ORDER BY id LIMIT ?`,
+		DeliveryPending, now, limit)
+}
+
+// Selects the webhook's deliveries, newest first
+func SelectWebhookDeliveries(db DBTX, webhookId int, limit int) ([]WebhookDelivery, error) {
+	return selectDeliveries(db, "SelectWebhookDeliveries", `webhook_id = ? ORDER BY id DESC LIMIT ?`, webhookId, limit)
+}
+
+// Claims a due delivery by pushing its next attempt back to until, so that no other instance attempts it meanwhile.
+// Returns false if it is no longer due.
+func ClaimDelivery(db DBTX, id int, now time.Time, until time.Time) (bool, error) {
+	const query string = `
+        UPDATE webhook_deliveries
+        SET next_attempt_at = ?
+        WHERE id = ? AND status = ? AND next_attempt_at <= ?
+        `
+	result, err := db.Exec(query, until, id, DeliveryPending, now)
+	if err != nil {
+		return false, fmt.Errorf("ClaimDelivery: db.Exec: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ClaimDelivery: result.RowsAffected: %w", err)
+	}
+	return rowsAffected == 1, nil
+}
+
+// Records the outcome of an attempt
+func UpdateDelivery(db DBTX, delivery WebhookDelivery) error {
+	const query string = `
+        UPDATE webhook_deliveries
+        SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ?, delivered_at = ?
+        WHERE id = ?
+        `
+	_, err := db.Exec(query, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastStatusCode,
+		delivery.LastError, delivery.DeliveredAt, delivery.Id)
+	if err != nil {
+		return fmt.Errorf("UpdateDelivery: db.Exec: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Particle refuses cloud function calls to the denied device
+type deniedParticle struct {
+	particle.MockParticle
+}
+
+const deniedBody = `{"ok":false,"error":"Permission denied"}`
+
+func (p deniedParticle) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
+	if deviceId == "denied" {
+		return 0, fmt.Errorf("deniedParticle.CloudFunction: %w", &particle.APIError{StatusCode: 403, Body: deniedBody})
+	}
+	return p.MockParticle.CloudFunction(ctx, deviceId, cloudFunction, argument)
+}
+
+func TestRelayAttempts(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.RetryPolicies = map[string]config.RetryPolicyConfig{
+		"quick": {
+			Ping:          config.BackoffConfig{MaxAttempts: 2},
+			CloudFunction: config.BackoffConfig{MaxAttempts: 2},
+		},
+	}
+
+	db, err := SetupFileDB("attempts.db3")
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	drc := 5
+	options := models.RelayOptions{RetryPolicy: "quick"}
+	successId, err := server.CreateRelay(db, "dev0", "func0", "5", &drc, now, options)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	mismatchId, err := server.CreateRelay(db, "dev1", "func0", "4", &drc, now, options)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	errorId, err := server.CreateRelay(db, "dev2", "func0", particle.DeviceCFError, nil, now, options)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	offlineId, err := server.CreateRelay(db, "dev"+particle.DevicePingOffline, "func0", "", nil, now, options)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	deniedId, err := server.CreateRelay(db, "denied", "func0", "", nil, now, options)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+
+	stop := StartBackgroundTask(&myConfig, db, deniedParticle{particle.NewMock()}, server.NewWakeup())
+	defer stop()
+
+	for relayId, status := range map[int]models.RelayStatus{successId: models.RelayComplete, mismatchId: models.RelayFailed,
+		errorId: models.RelayFailed, offlineId: models.RelayFailed, deniedId: models.RelayFailed} {
+		err = AssertRelayStatusWithin(db, relayId, status, 2*time.Second)
+		if err != nil {
+			t.Fatalf("TestRelayAttempts: %+v", err)
+		}
+	}
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+
+	ok := 200
+	type want struct {
+		kind        string
+		outcome     string
+		httpStatus  *int
+		returnValue *int
+		hasError    bool
+	}
+	ping := want{models.AttemptPing, models.AttemptOnline, &ok, nil, false}
+	rv5, rv4 := 5, 4
+	forbidden := 403
+	tests := map[int][]want{
+		successId:  {ping, {models.AttemptCloudFunction, models.AttemptSuccess, &ok, &rv5, false}},
+		mismatchId: {ping, {models.AttemptCloudFunction, models.AttemptMismatch, &ok, &rv4, false}},
+		errorId: {ping, {models.AttemptCloudFunction, models.AttemptError, nil, nil, true},
+			{models.AttemptCloudFunction, models.AttemptError, nil, nil, true}},
+		offlineId: {{models.AttemptPing, models.AttemptOffline, &ok, nil, false}, {models.AttemptPing, models.AttemptOffline, &ok, nil, false}},
+		deniedId: {ping, {models.AttemptCloudFunction, models.AttemptError, &forbidden, nil, true},
+			{models.AttemptCloudFunction, models.AttemptError, &forbidden, nil, true}},
+	}
+	for relayId, wantAttempts := range tests {
+		var attempts []models.Attempt
+		err = getJson(fmt.Sprintf("%s/api/relays/%d/attempts", srv.URL, relayId), &attempts)
+		if err != nil {
+			t.Fatalf("TestRelayAttempts: %+v", err)
+		}
+		if len(attempts) != len(wantAttempts) {
+			t.Fatalf("TestRelayAttempts: relay %d attempts want=%d, got=%+v", relayId, len(wantAttempts), attempts)
+		}
+		for i, w := range wantAttempts {
+			a := attempts[i]
+			if a.RelayId != relayId || a.Kind != w.kind || a.Outcome != w.outcome || !intPtrEqual(a.HttpStatus, w.httpStatus) ||
+				!intPtrEqual(a.ReturnValue, w.returnValue) || (a.Error != nil) != w.hasError || a.StartedAt.Before(now.Add(-time.Second)) {
+				t.Errorf("TestRelayAttempts: relay %d attempt %d want=%+v, got=%+v", relayId, i, w, a)
+			}
+		}
+	}
+
+	var denied []models.Attempt
+	err = getJson(fmt.Sprintf("%s/api/relays/%d/attempts", srv.URL, deniedId), &denied)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	if denied[1].ErrorBody == nil || *denied[1].ErrorBody != deniedBody {
+		t.Errorf("TestRelayAttempts: error body want=%s, got=%v", deniedBody, denied[1].ErrorBody)
+	}
+
+	// Attempts are only included in the relay when asked for
+	var relay models.Relay
+	err = getJson(fmt.Sprintf("%s/api/relays/%d", srv.URL, successId), &relay)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	if relay.Attempts != nil {
+		t.Errorf("TestRelayAttempts: attempts should be omitted, got=%+v", relay.Attempts)
+	}
+	err = getJson(fmt.Sprintf("%s/api/relays/%d?attempts=true", srv.URL, successId), &relay)
+	if err != nil {
+		t.Fatalf("TestRelayAttempts: %+v", err)
+	}
+	if len(relay.Attempts) != 2 || relay.Attempts[1].Outcome != models.AttemptSuccess {
+		t.Errorf("TestRelayAttempts: want 2 attempts, got=%+v", relay.Attempts)
+	}
+}
+
+func intPtrEqual(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,192 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestBackgroundTaskWakeup(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Settings.MaxSleepSeconds = 3600
+
+	db, err := SetupFileDB("background.db3")
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskWakeup: %+v", err)
+	}
+
+	wakeup := server.NewWakeup()
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), wakeup)
+	defer stop()
+	// Let the task go to sleep on an empty table
+	time.Sleep(100 * time.Millisecond)
+
+	// A new relay is only picked up if the task is woken
+	relayId, err := AssertCreateRelay(db, "dev0", "func0", "", nil, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskWakeup: %+v", err)
+	}
+	wakeup.Signal()
+	err = AssertRelayStatusWithin(db, relayId, models.RelayComplete, time.Second)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskWakeup: %+v", err)
+	}
+
+	// A relay in the future is run once its scheduled time arrives, without another signal
+	scheduledTime := time.Now().Add(500 * time.Millisecond).UTC()
+	relayId, err = AssertCreateRelay(db, "dev0", "func0", "", nil, scheduledTime)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskWakeup: %+v", err)
+	}
+	wakeup.Signal()
+	time.Sleep(100 * time.Millisecond)
+	err = AssertRelayStatusWithin(db, relayId, models.RelayReady, 0)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskWakeup: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, relayId, models.RelayComplete, time.Second)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskWakeup: %+v", err)
+	}
+}
+
+func TestBackgroundTaskShutdown(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Settings.ShutdownGraceSeconds = 2
+
+	db, err := SetupFileDB("shutdown.db3")
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskShutdown: %+v", err)
+	}
+	defer db.Close()
+
+	mock := particle.NewMock()
+	mock.Latency = 300 * time.Millisecond
+	relayId, err := AssertCreateRelay(db, "dev0", "func0", "", nil, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskShutdown: %+v", err)
+	}
+
+	// The relay in flight is allowed to finish within the grace period
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.BackgroundTask(ctx, &myConfig, db, mock, server.NewWakeup())
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(myConfig.Settings.ShutdownGraceSeconds) * time.Second):
+		t.Fatalf("TestBackgroundTaskShutdown: background task did not stop within the grace period")
+	}
+	err = AssertRelayStatusWithin(db, relayId, models.RelayComplete, 0)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskShutdown: %+v", err)
+	}
+
+	// Relays that take longer than the grace period are aborted and keep their lease for the expired lease policy
+	myConfig.Settings.ShutdownGraceSeconds = 0
+	relayId, err = AssertCreateRelay(db, "dev0", "func0", "", nil, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskShutdown: %+v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	done = make(chan struct{})
+	go func() {
+		server.BackgroundTask(ctx, &myConfig, db, mock, server.NewWakeup())
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(mock.Latency):
+		t.Fatalf("TestBackgroundTaskShutdown: background task did not abort the relay in flight")
+	}
+	relay, err := models.SelectRelay(db, relayId)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskShutdown: %+v", err)
+	}
+	err = AssertRelay(relay, "dev0", "func0", "", nil, models.RelayRunning, nil, 0)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskShutdown: %+v", err)
+	}
+	if relay.LeaseOwner == nil || relay.LeaseExpires == nil {
+		t.Fatalf("TestBackgroundTaskShutdown: relay %d is running without a lease", relayId)
+	}
+}
+
+// Wraps the recording mock so that cloud functions on one device hang until cancelled
+type slowDeviceParticle struct {
+	*recordingParticle
+	slowDeviceId string
+}
+
+func (p slowDeviceParticle) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
+	if deviceId == p.slowDeviceId {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return p.recordingParticle.CloudFunction(ctx, deviceId, cloudFunction, argument)
+}
+
+// A device which hangs only ties up its own worker, the others keep processing relays
+func TestBackgroundTaskSlowDevice(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Settings.MaxRoutines = 2
+	myConfig.Settings.ShutdownGraceSeconds = 0
+
+	db, err := SetupFileDB("pool.db3")
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskSlowDevice: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	slowId, err := server.CreateRelay(db, "slow", "func0", "slow", nil, now, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskSlowDevice: %+v", err)
+	}
+	var relayIds []int
+	for i := 0; i < 20; i++ {
+		relayId, err := server.CreateRelay(db, fmt.Sprintf("dev%d", i%5), "func0", fmt.Sprintf("%d", i), nil, now, models.RelayOptions{})
+		if err != nil {
+			t.Fatalf("TestBackgroundTaskSlowDevice: %+v", err)
+		}
+		relayIds = append(relayIds, relayId)
+	}
+
+	mock := slowDeviceParticle{newRecordingParticle(10 * time.Millisecond), "slow"}
+	stop := StartBackgroundTask(&myConfig, db, mock, server.NewWakeup())
+	defer stop()
+
+	for _, relayId := range relayIds {
+		err = AssertRelayStatusWithin(db, relayId, models.RelayComplete, 2*time.Second)
+		if err != nil {
+			t.Fatalf("TestBackgroundTaskSlowDevice: %+v", err)
+		}
+	}
+	err = AssertRelayStatusWithin(db, slowId, models.RelayRunning, 0)
+	if err != nil {
+		t.Fatalf("TestBackgroundTaskSlowDevice: %+v", err)
+	}
+
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	if len(mock.violations) != 0 {
+		t.Fatalf("TestBackgroundTaskSlowDevice: %v", mock.violations)
+	}
+	for i := 0; i < 20; i++ {
+		if calls := mock.calls[fmt.Sprintf("%d", i)]; calls != 1 {
+			t.Fatalf("TestBackgroundTaskSlowDevice: relay %d called %d times", relayIds[i], calls)
+		}
+	}
+}
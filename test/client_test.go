@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -28,10 +29,10 @@ func TestClient(t *testing.T) {
 	// defer db.Close()
 
 	particle := particle.NewMock()
+	wakeup := server.NewWakeup()
 	go func() {
-		if err := server.Run(db, "localhost", "8080"); err != nil {
-			// TODO: Fix this warning
-			t.Fatalf("TestCancellations: Could not start server: %s\n", err)
+		if err := server.Run(context.Background(), &myConfig, db, wakeup); err != nil {
+			t.Errorf("TestCancellations: Could not start server: %s\n", err)
 		}
 	}()
 
@@ -84,7 +85,7 @@ func TestClient(t *testing.T) {
 		t.Fatalf("TestClient: %+v", err)
 	}
 
-	go server.BackgroundTask(&myConfig, db, particle)
+	go server.BackgroundTask(context.Background(), &myConfig, db, particle, wakeup)
 	time.Sleep(100 * time.Millisecond)
 
 	relay, err = client.GetRelay(id)
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestCoalesceRelays(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("coalesce.db3")
+	if err != nil {
+		t.Fatalf("TestCoalesceRelays: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	later := time.Now().UTC().Add(time.Hour)
+	key := "temperature"
+	create := func(deviceId string, argument string, coalesceKey *string, dependsOn []int) int {
+		relayId, err := client.CreateRelayFromRequest(models.CreateRelayRequest{DeviceId: deviceId, CloudFunction: "setTemperature",
+			Argument: &argument, ScheduledTime: &later, CoalesceKey: coalesceKey, DependsOn: dependsOn})
+		if err != nil {
+			t.Fatalf("TestCoalesceRelays: %+v", err)
+		}
+		return relayId
+	}
+	assertStatus := func(relayId int, status models.RelayStatus, supersededBy *int) {
+		relay, err := client.GetRelay(relayId)
+		if err != nil {
+			t.Fatalf("TestCoalesceRelays: %+v", err)
+		}
+		sameReplacement := (relay.SupersededBy == nil) == (supersededBy == nil) &&
+			(supersededBy == nil || *relay.SupersededBy == *supersededBy)
+		if relay.Status != status || !sameReplacement {
+			t.Fatalf("TestCoalesceRelays: relay %d, want status %d superseded by %v, got %+v", relayId, status, supersededBy, relay)
+		}
+	}
+
+	first := create("dev0", "20", &key, nil)
+	second := create("dev0", "21", &key, nil)
+	assertStatus(first, models.RelaySuperseded, &second)
+	assertStatus(second, models.RelayReady, nil)
+
+	// Keys are per device, and relays without the key are left alone
+	otherDevice := create("dev1", "22", &key, nil)
+	noKey := create("dev0", "23", nil, nil)
+	assertStatus(second, models.RelayReady, nil)
+	assertStatus(otherDevice, models.RelayReady, nil)
+
+	// Only ready relays are superseded
+	err = models.UpdateRelayStatus(db, second, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestCoalesceRelays: %+v", err)
+	}
+	third := create("dev0", "24", &key, nil)
+	assertStatus(second, models.RelayComplete, nil)
+	assertStatus(noKey, models.RelayReady, nil)
+
+	// Dependents of a superseded relay are cancelled like those of a failed one
+	dependent := create("dev2", "", nil, []int{third})
+	fourth := create("dev0", "25", &key, nil)
+	assertStatus(third, models.RelaySuperseded, &fourth)
+	_, err = server.CancelDependents(db)
+	if err != nil {
+		t.Fatalf("TestCoalesceRelays: %+v", err)
+	}
+	assertStatus(dependent, models.RelayCancelled, nil)
+
+	err = client.CancelRelay(first)
+	if err == nil {
+		t.Fatalf("TestCoalesceRelays: want an error cancelling a superseded relay")
+	}
+
+	empty := ""
+	_, err = client.CreateRelayFromRequest(models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "setTemperature", CoalesceKey: &empty})
+	if err == nil {
+		t.Fatalf("TestCoalesceRelays: want an error for an empty coalesce key")
+	}
+}
@@ -0,0 +1,135 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestSuccessConditionMatches(t *testing.T) {
+	zero, ten := 0, 10
+	tests := []struct {
+		condition models.SuccessCondition
+		matches   []int
+		misses    []int
+	}{
+		{models.SuccessCondition{Codes: []int{1, 4}}, []int{1, 4}, []int{0, 2}},
+		{models.SuccessCondition{Min: &zero}, []int{0, 100}, []int{-1}},
+		{models.SuccessCondition{Min: &zero, Max: &ten}, []int{0, 10}, []int{-1, 11}},
+		{models.SuccessCondition{Not: []int{-2}}, []int{-1, 0}, []int{-2}},
+		{models.SuccessCondition{Min: &zero, Not: []int{3}}, []int{0, 4}, []int{-1, 3}},
+	}
+	for i, test := range tests {
+		if err := test.condition.Validate(); err != nil {
+			t.Fatalf("TestSuccessConditionMatches: condition %d, %+v", i, err)
+		}
+		for _, v := range test.matches {
+			if !test.condition.Matches(v) {
+				t.Errorf("TestSuccessConditionMatches: condition %d should match %d", i, v)
+			}
+		}
+		for _, v := range test.misses {
+			if test.condition.Matches(v) {
+				t.Errorf("TestSuccessConditionMatches: condition %d should not match %d", i, v)
+			}
+		}
+	}
+
+	invalid := []models.SuccessCondition{
+		{},
+		{OnMismatch: models.MismatchRetry},
+		{Min: &ten, Max: &zero},
+		{Codes: []int{1}, OnMismatch: "later"},
+	}
+	for i, condition := range invalid {
+		if err := condition.Validate(); err == nil {
+			t.Errorf("TestSuccessConditionMatches: invalid condition %d passed validation", i)
+		}
+	}
+
+	// The desired return code is checked first
+	one := 1
+	relay := models.Relay{DesiredReturnCode: &one, SuccessConditions: []models.SuccessCondition{{Not: []int{1}, OnMismatch: models.MismatchRetry}}}
+	if failed := relay.FailedCondition(2); failed == nil || failed.OnMismatch != models.MismatchFail {
+		t.Errorf("TestSuccessConditionMatches: want the desired return code to fail, got %+v", failed)
+	}
+	if failed := relay.FailedCondition(1); failed == nil || failed.OnMismatch != models.MismatchRetry {
+		t.Errorf("TestSuccessConditionMatches: want the condition to retry, got %+v", failed)
+	}
+}
+
+func TestSuccessConditions(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.RetryPolicies = map[string]config.RetryPolicyConfig{
+		"quick": {CloudFunction: config.BackoffConfig{MaxAttempts: 3}},
+	}
+
+	db, err := SetupFileDB("condition.db3")
+	if err != nil {
+		t.Fatalf("TestSuccessConditions: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+
+	resp, err := postRelay(srv.URL, models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0",
+		SuccessConditions: []models.SuccessCondition{{OnMismatch: models.MismatchRetry}}})
+	if err != nil {
+		t.Fatalf("TestSuccessConditions: %+v", err)
+	}
+	if resp != http.StatusUnprocessableEntity {
+		t.Fatalf("TestSuccessConditions: status want=%d, got=%d", http.StatusUnprocessableEntity, resp)
+	}
+
+	// -2 is busy, try again, other negative values are errors
+	zero := 0
+	busy := []models.SuccessCondition{{Not: []int{-2}, OnMismatch: models.MismatchRetry}, {Min: &zero}}
+	options := models.RelayOptions{RetryPolicy: "quick", SuccessConditions: busy}
+	now := time.Now().UTC()
+	tests := []struct {
+		argument string
+		status   models.RelayStatus
+		tries    int
+	}{
+		{"-2", models.RelayFailed, 3},
+		{"-1", models.RelayFailed, 1},
+		{"7", models.RelayComplete, 1},
+	}
+	relayIds := make([]int, len(tests))
+	for i, test := range tests {
+		relayIds[i], err = server.CreateRelay(db, fmt.Sprintf("dev%d", i), "func0", test.argument, nil, now, options)
+		if err != nil {
+			t.Fatalf("TestSuccessConditions: %+v", err)
+		}
+	}
+
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), server.NewWakeup())
+	defer stop()
+
+	for i, test := range tests {
+		err = AssertRelayStatusWithin(db, relayIds[i], test.status, 2*time.Second)
+		if err != nil {
+			t.Fatalf("TestSuccessConditions: %+v", err)
+		}
+		var relay models.Relay
+		err = getJson(fmt.Sprintf("%s/api/relays/%d?attempts=true", srv.URL, relayIds[i]), &relay)
+		if err != nil {
+			t.Fatalf("TestSuccessConditions: %+v", err)
+		}
+		if relay.Tries != test.tries || len(relay.SuccessConditions) != 2 {
+			t.Errorf("TestSuccessConditions: relay %d want tries=%d with 2 conditions, got %+v", relayIds[i], test.tries, relay)
+		}
+		last := relay.Attempts[len(relay.Attempts)-1]
+		if last.ReturnValue == nil || fmt.Sprint(*last.ReturnValue) != test.argument {
+			t.Errorf("TestSuccessConditions: relay %d last attempt want return value %s, got %+v", relayIds[i], test.argument, last)
+		}
+	}
+}
@@ -52,6 +52,56 @@ func TestConfig(t *testing.T) {
     if myConfig.Settings.MaxRetries != defaultConfig.Settings.MaxRetries {
         t.Errorf("TestConfig: settings MaxRetries, want=%d, got=%d", defaultConfig.Settings.MaxRetries, myConfig.Settings.MaxRetries)
     }
+    if myConfig.Settings.IdempotencyKeySeconds != 3600 {
+        t.Errorf("TestConfig: settings IdempotencyKeySeconds, want=3600, got=%d", myConfig.Settings.IdempotencyKeySeconds)
+    }
+
+    policy, ok := myConfig.RetryPolicy("slow")
+    if !ok {
+        t.Fatalf("TestConfig: retry policy slow is missing")
+    }
+    want := config.BackoffConfig{InitialDelaySeconds: 60, Multiplier: 2, MaxDelaySeconds: 3600, Jitter: 0.1}
+    if policy.Ping != want {
+        t.Errorf("TestConfig: retry policy slow ping, want=%+v, got=%+v", want, policy.Ping)
+    }
+    want = config.BackoffConfig{InitialDelaySeconds: 30, MaxAttempts: 5}
+    if policy.CloudFunction != want {
+        t.Errorf("TestConfig: retry policy slow cloud_function, want=%+v, got=%+v", want, policy.CloudFunction)
+    }
+    if _, ok := myConfig.RetryPolicy("fast"); ok {
+        t.Errorf("TestConfig: retry policy fast should not exist")
+    }
+
+    wantLimits := config.RateLimitConfig{FunctionsPerSecond: 2.5, FunctionBurst: 5, DeviceSpacingMs: 1000}
+    if myConfig.RateLimits != wantLimits {
+        t.Errorf("TestConfig: rate limits, want=%+v, got=%+v", wantLimits, myConfig.RateLimits)
+    }
+
+    wantEvents := config.DeviceEventsConfig{Enabled: true, Url: defaultConfig.DeviceEvents.Url, ReconnectInitialSeconds: 1, ReconnectMaxSeconds: 10}
+    if myConfig.DeviceEvents != wantEvents {
+        t.Errorf("TestConfig: device events, want=%+v, got=%+v", wantEvents, myConfig.DeviceEvents)
+    }
+
+    wantWebhooks := defaultConfig.Webhooks
+    wantWebhooks.Secret = "callback-secret"
+    wantWebhooks.Retry.MaxAttempts = 3
+    if myConfig.Webhooks != wantWebhooks {
+        t.Errorf("TestConfig: webhooks, want=%+v, got=%+v", wantWebhooks, myConfig.Webhooks)
+    }
+
+    wantEventsConfig := config.EventsConfig{PollMs: defaultConfig.Events.PollMs, HeartbeatSeconds: 0, RetentionSeconds: 3600}
+    if myConfig.Events != wantEventsConfig {
+        t.Errorf("TestConfig: events, want=%+v, got=%+v", wantEventsConfig, myConfig.Events)
+    }
+
+    // The default policy falls back to the settings
+    policy, ok = myConfig.RetryPolicy("")
+    if !ok {
+        t.Fatalf("TestConfig: default retry policy is missing")
+    }
+    if policy.Ping.InitialDelaySeconds != 5 || policy.CloudFunction.MaxAttempts != defaultConfig.Settings.MaxRetries {
+        t.Errorf("TestConfig: default retry policy does not match the settings, got=%+v", policy)
+    }
 }
 
 func getConfigString() (string) {
@@ -64,5 +114,35 @@ filename = "my.db3"
 
 [settings]
 ping_retry_seconds = 5
+idempotency_key_seconds = 3600
+
+[retry_policies.slow.ping]
+initial_delay_seconds = 60
+multiplier = 2.0
+max_delay_seconds = 3600
+jitter = 0.1
+
+[retry_policies.slow.cloud_function]
+initial_delay_seconds = 30
+max_attempts = 5
+
+[rate_limits]
+functions_per_second = 2.5
+function_burst = 5
+device_spacing_ms = 1000
+
+[device_events]
+enabled = true
+reconnect_max_seconds = 10
+
+[webhooks]
+secret = "callback-secret"
+
+[webhooks.retry]
+max_attempts = 3
+
+[events]
+heartbeat_seconds = 0
+retention_seconds = 3600
 `
 }
@@ -0,0 +1,65 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/cron"
+)
+
+func TestCronParse(t *testing.T) {
+	valid := []string{"* * * * *", "0 3 * * *", "*/15 8-18 * * mon-fri", "0 0 1,15 jan,jul *", "5 4 * * 7", "0-30/10 * * * *"}
+	for _, expr := range valid {
+		if _, err := cron.Parse(expr); err != nil {
+			t.Fatalf("TestCronParse: want %q to parse, got %+v", expr, err)
+		}
+	}
+
+	invalid := []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "* * * foo *"}
+	for _, expr := range invalid {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Fatalf("TestCronParse: want an error for %q", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("TestCronNext: %+v", err)
+	}
+
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 5, 1, 10, 0, 30, 0, time.UTC), time.Date(2024, 5, 1, 10, 1, 0, 0, time.UTC)},
+		// Strictly after
+		{"0 3 * * *", time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 1, 10, 16, 0, 0, time.UTC), time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 9 * * mon", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 6, 9, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 15 * fri", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		// A step over the whole range is the same as *, so only the weekday restricts
+		{"0 0 */1 * 1", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0-6", time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, 5, 1, 12, 0, 0, 0, newYork), time.Date(2024, 5, 2, 3, 0, 0, 0, newYork)},
+		// 2:30 does not exist on the day clocks spring forward
+		{"30 2 * * *", time.Date(2024, 3, 9, 12, 0, 0, 0, newYork), time.Date(2024, 3, 11, 2, 30, 0, 0, newYork)},
+		{"0 0 30 2 *", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, test := range tests {
+		schedule, err := cron.Parse(test.expr)
+		if err != nil {
+			t.Fatalf("TestCronNext: %+v", err)
+		}
+		got := schedule.Next(test.from)
+		if !got.Equal(test.want) {
+			t.Fatalf("TestCronNext: %q from %s want=%s, got=%s", test.expr, test.from, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/database"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// A database created before columns were added to the tables is upgraded on setup
+func TestMigrateTables(t *testing.T) {
+	path := "migrate.db3"
+	CleanupTestDB(path)
+	db, err := database.Connect(path)
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+	_, err = db.Exec(`
+        CREATE TABLE devices (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        device_id TEXT UNIQUE NOT NULL,
+        last_online DATETIME NULL
+        );
+        CREATE TABLE relays (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        device_key INTEGER NOT NULL,
+        cloud_function TEXT NOT NULL,
+        argument TEXT NOT NULL,
+        desired_return_code INTEGER NULL,
+        scheduled_time DATETIME NOT NULL,
+        status INTEGER NOT NULL,
+        tries INTEGER NOT NULL,
+        FOREIGN KEY(device_key) REFERENCES devices(id)
+        );
+        INSERT INTO devices (device_id) VALUES ('dev0');
+        INSERT INTO relays (device_key, cloud_function, argument, scheduled_time, status, tries)
+        VALUES (1, 'func0', 'arg0', '2024-05-14 20:17:32.897647+00:00', 0, 0);
+        `)
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+	db.Close()
+
+	db, err = database.Setup(path, true)
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+	defer db.Close()
+
+	relay, err := models.SelectRelay(db, 1)
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+	scheduledTime, err := time.Parse(layout, "2024-05-14 20:17:32.897647+00:00")
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+	scheduledTime = scheduledTime.UTC()
+	err = AssertRelay(relay, "dev0", "func0", "arg0", nil, models.RelayReady, &scheduledTime, 0)
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+
+	// New relays can use the migrated tables
+	_, err = AssertCreateRelay(db, "dev0", "func0", "", nil, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("TestMigrateTables: %+v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestDependencies(t *testing.T) {
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	createRelay := func(deviceId string, options models.RelayOptions) int {
+		id, err := server.CreateRelay(db, deviceId, "func0", "", nil, now, options)
+		if err != nil {
+			t.Fatalf("TestDependencies: %+v", err)
+		}
+		return id
+	}
+
+	configId := createRelay("dev0", models.RelayOptions{})
+	enableId := createRelay("dev1", models.RelayOptions{DependsOn: []int{configId}})
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{configId})
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	// Blocked relays do not wake the scheduler
+	next, err := models.SelectNextScheduledTime(db, models.RelayReady)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	if next == nil || !next.Equal(now) {
+		t.Fatalf("TestDependencies: next scheduled time want=%s, got=%v", now, next)
+	}
+	err = models.UpdateRelayStatus(db, configId, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{enableId})
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, enableId, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+
+	parent := createRelay("dev0", models.RelayOptions{})
+	cancelled := createRelay("dev1", models.RelayOptions{DependsOn: []int{parent}})
+	cascaded := createRelay("dev2", models.RelayOptions{DependsOn: []int{cancelled}})
+	runs := createRelay("dev3", models.RelayOptions{DependsOn: []int{parent}, OnDependencyFailure: models.DependencyFailureRun})
+	n, err := server.CancelDependents(db)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	if n != 0 {
+		t.Fatalf("TestDependencies: cancelled want=0, got=%d", n)
+	}
+
+	err = models.UpdateRelayStatus(db, parent, models.RelayFailed)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	n, err = server.CancelDependents(db)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	if n != 2 {
+		t.Fatalf("TestDependencies: cancelled want=2, got=%d", n)
+	}
+	for relayId, status := range map[int]models.RelayStatus{cancelled: models.RelayCancelled, cascaded: models.RelayCancelled, runs: models.RelayReady} {
+		err = AssertRelayStatusWithin(db, relayId, status, 0)
+		if err != nil {
+			t.Fatalf("TestDependencies: %+v", err)
+		}
+	}
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{runs})
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+
+	relay, err := models.SelectRelay(db, runs)
+	if err != nil {
+		t.Fatalf("TestDependencies: %+v", err)
+	}
+	if !SliceCompare(relay.DependsOn, []int{parent}) || relay.OnDependencyFailure != models.DependencyFailureRun {
+		t.Fatalf("TestDependencies: want dependency on %d, got %+v", parent, relay)
+	}
+}
+
+// A relay for one device runs once the relay it depends on completes on another device
+func TestDependencySequence(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("dependency.db3")
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	defer db.Close()
+
+	wakeup := server.NewWakeup()
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, wakeup))
+	defer srv.Close()
+
+	drc := 3
+	missing := []int{1000}
+	resp, err := postRelay(srv.URL, models.CreateRelayRequest{DeviceId: "dev1", CloudFunction: "enable", DependsOn: missing})
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	if resp != http.StatusUnprocessableEntity {
+		t.Fatalf("TestDependencySequence: status want=%d, got=%d", http.StatusUnprocessableEntity, resp)
+	}
+
+	now := time.Now().UTC()
+	// A parent listed twice is rejected rather than failing on the dependency's unique constraint
+	repeatedId, err := server.CreateRelay(db, "dev0", "config", "", nil, now.Add(time.Hour), models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	resp, err = postRelay(srv.URL, models.CreateRelayRequest{DeviceId: "dev1", CloudFunction: "enable", DependsOn: []int{repeatedId, repeatedId}})
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	if resp != http.StatusUnprocessableEntity {
+		t.Fatalf("TestDependencySequence: repeated parent status want=%d, got=%d", http.StatusUnprocessableEntity, resp)
+	}
+
+	// The parent is scheduled after its dependent, which must wait for it regardless
+	later := now.Add(200 * time.Millisecond)
+	configId, err := server.CreateRelay(db, "dev0", "config", "3", &drc, later, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	enableId, err := server.CreateRelay(db, "dev1", "enable", "3", &drc, now, models.RelayOptions{DependsOn: []int{configId}})
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), wakeup)
+	defer stop()
+
+	time.Sleep(100 * time.Millisecond)
+	err = AssertRelayStatusWithin(db, enableId, models.RelayReady, 0)
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, enableId, models.RelayComplete, 2*time.Second)
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, configId, models.RelayComplete, 0)
+	if err != nil {
+		t.Fatalf("TestDependencySequence: %+v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Stands in for Particle's event stream, each connection sends the next batch of events and then
+// ends the stream, apart from the last which stays open
+func statusEventServer(batches [][]string) (*httptest.Server, func() int) {
+	var mu sync.Mutex
+	connections := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		n := connections
+		connections++
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ":ok\n\n")
+		if n < len(batches) {
+			for _, event := range batches[n] {
+				fmt.Fprint(w, event)
+			}
+		}
+		w.(http.Flusher).Flush()
+		if n >= len(batches)-1 {
+			<-r.Context().Done()
+		}
+	}))
+	return srv, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return connections
+	}
+}
+
+func statusEvent(deviceId string, status string) string {
+	return fmt.Sprintf("event: spark/status\ndata: {\"data\":\"%s\",\"ttl\":60,\"published_at\":\"2024-05-14T20:17:32.897Z\",\"coreid\":\"%s\"}\n\n", status, deviceId)
+}
+
+func TestSubscribeStatusEvents(t *testing.T) {
+	srv, connections := statusEventServer([][]string{
+		{statusEvent("dev0", "online"), "event: other\ndata: {}\n\n"},
+		{statusEvent("dev1", "offline"), statusEvent("dev0", "rebooting"), statusEvent("dev0", "offline")},
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan particle.DeviceStatusEvent, 10)
+	done := make(chan struct{})
+	go func() {
+		backoff := particle.Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+		particle.SubscribeStatusEvents(ctx, srv.URL, "token", backoff, func(event particle.DeviceStatusEvent) {
+			events <- event
+		})
+		close(done)
+	}()
+
+	published := time.Date(2024, 5, 14, 20, 17, 32, 897000000, time.UTC)
+	want := []particle.DeviceStatusEvent{
+		{DeviceId: "dev0", Online: true, Time: published},
+		{DeviceId: "dev1", Online: false, Time: published},
+		{DeviceId: "dev0", Online: false, Time: published},
+	}
+	for i, w := range want {
+		select {
+		case event := <-events:
+			if event != w {
+				t.Errorf("TestSubscribeStatusEvents: event %d want=%+v, got=%+v", i, w, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("TestSubscribeStatusEvents: timed out waiting for event %d", i)
+		}
+	}
+	if n := connections(); n != 2 {
+		t.Errorf("TestSubscribeStatusEvents: expected to reconnect once, connections=%d", n)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TestSubscribeStatusEvents: subscriber did not stop")
+	}
+}
+
+func TestSubscribeStatusEventsBackoff(t *testing.T) {
+	var mu sync.Mutex
+	var attempts []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts = append(attempts, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	backoff := particle.Backoff{Initial: 20 * time.Millisecond, Max: 80 * time.Millisecond}
+	particle.SubscribeStatusEvents(ctx, srv.URL, "token", backoff, func(particle.DeviceStatusEvent) {})
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Delays of 20, 40, 80, 80... ms
+	if len(attempts) < 4 || len(attempts) > 7 {
+		t.Fatalf("TestSubscribeStatusEventsBackoff: unexpected number of attempts %d", len(attempts))
+	}
+	if gap := attempts[3].Sub(attempts[2]); gap < 80*time.Millisecond {
+		t.Errorf("TestSubscribeStatusEventsBackoff: expected the delay to reach the max, got %s", gap)
+	}
+}
+
+func TestHandleDeviceStatus(t *testing.T) {
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	later := now.Add(time.Hour)
+	waitingId, err := server.CreateRelay(db, "dev0", "func0", "", nil, later, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	// A relay which has not tried to ping the device yet keeps its time
+	futureId, err := server.CreateRelay(db, "dev0", "func1", "", nil, later, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	_, err = db.Exec("UPDATE relays SET pings = 1 WHERE id = ?", waitingId)
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+
+	wakeup := server.NewWakeup()
+	offline := particle.DeviceStatusEvent{DeviceId: "dev0", Online: false, Time: now.Add(-time.Minute)}
+	if err := server.HandleDeviceStatus(db, offline, wakeup); err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if wakeup.Sleep(context.Background(), 10*time.Millisecond) {
+		t.Errorf("TestHandleDeviceStatus: woken by an offline event")
+	}
+	device, err := models.SelectDeviceByDeviceId(db, "dev0")
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if device.LastOffline == nil || !device.LastOffline.Equal(offline.Time) {
+		t.Errorf("TestHandleDeviceStatus: last_offline want=%s, got=%v", offline.Time, device.LastOffline)
+	}
+
+	online := particle.DeviceStatusEvent{DeviceId: "dev0", Online: true, Time: now}
+	if err := server.HandleDeviceStatus(db, online, wakeup); err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if !wakeup.Sleep(context.Background(), 10*time.Millisecond) {
+		t.Errorf("TestHandleDeviceStatus: not woken by an online event")
+	}
+	device, err = models.SelectDeviceByDeviceId(db, "dev0")
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if !device.IsOnline(time.Now().UTC(), time.Minute) {
+		t.Errorf("TestHandleDeviceStatus: device should be online, got=%+v", device)
+	}
+
+	relay, err := models.SelectRelay(db, waitingId)
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if relay.ScheduledTime.After(time.Now().UTC()) {
+		t.Errorf("TestHandleDeviceStatus: relay %d should be due, scheduled at %s", waitingId, relay.ScheduledTime)
+	}
+	relay, err = models.SelectRelay(db, futureId)
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if !relay.ScheduledTime.Equal(later) {
+		t.Errorf("TestHandleDeviceStatus: relay %d want scheduled at %s, got %s", futureId, later, relay.ScheduledTime)
+	}
+
+	// Devices without relays are ignored
+	unknown := particle.DeviceStatusEvent{DeviceId: "unknown", Online: true, Time: now}
+	if err := server.HandleDeviceStatus(db, unknown, wakeup); err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	device, err = models.SelectDeviceByDeviceId(db, "unknown")
+	if err != nil {
+		t.Fatalf("TestHandleDeviceStatus: %+v", err)
+	}
+	if device != nil {
+		t.Errorf("TestHandleDeviceStatus: unknown device was added")
+	}
+}
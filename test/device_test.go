@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Wraps the mock to count pings per device
+type pingCounter struct {
+	particle.MockParticle
+	mu    sync.Mutex
+	pings map[string]int
+}
+
+func (p *pingCounter) Ping(ctx context.Context, deviceId string) (bool, error) {
+	p.mu.Lock()
+	p.pings[deviceId]++
+	p.mu.Unlock()
+	return p.MockParticle.Ping(ctx, deviceId)
+}
+
+func (p *pingCounter) count(deviceId string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pings[deviceId]
+}
+
+func TestDeviceIsOnline(t *testing.T) {
+	now := time.Now().UTC()
+	recent := now.Add(-time.Minute)
+	stale := now.Add(-time.Hour)
+	freshness := 5 * time.Minute
+
+	tests := []struct {
+		device models.Device
+		online bool
+	}{
+		{models.Device{}, false},
+		{models.Device{LastOnline: &recent}, true},
+		{models.Device{LastOnline: &stale}, false},
+		{models.Device{LastOnline: &recent, LastOffline: &stale}, true},
+		{models.Device{LastOnline: &stale, LastOffline: &recent}, false},
+	}
+	for i, test := range tests {
+		if online := test.device.IsOnline(now, freshness); online != test.online {
+			t.Fatalf("TestDeviceIsOnline: device %d online want=%t, got=%t", i, test.online, online)
+		}
+	}
+}
+
+func TestDeviceFreshness(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Settings.CFRetrySeconds = 0
+
+	db, err := SetupFileDB("device.db3")
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	stale := now.Add(-time.Hour)
+	recent := now.Add(-time.Second)
+	staleId, err := server.CreateRelay(db, "stale", "func0", "", nil, now, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	freshId, err := server.CreateRelay(db, "fresh", "func0", "", nil, now, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	timeoutId, err := server.CreateRelay(db, "timeout"+particle.DeviceCFTimeout, "func0", "", nil, now, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	for deviceId, lastOnline := range map[string]time.Time{"stale": stale, "fresh": recent, "timeout" + particle.DeviceCFTimeout: recent} {
+		device, err := models.SelectDeviceByDeviceId(db, deviceId)
+		if err != nil {
+			t.Fatalf("TestDeviceFreshness: %+v", err)
+		}
+		err = models.UpdateDevice(db, device.Id, &lastOnline)
+		if err != nil {
+			t.Fatalf("TestDeviceFreshness: %+v", err)
+		}
+	}
+
+	counter := &pingCounter{MockParticle: particle.NewMock(), pings: make(map[string]int)}
+	stop := StartBackgroundTask(&myConfig, db, counter, server.NewWakeup())
+	defer stop()
+
+	err = AssertRelayStatusWithin(db, staleId, models.RelayComplete, time.Second)
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, freshId, models.RelayComplete, time.Second)
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	// Every try after the first timeout pings the device first
+	err = AssertRelayStatusWithin(db, timeoutId, models.RelayFailed, 2*time.Second)
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	for deviceId, pings := range map[string]int{"stale": 1, "fresh": 0, "timeout" + particle.DeviceCFTimeout: myConfig.Settings.MaxRetries - 1} {
+		if got := counter.count(deviceId); got != pings {
+			t.Fatalf("TestDeviceFreshness: device %s pings want=%d, got=%d", deviceId, pings, got)
+		}
+	}
+
+	// A successful cloud function call refreshes last_online, a timeout sets last_offline
+	device, err := models.SelectDeviceByDeviceId(db, "fresh")
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	if device.LastOnline == nil || !device.LastOnline.After(recent) || device.LastOffline != nil {
+		t.Fatalf("TestDeviceFreshness: want a refreshed online device, got %+v", device)
+	}
+	device, err = models.SelectDeviceByDeviceId(db, "timeout"+particle.DeviceCFTimeout)
+	if err != nil {
+		t.Fatalf("TestDeviceFreshness: %+v", err)
+	}
+	if device.LastOffline == nil || device.IsOnline(time.Now(), time.Hour) {
+		t.Fatalf("TestDeviceFreshness: want an offline device, got %+v", device)
+	}
+}
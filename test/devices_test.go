@@ -0,0 +1,113 @@
+package test
+
+import (
+	"net"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestDevices(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("devices.db3")
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	now := time.Now().UTC()
+	// dev0 has a backlog, dev1 has only finished relays
+	var dev0Ids []int
+	for i := 0; i < 3; i++ {
+		relayId, err := server.CreateRelay(db, "dev0", "func0", "", nil, now.Add(time.Duration(3-i)*time.Minute), models.RelayOptions{})
+		if err != nil {
+			t.Fatalf("TestDevices: %+v", err)
+		}
+		dev0Ids = append(dev0Ids, relayId)
+	}
+	err = models.UpdateRelayStatus(db, dev0Ids[2], models.RelayFailed)
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	for _, status := range []models.RelayStatus{models.RelayComplete, models.RelayComplete, models.RelayFailed} {
+		relayId, err := server.CreateRelay(db, "dev1", "func0", "", nil, now, models.RelayOptions{})
+		if err != nil {
+			t.Fatalf("TestDevices: %+v", err)
+		}
+		err = models.UpdateRelayStatus(db, relayId, status)
+		if err != nil {
+			t.Fatalf("TestDevices: %+v", err)
+		}
+	}
+	deviceKey, err := models.InsertOrUpdateDevice(db, "dev1")
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	err = models.UpdateDevice(db, deviceKey, &now)
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+
+	devices, err := client.GetDevices(false)
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	if len(devices) != 2 || devices[0].DeviceId != "dev0" || devices[1].DeviceId != "dev1" {
+		t.Fatalf("TestDevices: want dev0 and dev1, got %+v", devices)
+	}
+	dev0 := devices[0]
+	if dev0.PendingRelays != 2 || dev0.FailedRelays != 1 || dev0.CompletedRelays != 0 || dev0.LastOnline != nil {
+		t.Fatalf("TestDevices: unexpected dev0 %+v", dev0)
+	}
+	// The relay scheduled first, not the one created first
+	if dev0.NextRelay == nil || dev0.NextRelay.Id != dev0Ids[1] {
+		t.Fatalf("TestDevices: want next relay %d, got %+v", dev0Ids[1], dev0.NextRelay)
+	}
+
+	dev1, err := client.GetDevice("dev1")
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	if dev1.PendingRelays != 0 || dev1.FailedRelays != 1 || dev1.CompletedRelays != 2 || dev1.NextRelay != nil ||
+		dev1.LastOnline == nil || !dev1.LastOnline.Equal(now) {
+		t.Fatalf("TestDevices: unexpected dev1 %+v", dev1)
+	}
+
+	devices, err = client.GetDevices(true)
+	if err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	if len(devices) != 1 || devices[0].DeviceId != "dev0" {
+		t.Fatalf("TestDevices: want only dev0 with pending relays, got %+v", devices)
+	}
+
+	_, err = client.GetDevice("dev2")
+	if err == nil {
+		t.Fatalf("TestDevices: want an error for an unknown device")
+	}
+
+	relays := client.ListDeviceRelays("dev0", models.ListRelaysRequest{
+		RelayFilter: models.RelayFilter{Statuses: []models.RelayStatus{models.RelayReady}},
+		Limit:       1,
+	})
+	var relayIds []int
+	for relays.Next() {
+		relayIds = append(relayIds, relays.Relay().Id)
+	}
+	if err := relays.Err(); err != nil {
+		t.Fatalf("TestDevices: %+v", err)
+	}
+	if !slices.Equal(relayIds, dev0Ids[:2]) {
+		t.Fatalf("TestDevices: want relays %v, got %v", dev0Ids[:2], relayIds)
+	}
+}
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestEventStream(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Events.PollMs = 10
+	db, err := SetupFileDB("events.db3")
+	if err != nil {
+		t.Fatalf("TestEventStream: %+v", err)
+	}
+	defer db.Close()
+
+	wakeup := server.NewWakeup()
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, wakeup))
+	defer srv.Close()
+	relayClient := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	open := func(filter models.EventFilter, lastEventId *int) *client.EventStream {
+		stream, err := relayClient.StreamEvents(ctx, filter, lastEventId)
+		if err != nil {
+			t.Fatalf("TestEventStream: %+v", err)
+		}
+		return stream
+	}
+	next := func(stream *client.EventStream) models.Event {
+		if !stream.Next() {
+			t.Fatalf("TestEventStream: stream ended: %+v", stream.Err())
+		}
+		return stream.Event()
+	}
+
+	// Events from before a stream was opened are only sent when resuming
+	_, err = server.CreateRelay(db, "dev2", "func0", "", nil, time.Now().UTC().Add(time.Hour), models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestEventStream: %+v", err)
+	}
+	all := open(models.EventFilter{}, nil)
+	defer all.Close()
+	dev1 := "dev1"
+	dev1Stream := open(models.EventFilter{DeviceId: &dev1}, nil)
+	defer dev1Stream.Close()
+
+	drc := 5
+	argument := "5"
+	relayId, err := relayClient.CreateRelayFromRequest(models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0",
+		Argument: &argument, DesiredReturnCode: &drc})
+	if err != nil {
+		t.Fatalf("TestEventStream: %+v", err)
+	}
+	later := time.Now().UTC().Add(time.Hour)
+	cancelledId, err := relayClient.CreateRelayFromRequest(models.CreateRelayRequest{DeviceId: dev1, CloudFunction: "func0", ScheduledTime: &later})
+	if err != nil {
+		t.Fatalf("TestEventStream: %+v", err)
+	}
+	err = relayClient.CancelRelay(cancelledId)
+	if err != nil {
+		t.Fatalf("TestEventStream: %+v", err)
+	}
+
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), wakeup)
+	defer stop()
+
+	created := next(all)
+	if created.Type != models.EventRelayCreated || created.RelayId == nil || *created.RelayId != relayId || created.DeviceId != "dev0" {
+		t.Fatalf("TestEventStream: want relay %d created, got %+v", relayId, created)
+	}
+	seen := map[string]int{}
+	lastId := created.Id
+	for seen[models.EventRelayCompleted] == 0 {
+		event := next(all)
+		if event.Id <= lastId {
+			t.Fatalf("TestEventStream: event %d after event %d", event.Id, lastId)
+		}
+		lastId = event.Id
+		if event.DeviceId == "dev0" {
+			seen[event.Type]++
+		}
+	}
+	// A ping and a cloud function call
+	if seen[models.EventRelayAttempted] != 2 || seen[models.EventDeviceOnline] != 1 {
+		t.Fatalf("TestEventStream: want 2 attempts and the device coming online, got %v", seen)
+	}
+
+	for _, want := range []string{models.EventRelayCreated, models.EventRelayCancelled} {
+		event := next(dev1Stream)
+		if event.Type != want || event.DeviceId != dev1 || event.RelayId == nil || *event.RelayId != cancelledId {
+			t.Fatalf("TestEventStream: want relay %d %s, got %+v", cancelledId, want, event)
+		}
+	}
+
+	// Resuming after the relay was created replays the rest of its events
+	resumed := open(models.EventFilter{RelayId: &relayId}, &created.Id)
+	defer resumed.Close()
+	if event := next(resumed); event.Type != models.EventRelayAttempted || *event.RelayId != relayId {
+		t.Fatalf("TestEventStream: want relay %d attempted, got %+v", relayId, event)
+	}
+
+	for _, query := range []string{"relay_id=x", "last_event_id=-1"} {
+		resp, err := http.Get(srv.URL + "/api/events?" + query)
+		if err != nil {
+			t.Fatalf("TestEventStream: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("TestEventStream: %s, status want=%d, got=%d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+}
+
+// Devices emit an event when their known state changes, not each time they are seen
+func TestDeviceEvents(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestDeviceEvents: %+v", err)
+	}
+	defer db.Close()
+
+	deviceKey, err := models.InsertDevice(db, "dev0")
+	if err != nil {
+		t.Fatalf("TestDeviceEvents: %+v", err)
+	}
+	now := time.Now().UTC()
+	for i, online := range []bool{true, true, false, false, true} {
+		at := now.Add(time.Duration(i) * time.Second)
+		if online {
+			err = models.UpdateDevice(db, deviceKey, &at)
+		} else {
+			err = models.UpdateDeviceOffline(db, deviceKey, at)
+		}
+		if err != nil {
+			t.Fatalf("TestDeviceEvents: %+v", err)
+		}
+	}
+
+	events, err := models.SelectEvents(db, 0, models.EventFilter{}, 10)
+	if err != nil {
+		t.Fatalf("TestDeviceEvents: %+v", err)
+	}
+	want := []string{models.EventDeviceOnline, models.EventDeviceOffline, models.EventDeviceOnline}
+	var got []string
+	for _, event := range events {
+		got = append(got, event.Type)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("TestDeviceEvents: want %v, got %v", want, got)
+	}
+
+	deleted, err := server.PruneEvents(&myConfig, db, now)
+	if err != nil {
+		t.Fatalf("TestDeviceEvents: %+v", err)
+	}
+	if deleted != 0 {
+		t.Fatalf("TestDeviceEvents: deleted want=0, got=%d", deleted)
+	}
+	deleted, err = server.PruneEvents(&myConfig, db, now.Add(time.Duration(myConfig.Events.RetentionSeconds+1)*time.Second))
+	if err != nil {
+		t.Fatalf("TestDeviceEvents: %+v", err)
+	}
+	if deleted != len(want) {
+		t.Fatalf("TestDeviceEvents: deleted want=%d, got=%d", len(want), deleted)
+	}
+}
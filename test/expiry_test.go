@@ -0,0 +1,143 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestExpireRelays(t *testing.T) {
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestExpireRelays: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+	expiredId, err := server.CreateRelay(db, "dev0", "func0", "", nil, past, models.RelayOptions{ExpiresAt: &now})
+	if err != nil {
+		t.Fatalf("TestExpireRelays: %+v", err)
+	}
+	liveId, err := server.CreateRelay(db, "dev0", "func0", "", nil, past, models.RelayOptions{ExpiresAt: &future})
+	if err != nil {
+		t.Fatalf("TestExpireRelays: %+v", err)
+	}
+	foreverId, err := server.CreateRelay(db, "dev0", "func0", "", nil, past, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestExpireRelays: %+v", err)
+	}
+
+	n, err := server.ExpireRelays(db, now)
+	if err != nil {
+		t.Fatalf("TestExpireRelays: %+v", err)
+	}
+	if n != 1 {
+		t.Fatalf("TestExpireRelays: expired want=1, got=%d", n)
+	}
+	for relayId, status := range map[int]models.RelayStatus{expiredId: models.RelayExpired, liveId: models.RelayReady, foreverId: models.RelayReady} {
+		err = AssertRelayStatusWithin(db, relayId, status, 0)
+		if err != nil {
+			t.Fatalf("TestExpireRelays: %+v", err)
+		}
+	}
+}
+
+// A relay for an offline device expires while waiting for its next ping
+func TestExpireOfflineRelay(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Settings.MaxSleepSeconds = 3600
+
+	db, err := SetupFileDB("expiry.db3")
+	if err != nil {
+		t.Fatalf("TestExpireOfflineRelay: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	expiresAt := now.Add(300 * time.Millisecond)
+	relayId, err := server.CreateRelay(db, "dev"+particle.DevicePingOffline, "func0", "", nil, now, models.RelayOptions{ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatalf("TestExpireOfflineRelay: %+v", err)
+	}
+
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), server.NewWakeup())
+	defer stop()
+
+	err = AssertRelayStatusWithin(db, relayId, models.RelayExpired, time.Second)
+	if err != nil {
+		t.Fatalf("TestExpireOfflineRelay: %+v", err)
+	}
+	relay, err := models.SelectRelay(db, relayId)
+	if err != nil {
+		t.Fatalf("TestExpireOfflineRelay: %+v", err)
+	}
+	if relay.Pings != 1 {
+		t.Fatalf("TestExpireOfflineRelay: pings want=1, got=%d", relay.Pings)
+	}
+}
+
+func TestCreateRelayExpiry(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestCreateRelayExpiry: %+v", err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+
+	scheduledTime := time.Now().Add(time.Hour).UTC()
+	ttl := 60
+	expiresAt := scheduledTime.Add(-time.Minute)
+	requests := []struct {
+		req    models.CreateRelayRequest
+		status int
+	}{
+		{models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0", ScheduledTime: &scheduledTime, TtlSeconds: &ttl}, http.StatusOK},
+		{models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0", ScheduledTime: &scheduledTime, TtlSeconds: &ttl, ExpiresAt: &expiresAt}, http.StatusUnprocessableEntity},
+		{models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0", ScheduledTime: &scheduledTime, ExpiresAt: &expiresAt}, http.StatusUnprocessableEntity},
+	}
+	for i, request := range requests {
+		jsonData, err := json.Marshal(request.req)
+		if err != nil {
+			t.Fatalf("TestCreateRelayExpiry: %+v", err)
+		}
+		resp, err := http.Post(srv.URL+"/api/relays", "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			t.Fatalf("TestCreateRelayExpiry: %+v", err)
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != request.status {
+			t.Fatalf("TestCreateRelayExpiry: request %d status want=%d, got=%d, body=%s", i, request.status, resp.StatusCode, body)
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+
+		relayId, err := strconv.Atoi(body.String())
+		if err != nil {
+			t.Fatalf("TestCreateRelayExpiry: %+v", err)
+		}
+		relay, err := models.SelectRelay(db, relayId)
+		if err != nil {
+			t.Fatalf("TestCreateRelayExpiry: %+v", err)
+		}
+		want := scheduledTime.Add(time.Duration(ttl) * time.Second)
+		if relay.ExpiresAt == nil || !relay.ExpiresAt.Equal(want) {
+			t.Fatalf("TestCreateRelayExpiry: expires at want=%s, got=%v", want, relay.ExpiresAt)
+		}
+	}
+}
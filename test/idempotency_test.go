@@ -0,0 +1,145 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// Posts the relay with the Idempotency-Key header, returns the status code, the relay id if it was created and
+// whether the response was replayed
+func postRelayWithKey(url string, key string, req models.CreateRelayRequest) (int, int, bool, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	httpReq, err := http.NewRequest("POST", url+"/api/relays", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, 0, false, nil
+	}
+	relayId, err := strconv.Atoi(string(body))
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("postRelayWithKey: %w on %s", err, body)
+	}
+	return resp.StatusCode, relayId, resp.Header.Get("Idempotent-Replayed") == "true", nil
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("idempotency.db3")
+	if err != nil {
+		t.Fatalf("TestIdempotencyKeys: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	later := time.Now().UTC().Add(time.Hour)
+	req := models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0", ScheduledTime: &later}
+
+	// A repeated request returns the original relay
+	statusCode, relayId, replayed, err := postRelayWithKey(srv.URL, "key0", req)
+	if err != nil || statusCode != http.StatusOK || replayed {
+		t.Fatalf("TestIdempotencyKeys: status %d, replayed %t, %+v", statusCode, replayed, err)
+	}
+	statusCode, repeatId, replayed, err := postRelayWithKey(srv.URL, "key0", req)
+	if err != nil || statusCode != http.StatusOK || !replayed || repeatId != relayId {
+		t.Fatalf("TestIdempotencyKeys: want replayed relay %d, got %d, status %d, replayed %t, %+v", relayId, repeatId, statusCode, replayed, err)
+	}
+
+	// The key may also be given in the body
+	key := "key0"
+	req.ClientRequestId = &key
+	repeatId, err = client.CreateRelayFromRequest(req)
+	if err != nil || repeatId != relayId {
+		t.Fatalf("TestIdempotencyKeys: want relay %d for client_request_id, got %d, %+v", relayId, repeatId, err)
+	}
+	req.ClientRequestId = nil
+
+	// Another payload under the same key is rejected
+	argument := "a"
+	other := req
+	other.Argument = &argument
+	statusCode, _, _, err = postRelayWithKey(srv.URL, "key0", other)
+	if err != nil || statusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("TestIdempotencyKeys: want %d for another payload, got %d, %+v", http.StatusUnprocessableEntity, statusCode, err)
+	}
+
+	// The header and the body must agree
+	key = "key1"
+	req.ClientRequestId = &key
+	statusCode, _, _, err = postRelayWithKey(srv.URL, "key2", req)
+	if err != nil || statusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("TestIdempotencyKeys: want %d for mismatched keys, got %d, %+v", http.StatusUnprocessableEntity, statusCode, err)
+	}
+	req.ClientRequestId = nil
+
+	// The client generates a new key for each request
+	firstId, err := client.CreateRelayFromRequest(req)
+	if err != nil {
+		t.Fatalf("TestIdempotencyKeys: %+v", err)
+	}
+	secondId, err := client.CreateRelayFromRequest(req)
+	if err != nil {
+		t.Fatalf("TestIdempotencyKeys: %+v", err)
+	}
+	if firstId == relayId || secondId == relayId || firstId == secondId {
+		t.Fatalf("TestIdempotencyKeys: want new relays, got %d and %d", firstId, secondId)
+	}
+
+	// Keys past the retention window are forgotten
+	expiredAt := time.Now().UTC().Add(-time.Duration(myConfig.Settings.IdempotencyKeySeconds+1) * time.Second)
+	hash := "hash"
+	err = models.InsertIdempotencyKey(db, models.IdempotencyKey{Key: "key3", RequestHash: hash, RelayId: relayId, CreatedAt: expiredAt})
+	if err != nil {
+		t.Fatalf("TestIdempotencyKeys: %+v", err)
+	}
+	statusCode, newId, replayed, err := postRelayWithKey(srv.URL, "key3", other)
+	if err != nil || statusCode != http.StatusOK || replayed || newId == relayId {
+		t.Fatalf("TestIdempotencyKeys: want a new relay for an expired key, got %d, status %d, replayed %t, %+v", newId, statusCode, replayed, err)
+	}
+
+	err = models.InsertIdempotencyKey(db, models.IdempotencyKey{Key: "key4", RequestHash: hash, RelayId: relayId, CreatedAt: expiredAt})
+	if err != nil {
+		t.Fatalf("TestIdempotencyKeys: %+v", err)
+	}
+	deleted, err := server.PruneIdempotencyKeys(&myConfig, db, time.Now().UTC())
+	if err != nil {
+		t.Fatalf("TestIdempotencyKeys: %+v", err)
+	}
+	if deleted != 1 {
+		t.Fatalf("TestIdempotencyKeys: want 1 pruned key, got %d", deleted)
+	}
+	existing, err := models.SelectIdempotencyKey(db, "key0")
+	if err != nil || existing == nil || existing.RelayId != relayId {
+		t.Fatalf("TestIdempotencyKeys: want key0 to be kept, got %+v, %+v", existing, err)
+	}
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/database"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestMultipleInstances(t *testing.T) {
+	path := "instances.db3"
+	db0, err := SetupFileDB(path)
+	if err != nil {
+		t.Fatalf("TestMultipleInstances: %+v", err)
+	}
+	defer db0.Close()
+	db1, err := database.Setup(path, true)
+	if err != nil {
+		t.Fatalf("TestMultipleInstances: %+v", err)
+	}
+	defer db1.Close()
+
+	nDevices := 5
+	nRelays := 50
+	relayIds := make([]int, nRelays)
+	for i := 0; i < nRelays; i++ {
+		deviceId := fmt.Sprintf("dev_%d", i%nDevices)
+		relayIds[i], err = AssertCreateRelay(db0, deviceId, "func0", fmt.Sprintf("relay_%d", i), nil, time.Now().UTC())
+		if err != nil {
+			t.Fatalf("TestMultipleInstances: %+v", err)
+		}
+	}
+
+	recorder := newRecordingParticle(5 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for i, db := range []*sql.DB{db0, db1} {
+		myConfig := config.GetDefaultConfig()
+		myConfig.Settings.InstanceId = fmt.Sprintf("instance_%d", i)
+		myConfig.Settings.MaxSleepSeconds = 1
+		wg.Add(1)
+		go func() {
+			server.BackgroundTask(ctx, &myConfig, db, recorder, server.NewWakeup())
+			wg.Done()
+		}()
+	}
+
+	for _, relayId := range relayIds {
+		err = AssertRelayStatusWithin(db0, relayId, models.RelayComplete, 5*time.Second)
+		if err != nil {
+			t.Fatalf("TestMultipleInstances: %+v", err)
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	for i := 0; i < nRelays; i++ {
+		argument := fmt.Sprintf("relay_%d", i)
+		if recorder.calls[argument] != 1 {
+			t.Errorf("TestMultipleInstances: relay %d called want=1, got=%d", relayIds[i], recorder.calls[argument])
+		}
+	}
+	if len(recorder.violations) != 0 {
+		t.Fatalf("TestMultipleInstances: %+v", recorder.violations)
+	}
+}
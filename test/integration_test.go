@@ -1,34 +1,40 @@
 package test
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"testing"
 	"time"
 
-	"relay/internal/client"
-	"relay/internal/models"
-	"relay/internal/particle"
-	"relay/internal/server"
-	"relay/internal/config"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/internal/config"
 )
 
 type TestRelay struct {
 	Id       int
 	DeviceId string
+	Argument string
 	DRC      int
 	Status   models.RelayStatus
 	Cancel   bool
 }
 
-func generateRelay(nDevices int) (string, int, models.RelayStatus) {
+// MockParticle returns the argument as the return value, or fails on particle.DeviceCFError
+func generateRelay(nDevices int) (string, string, int, models.RelayStatus) {
 	devNum := rand.Intn(nDevices)
 	deviceId := fmt.Sprintf("dev_%d", devNum)
-	drc := rand.Intn(3) + 1 // 1-3 correspond to MockParticle return status options DRC != status
-	if drc == 3 {           // Success
-		return deviceId, drc, models.RelayComplete
-	} else {
-		return deviceId, drc, models.RelayFailed
+	drc := 3
+	switch rand.Intn(3) {
+	case 0:
+		return deviceId, particle.DeviceCFError, drc, models.RelayFailed
+	case 1:
+		return deviceId, "2", drc, models.RelayFailed
+	default: // Success
+		return deviceId, "3", drc, models.RelayComplete
 	}
 }
 
@@ -38,32 +44,32 @@ func TestIntegration(t *testing.T) {
     myConfig := config.GetDefaultConfig()
     myConfig.Settings.PingRetrySeconds = 15
     myConfig.Settings.CFRetrySeconds = 10
+    myConfig.Server.Port = 8081
 
 	// db, err := SetupMemoryDB()
-	db, err := SetupFileDB("test.db3")
+	db, err := SetupFileDB("integration.db3")
 	if err != nil {
 		t.Fatalf("TestCancellations: %+v", err)
 	}
 	// defer db.Close()
 
 	particle := particle.NewMock()
-	go server.BackgroundTask(&myConfig, db, particle)
+	wakeup := server.NewWakeup()
+	go server.BackgroundTask(context.Background(), &myConfig, db, particle, wakeup)
 	go func() {
-		if err := server.Run(db, "localhost", "8080"); err != nil {
-			// TODO: Fix this warning
-			t.Fatalf("TestCancellations: Could not start server: %s\n", err)
+		if err := server.Run(context.Background(), &myConfig, db, wakeup); err != nil {
+			t.Errorf("TestCancellations: Could not start server: %s\n", err)
 		}
 	}()
 
 	time.Sleep(100 * time.Millisecond)
-	client := client.NewClient(8080)
+	client := client.NewClient(8081)
 	err = client.Ping()
 	if err != nil {
 		t.Fatalf("TestIntegration: %+v", err)
 	}
 
 	cloudFunction := "func0"
-	argument := ""
 	var scheduledTime *time.Time = nil
 
 	nRelays := 1000
@@ -72,13 +78,14 @@ func TestIntegration(t *testing.T) {
 
 	// TODO: use goroutines to hit in parallel?
 	for i := 0; i < nRelays; i++ {
-		deviceId, drc, status := generateRelay(nDevices)
+		deviceId, argument, drc, status := generateRelay(nDevices)
 		id, err := client.CreateRelay(deviceId, cloudFunction, argument, &drc, scheduledTime)
 		if err != nil {
 			t.Fatalf("TestIntegration: %+v", err)
 		}
 		testRelays[i].Id = id
 		testRelays[i].DeviceId = deviceId
+		testRelays[i].Argument = argument
 		testRelays[i].DRC = drc
 		testRelays[i].Status = status
 		testRelays[i].Cancel = rand.Intn(10) == 0
@@ -97,12 +104,12 @@ func TestIntegration(t *testing.T) {
 			relay, err := client.GetRelay(testRelays[i].Id)
 			if err != nil {
 				t.Logf("TestIntegration: expected an error for non existant relay got %+v\n", relay)
-			} else if relay.Status == models.RelayReady {
+			} else if relay.Status == models.RelayReady || relay.Status == models.RelayRunning {
 				time.Sleep(100 * time.Millisecond)
 				continue
 			} else if relay.Status == testRelays[i].Status ||
 				testRelays[i].Cancel && relay.Status == models.RelayCancelled {
-				err = AssertRelay(relay, testRelays[i].DeviceId, cloudFunction, argument, &testRelays[i].DRC, relay.Status, scheduledTime, relay.Tries)
+				err = AssertRelay(relay, testRelays[i].DeviceId, cloudFunction, testRelays[i].Argument, &testRelays[i].DRC, relay.Status, scheduledTime, relay.Tries)
 				if err != nil {
 					t.Fatalf("TestIntegration: %+v", err)
 				}
@@ -0,0 +1,152 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestRateLimitedBuckets(t *testing.T) {
+	limited := particle.NewRateLimited(particle.NewMock(),
+		particle.Rate{PerSecond: 1000, Burst: 1},
+		particle.Rate{PerSecond: 20, Burst: 2},
+		0)
+
+	// 2 calls go through right away, the other 4 wait 50ms each
+	start := time.Now()
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			returnValue, err := limited.CloudFunction(context.Background(), fmt.Sprintf("dev%d", i), "func0", "1")
+			if err != nil || returnValue != 1 {
+				errs <- fmt.Errorf("call %d: return value=%d, err=%+v", i, returnValue, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("TestRateLimitedBuckets: %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("TestRateLimitedBuckets: want 6 calls to take 200ms, took %s", elapsed)
+	}
+
+	// Pings have their own bucket
+	start = time.Now()
+	online, err := limited.Ping(context.Background(), "dev0")
+	if err != nil || !online {
+		t.Fatalf("TestRateLimitedBuckets: online=%t, err=%+v", online, err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("TestRateLimitedBuckets: ping waited %s on the cloud function limit", elapsed)
+	}
+
+	// A call which gives up waiting is never sent
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		_, err = limited.CloudFunction(ctx, "dev0", "func0", "")
+	}
+	if !errors.Is(err, particle.ErrNotSent) {
+		t.Fatalf("TestRateLimitedBuckets: want ErrNotSent, got %+v", err)
+	}
+}
+
+func TestRateLimitedDeviceSpacing(t *testing.T) {
+	limited := particle.NewRateLimited(particle.NewMock(), particle.Rate{}, particle.Rate{}, 50*time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := limited.Ping(context.Background(), "dev0"); err != nil {
+			t.Fatalf("TestRateLimitedDeviceSpacing: %+v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 95*time.Millisecond {
+		t.Fatalf("TestRateLimitedDeviceSpacing: want 3 calls to one device to take 100ms, took %s", elapsed)
+	}
+
+	// Other devices are not held up
+	start = time.Now()
+	if _, err := limited.CloudFunction(context.Background(), "dev1", "func0", ""); err != nil {
+		t.Fatalf("TestRateLimitedDeviceSpacing: %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("TestRateLimitedDeviceSpacing: dev1 waited %s", elapsed)
+	}
+}
+
+// Particle refuses the first n cloud function calls with 429
+type throttledParticle struct {
+	particle.MockParticle
+	mu         *sync.Mutex
+	refusals   *int
+	retryAfter time.Duration
+}
+
+func (p throttledParticle) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if *p.refusals > 0 {
+		*p.refusals--
+		return 0, fmt.Errorf("throttledParticle.CloudFunction: %w", &particle.APIError{StatusCode: 429, RetryAfter: p.retryAfter})
+	}
+	return p.MockParticle.CloudFunction(ctx, deviceId, cloudFunction, argument)
+}
+
+// A call Particle refused with 429 is not sent, and the next one waits for the Retry-After
+func TestRateLimitedTooManyRequests(t *testing.T) {
+	refusals := 1
+	throttled := throttledParticle{particle.NewMock(), &sync.Mutex{}, &refusals, 50 * time.Millisecond}
+	limited := particle.NewRateLimited(throttled, particle.Rate{}, particle.Rate{}, 0)
+
+	_, err := limited.CloudFunction(context.Background(), "dev0", "func0", "")
+	if !errors.Is(err, particle.ErrNotSent) {
+		t.Fatalf("TestRateLimitedTooManyRequests: want ErrNotSent, got %+v", err)
+	}
+	start := time.Now()
+	_, err = limited.CloudFunction(context.Background(), "dev1", "func0", "")
+	if err != nil {
+		t.Fatalf("TestRateLimitedTooManyRequests: %+v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Fatalf("TestRateLimitedTooManyRequests: want the call to wait 50ms, took %s", elapsed)
+	}
+
+	// The relay goes back to ready without using up a try
+	db, err := SetupFileDB("limiter_too_many.db3")
+	if err != nil {
+		t.Fatalf("TestRateLimitedTooManyRequests: %+v", err)
+	}
+	defer db.Close()
+	myConfig := config.GetDefaultConfig()
+	refusals = 2
+	relayId, err := server.CreateRelay(db, "dev0", "func0", "", nil, time.Now().UTC(), models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestRateLimitedTooManyRequests: %+v", err)
+	}
+	stop := StartBackgroundTask(&myConfig, db, particle.NewRateLimited(throttled, particle.Rate{}, particle.Rate{}, 0), server.NewWakeup())
+	defer stop()
+	err = AssertRelayStatusWithin(db, relayId, models.RelayComplete, 2*time.Second)
+	if err != nil {
+		t.Fatalf("TestRateLimitedTooManyRequests: %+v", err)
+	}
+	relay, err := models.SelectRelay(db, relayId)
+	if err != nil {
+		t.Fatalf("TestRateLimitedTooManyRequests: %+v", err)
+	}
+	if relay.Tries != 1 {
+		t.Fatalf("TestRateLimitedTooManyRequests: tries want=1, got=%d", relay.Tries)
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestRetryRelay(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Settings.CFRetrySeconds = 0
+	db, err := SetupFileDB("manual_retry.db3")
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	defer db.Close()
+
+	wakeup := server.NewWakeup()
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, wakeup))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	now := time.Now().UTC()
+	failedId, err := AssertCreateAndUpdateRelay(db, "dev0", "func0", particle.DeviceCFError, nil, now, models.RelayFailed, 3)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	expiresAt := now.Add(-time.Minute)
+	expiredId, err := server.CreateRelay(db, "dev1", "func0", "", nil, now.Add(-time.Hour), models.RelayOptions{ExpiresAt: &expiresAt, Priority: 2})
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, expiredId, models.RelayExpired)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	readyId, err := server.CreateRelay(db, "dev2", "func0", "", nil, now.Add(time.Hour), models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+
+	// Only failed, expired and cancelled relays can be retried
+	_, err = client.RetryRelay(readyId, models.RetryRelayRequest{})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusConflict)) {
+		t.Fatalf("TestRetryRelay: want %d for a ready relay, got %+v", http.StatusConflict, err)
+	}
+	_, err = client.RetryRelay(1000, models.RetryRelayRequest{})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusUnprocessableEntity)) {
+		t.Fatalf("TestRetryRelay: want %d for a missing relay, got %+v", http.StatusUnprocessableEntity, err)
+	}
+	mode := "again"
+	_, err = client.RetryRelay(failedId, models.RetryRelayRequest{Mode: &mode})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusUnprocessableEntity)) {
+		t.Fatalf("TestRetryRelay: want %d for an unknown mode, got %+v", http.StatusUnprocessableEntity, err)
+	}
+	noTries := 0
+	_, err = client.RetryRelay(failedId, models.RetryRelayRequest{MaxTries: &noTries})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusUnprocessableEntity)) {
+		t.Fatalf("TestRetryRelay: want %d for max_tries 0, got %+v", http.StatusUnprocessableEntity, err)
+	}
+
+	// Cloning leaves the original as it is
+	clone := models.RetryClone
+	later := now.Add(time.Hour)
+	cloneId, err := client.RetryRelay(expiredId, models.RetryRelayRequest{Mode: &clone, ScheduledTime: &later})
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, expiredId, models.RelayExpired, 0)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	relay, err := models.SelectRelay(db, cloneId)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	err = AssertRelay(relay, "dev1", "func0", "", nil, models.RelayReady, &later, 0)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	if cloneId == expiredId || relay.RetryOf == nil || *relay.RetryOf != expiredId || relay.Priority != 2 || relay.ExpiresAt != nil {
+		t.Fatalf("TestRetryRelay: want a clone of relay %d, got %+v", expiredId, relay)
+	}
+
+	// Resetting keeps the id and runs the relay with the new budget
+	maxTries := 2
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), wakeup)
+	defer stop()
+	retryId, err := client.RetryRelay(failedId, models.RetryRelayRequest{MaxTries: &maxTries})
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	if retryId != failedId {
+		t.Fatalf("TestRetryRelay: reset want id=%d, got=%d", failedId, retryId)
+	}
+	err = AssertRelayStatusWithin(db, failedId, models.RelayFailed, 2*time.Second)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	relay, err = models.SelectRelay(db, failedId)
+	if err != nil {
+		t.Fatalf("TestRetryRelay: %+v", err)
+	}
+	if relay.Tries != maxTries || relay.MaxTries == nil || *relay.MaxTries != maxTries {
+		t.Fatalf("TestRetryRelay: want %d tries, got %+v", maxTries, relay)
+	}
+}
+
+func TestRetryRelays(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("manual_retry_bulk.db3")
+	if err != nil {
+		t.Fatalf("TestRetryRelays: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	start := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	var inRange []int
+	for i, test := range []struct {
+		deviceId string
+		hours    int
+		status   models.RelayStatus
+		retried  bool
+	}{
+		{"dev0", 1, models.RelayFailed, true},
+		{"dev0", 2, models.RelayFailed, true},
+		{"dev0", 2, models.RelayComplete, false},
+		{"dev0", 2, models.RelayExpired, false},
+		{"dev0", 30, models.RelayFailed, false},
+		{"dev1", 1, models.RelayFailed, false},
+	} {
+		relayId, err := AssertCreateAndUpdateRelay(db, test.deviceId, fmt.Sprintf("func%d", i), "", nil,
+			start.Add(time.Duration(test.hours)*time.Hour), test.status, 1)
+		if err != nil {
+			t.Fatalf("TestRetryRelays: %+v", err)
+		}
+		if test.retried {
+			inRange = append(inRange, relayId)
+		}
+	}
+
+	deviceId := "dev0"
+	end := start.Add(24 * time.Hour)
+	req := models.RetryRelaysRequest{RelayFilter: models.RelayFilter{DeviceId: &deviceId, ScheduledAfter: &start, ScheduledBefore: &end}}
+	relayIds, err := client.RetryRelays(req)
+	if err != nil {
+		t.Fatalf("TestRetryRelays: %+v", err)
+	}
+	if !SliceCompare(relayIds, inRange) {
+		t.Fatalf("TestRetryRelays: retried want=%v, got=%v", inRange, relayIds)
+	}
+	for _, relayId := range relayIds {
+		err = AssertRelayStatusWithin(db, relayId, models.RelayReady, 0)
+		if err != nil {
+			t.Fatalf("TestRetryRelays: %+v", err)
+		}
+	}
+
+	// Nothing left to retry
+	relayIds, err = client.RetryRelays(req)
+	if err != nil {
+		t.Fatalf("TestRetryRelays: %+v", err)
+	}
+	if len(relayIds) != 0 {
+		t.Fatalf("TestRetryRelays: want no relays retried, got=%v", relayIds)
+	}
+
+	req.Statuses = []models.RelayStatus{models.RelayComplete}
+	_, err = client.RetryRelays(req)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusUnprocessableEntity)) {
+		t.Fatalf("TestRetryRelays: want %d for complete relays, got %+v", http.StatusUnprocessableEntity, err)
+	}
+
+	// Neither an empty filter nor one matching too many relays retries anything
+	bulk := make([]models.CreateRelayRequest, 1001)
+	for i := range bulk {
+		bulk[i] = models.CreateRelayRequest{DeviceId: "bulk", CloudFunction: "func0"}
+	}
+	_, err = client.CreateRelays(models.CreateRelaysRequest{Relays: bulk})
+	if err != nil {
+		t.Fatalf("TestRetryRelays: %+v", err)
+	}
+	_, err = db.Exec("UPDATE relays SET status = ? WHERE status = ?", models.RelayFailed, models.RelayReady)
+	if err != nil {
+		t.Fatalf("TestRetryRelays: %+v", err)
+	}
+	bulkId := "bulk"
+	for _, req := range []models.RetryRelaysRequest{{}, {RelayFilter: models.RelayFilter{DeviceId: &bulkId}}} {
+		_, err = client.RetryRelays(req)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusUnprocessableEntity)) {
+			t.Fatalf("TestRetryRelays: want %d for filter %+v, got %+v", http.StatusUnprocessableEntity, req.RelayFilter, err)
+		}
+	}
+	var ready int
+	err = db.QueryRow("SELECT COUNT(*) FROM relays WHERE status = ?", models.RelayReady).Scan(&ready)
+	if err != nil {
+		t.Fatalf("TestRetryRelays: %+v", err)
+	}
+	if ready != 0 {
+		t.Fatalf("TestRetryRelays: want no relays retried, got %d", ready)
+	}
+}
@@ -0,0 +1,184 @@
+package test
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestRecoverExpiredLeases(t *testing.T) {
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	myConfig := config.GetDefaultConfig()
+	policies := map[string]models.RelayStatus{
+		"retry":  models.RelayReady,
+		"fail":   models.RelayFailed,
+		"review": models.RelayNeedsReview,
+	}
+	for policy, status := range policies {
+		myConfig.Settings.ExpiredLeasePolicy = policy
+
+		expiredId, err := AssertCreateRelay(db, "dev0", "func0", "", nil, now)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+		}
+		leased, err := models.ClaimRelay(db, expiredId, "crashed", now.Add(-time.Second))
+		if err != nil || !leased {
+			t.Fatalf("TestRecoverExpiredLeases: lease relay %d, leased=%t, err=%+v", expiredId, leased, err)
+		}
+
+		// A lease which is still valid belongs to a live process
+		liveId, err := AssertCreateRelay(db, "dev1", "func0", "", nil, now)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+		}
+		leased, err = models.ClaimRelay(db, liveId, "alive", now.Add(time.Minute))
+		if err != nil || !leased {
+			t.Fatalf("TestRecoverExpiredLeases: lease relay %d, leased=%t, err=%+v", liveId, leased, err)
+		}
+
+		n, err := server.RecoverExpiredLeases(&myConfig, db, now)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+		}
+		if n != 1 {
+			t.Fatalf("TestRecoverExpiredLeases: policy %s recovered want=1, got=%d", policy, n)
+		}
+
+		relay, err := models.SelectRelay(db, expiredId)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+		}
+		err = AssertRelay(relay, "dev0", "func0", "", nil, status, &now, 0)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: policy %s, %+v", policy, err)
+		}
+		if relay.LeaseOwner != nil || relay.LeaseExpires != nil {
+			t.Fatalf("TestRecoverExpiredLeases: policy %s, lease was not cleared on relay %d", policy, expiredId)
+		}
+
+		relay, err = models.SelectRelay(db, liveId)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+		}
+		err = AssertRelay(relay, "dev1", "func0", "", nil, models.RelayRunning, &now, 0)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: policy %s, %+v", policy, err)
+		}
+
+		// The live process can still finish its relay, the crashed one can't
+		err = models.ReleaseRelay(db, liveId, "alive", now, models.RelayComplete, 1, 0)
+		if err != nil {
+			t.Fatalf("TestRecoverExpiredLeases: %+v", err)
+		}
+		err = models.ReleaseRelay(db, expiredId, "crashed", now, models.RelayComplete, 1, 0)
+		if err == nil {
+			t.Fatalf("TestRecoverExpiredLeases: policy %s, release of an expired lease should fail", policy)
+		}
+	}
+}
+
+// A relay needing review is resolved by hand, which unblocks its dependents
+func TestResolveReview(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("review.db3")
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	now := time.Now().UTC()
+	createRelay := func(deviceId string, options models.RelayOptions) int {
+		id, err := server.CreateRelay(db, deviceId, "func0", "", nil, now, options)
+		if err != nil {
+			t.Fatalf("TestResolveReview: %+v", err)
+		}
+		return id
+	}
+	review := func(relayId int) {
+		err := models.UpdateRelayStatus(db, relayId, models.RelayNeedsReview)
+		if err != nil {
+			t.Fatalf("TestResolveReview: %+v", err)
+		}
+	}
+
+	// Cancelling lets the dependents be cancelled or run
+	cancelledParent := createRelay("dev0", models.RelayOptions{})
+	cancelledChild := createRelay("dev1", models.RelayOptions{DependsOn: []int{cancelledParent}})
+	runChild := createRelay("dev2", models.RelayOptions{DependsOn: []int{cancelledParent}, OnDependencyFailure: models.DependencyFailureRun})
+	review(cancelledParent)
+	err = AssertGetReadyRelays(db, now, 0, 10, nil)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = client.CancelRelay(cancelledParent)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, cancelledParent, models.RelayCancelled, 0)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	_, err = server.CancelDependents(db)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, cancelledChild, models.RelayCancelled, 0)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{runChild})
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, runChild, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+
+	// Retrying runs the relay again, and its dependent once it completes
+	retriedParent := createRelay("dev0", models.RelayOptions{})
+	retriedChild := createRelay("dev1", models.RelayOptions{DependsOn: []int{retriedParent}})
+	review(retriedParent)
+	retryTime := now
+	relayId, err := client.RetryRelay(retriedParent, models.RetryRelayRequest{ScheduledTime: &retryTime})
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	if relayId != retriedParent {
+		t.Fatalf("TestResolveReview: retried want=%d, got=%d", retriedParent, relayId)
+	}
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{retriedParent})
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, retriedParent, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{retriedChild})
+	if err != nil {
+		t.Fatalf("TestResolveReview: %+v", err)
+	}
+
+	// Only a relay needing review is cancelled right away
+	err = client.CancelRelay(cancelledParent)
+	if err == nil {
+		t.Fatalf("TestResolveReview: cancelled relay %d twice", cancelledParent)
+	}
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestCreateRelays(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("relay_batch.db3")
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	later := time.Now().UTC().Add(time.Hour)
+	argument := "a"
+	drc := 1
+	unknownPolicy := "unknown"
+	relays := []models.CreateRelayRequest{
+		{DeviceId: "dev0", CloudFunction: "func0", Argument: &argument, DesiredReturnCode: &drc, ScheduledTime: &later},
+		{DeviceId: "dev0", CloudFunction: ""},
+		{DeviceId: "dev1", CloudFunction: "func1", RetryPolicy: &unknownPolicy},
+		{DeviceId: "dev1", CloudFunction: "func1"},
+	}
+
+	// By default a single invalid relay rejects the whole batch
+	results, err := client.CreateRelays(models.CreateRelaysRequest{Relays: relays})
+	if err == nil {
+		t.Fatalf("TestCreateRelays: want an error for a rejected batch")
+	}
+	if len(results) != len(relays) {
+		t.Fatalf("TestCreateRelays: want %d results, got %+v", len(relays), results)
+	}
+	for i, result := range results {
+		if result.RelayId != nil {
+			t.Fatalf("TestCreateRelays: result %d of a rejected batch has a relay id", i)
+		}
+		invalid := i == 1 || i == 2
+		if invalid != (result.Error != nil) {
+			t.Fatalf("TestCreateRelays: result %d, want invalid %t, got %+v", i, invalid, result)
+		}
+	}
+	ids, err := models.SelectRelayIdsByFilter(db, models.RelayFilter{Statuses: []models.RelayStatus{models.RelayReady}}, 100)
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("TestCreateRelays: want no relays after a rejected batch, got %v", ids)
+	}
+
+	// Best effort creates the valid relays
+	mode := models.BatchBestEffort
+	results, err = client.CreateRelays(models.CreateRelaysRequest{Relays: relays, Mode: &mode})
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	if results[1].Error == nil || results[2].Error == nil || results[1].RelayId != nil || results[2].RelayId != nil {
+		t.Fatalf("TestCreateRelays: want errors for the invalid relays, got %+v", results)
+	}
+	if results[0].RelayId == nil || results[3].RelayId == nil {
+		t.Fatalf("TestCreateRelays: want ids for the valid relays, got %+v", results)
+	}
+	relay, err := client.GetRelay(*results[0].RelayId)
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	err = AssertRelay(relay, "dev0", "func0", "a", &drc, models.RelayReady, &later, 0)
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	relay, err = client.GetRelay(*results[3].RelayId)
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	err = AssertRelay(relay, "dev1", "func1", "", nil, models.RelayReady, nil, 0)
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+
+	// A valid batch is created as a whole, relays may depend on existing relays
+	relays = []models.CreateRelayRequest{
+		{DeviceId: "dev2", CloudFunction: "func2"},
+		{DeviceId: "dev2", CloudFunction: "func2", DependsOn: []int{*results[0].RelayId}},
+	}
+	results, err = client.CreateRelays(models.CreateRelaysRequest{Relays: relays})
+	if err != nil {
+		t.Fatalf("TestCreateRelays: %+v", err)
+	}
+	if len(results) != 2 || results[0].RelayId == nil || results[1].RelayId == nil || *results[0].RelayId == *results[1].RelayId {
+		t.Fatalf("TestCreateRelays: want two new relays, got %+v", results)
+	}
+
+	// Unknown modes are rejected
+	mode = "some"
+	_, err = client.CreateRelays(models.CreateRelaysRequest{Relays: relays, Mode: &mode})
+	if err == nil {
+		t.Fatalf("TestCreateRelays: want an error for an unknown mode")
+	}
+}
@@ -0,0 +1,115 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestCancelRelays(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("relay_cancel.db3")
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	later := time.Now().UTC().Add(time.Hour)
+	var dev0Ids []int
+	for i := 0; i < 4; i++ {
+		relayId, err := server.CreateRelay(db, "dev0", "func0", "", nil, later, models.RelayOptions{})
+		if err != nil {
+			t.Fatalf("TestCancelRelays: %+v", err)
+		}
+		dev0Ids = append(dev0Ids, relayId)
+	}
+	err = models.UpdateRelayStatus(db, dev0Ids[3], models.RelayFailed)
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	func0Id, err := server.CreateRelay(db, "dev1", "func0", "", nil, later, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	func1Id, err := server.CreateRelay(db, "dev1", "func1", "", nil, later, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+
+	// Only the ready relays of the device are cancelled
+	cancelled, err := client.CancelDeviceRelays("dev0")
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	if cancelled != 3 {
+		t.Fatalf("TestCancelRelays: want 3 cancelled relays, got %d", cancelled)
+	}
+	// Relays which are already awaiting cancellation are not counted again
+	cancelled, err = client.CancelDeviceRelays("dev0")
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	if cancelled != 0 {
+		t.Fatalf("TestCancelRelays: want 0 cancelled relays, got %d", cancelled)
+	}
+
+	cloudFunction := "func1"
+	cancelled, err = client.CancelRelays(models.RelayFilter{CloudFunction: &cloudFunction})
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	if cancelled != 1 {
+		t.Fatalf("TestCancelRelays: want 1 cancelled relay, got %d", cancelled)
+	}
+
+	_, err = client.CancelRelays(models.RelayFilter{Statuses: []models.RelayStatus{models.RelayFailed}})
+	if err == nil {
+		t.Fatalf("TestCancelRelays: want an error for failed relays")
+	}
+	// A filter which only sets statuses is refused rather than cancelling everything, func0Id stays ready below
+	for _, filter := range []models.RelayFilter{{}, {Statuses: []models.RelayStatus{models.RelayReady}}} {
+		_, err = client.CancelRelays(filter)
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", http.StatusUnprocessableEntity)) {
+			t.Fatalf("TestCancelRelays: want %d for filter %+v, got %+v", http.StatusUnprocessableEntity, filter, err)
+		}
+	}
+	_, err = client.CancelDeviceRelays("dev2")
+	if err == nil {
+		t.Fatalf("TestCancelRelays: want an error for an unknown device")
+	}
+
+	err = server.ProcessCancellations(db)
+	if err != nil {
+		t.Fatalf("TestCancelRelays: %+v", err)
+	}
+	want := map[int]models.RelayStatus{
+		dev0Ids[0]: models.RelayCancelled,
+		dev0Ids[1]: models.RelayCancelled,
+		dev0Ids[2]: models.RelayCancelled,
+		dev0Ids[3]: models.RelayFailed,
+		func0Id:    models.RelayReady,
+		func1Id:    models.RelayCancelled,
+	}
+	for relayId, status := range want {
+		relay, err := models.SelectRelay(db, relayId)
+		if err != nil {
+			t.Fatalf("TestCancelRelays: %+v", err)
+		}
+		if relay.Status != status {
+			t.Fatalf("TestCancelRelays: relay %d, want status %d, got %d", relayId, status, relay.Status)
+		}
+	}
+}
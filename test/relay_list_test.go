@@ -0,0 +1,132 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func listRelayIds(client client.Client, req models.ListRelaysRequest) ([]int, error) {
+	relays := client.ListRelays(req)
+	var relayIds []int
+	for relays.Next() {
+		relayIds = append(relayIds, relays.Relay().Id)
+	}
+	if err := relays.Err(); err != nil {
+		return nil, fmt.Errorf("listRelayIds: %w", err)
+	}
+	return relayIds, nil
+}
+
+func TestListRelays(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("relay_list.db3")
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	// Relays of dev0 are scheduled in the reverse order of their creation
+	now := time.Now().UTC()
+	var dev0Ids, allIds []int
+	for i := 0; i < 7; i++ {
+		relayId, err := server.CreateRelay(db, "dev0", "func0", "", nil, now.Add(time.Duration(10-i)*time.Minute), models.RelayOptions{})
+		if err != nil {
+			t.Fatalf("TestListRelays: %+v", err)
+		}
+		dev0Ids = append(dev0Ids, relayId)
+		allIds = append(allIds, relayId)
+	}
+	createdAfter := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		relayId, err := server.CreateRelay(db, "dev1", fmt.Sprintf("func%d", i), "", nil, now, models.RelayOptions{})
+		if err != nil {
+			t.Fatalf("TestListRelays: %+v", err)
+		}
+		allIds = append(allIds, relayId)
+	}
+	err = models.UpdateRelayStatus(db, dev0Ids[1], models.RelayFailed)
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+
+	// Pages of 3 relays
+	relayIds, err := listRelayIds(client, models.ListRelaysRequest{Limit: 3})
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+	if !slices.Equal(relayIds, allIds) {
+		t.Fatalf("TestListRelays: want %v, got %v", allIds, relayIds)
+	}
+
+	deviceId := "dev0"
+	relayIds, err = listRelayIds(client, models.ListRelaysRequest{
+		RelayFilter: models.RelayFilter{DeviceId: &deviceId, Statuses: []models.RelayStatus{models.RelayReady}},
+		Sort:        models.RelaySortScheduledTime,
+		Limit:       2,
+	})
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+	want := []int{dev0Ids[6], dev0Ids[5], dev0Ids[4], dev0Ids[3], dev0Ids[2], dev0Ids[0]}
+	if !slices.Equal(relayIds, want) {
+		t.Fatalf("TestListRelays: by scheduled time, want %v, got %v", want, relayIds)
+	}
+
+	relayIds, err = listRelayIds(client, models.ListRelaysRequest{Desc: true, Limit: 4})
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+	want = slices.Clone(allIds)
+	slices.Reverse(want)
+	if !slices.Equal(relayIds, want) {
+		t.Fatalf("TestListRelays: descending, want %v, got %v", want, relayIds)
+	}
+
+	relayIds, err = listRelayIds(client, models.ListRelaysRequest{RelayFilter: models.RelayFilter{CreatedAfter: &createdAfter}})
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+	if !slices.Equal(relayIds, allIds[7:]) {
+		t.Fatalf("TestListRelays: created after, want %v, got %v", allIds[7:], relayIds)
+	}
+
+	cloudFunction := "func1"
+	relayIds, err = listRelayIds(client, models.ListRelaysRequest{RelayFilter: models.RelayFilter{CloudFunction: &cloudFunction}})
+	if err != nil {
+		t.Fatalf("TestListRelays: %+v", err)
+	}
+	if !slices.Equal(relayIds, allIds[8:9]) {
+		t.Fatalf("TestListRelays: by cloud function, want %v, got %v", allIds[8:9], relayIds)
+	}
+
+	// Relays are listed with their details
+	relays := client.ListRelays(models.ListRelaysRequest{RelayFilter: models.RelayFilter{Statuses: []models.RelayStatus{models.RelayFailed}}})
+	if !relays.Next() {
+		t.Fatalf("TestListRelays: want a failed relay, got %+v", relays.Err())
+	}
+	relay := relays.Relay()
+	if relay.Id != dev0Ids[1] || relay.Device.DeviceId != "dev0" || relay.Status != models.RelayFailed || relay.CreatedAt == nil {
+		t.Fatalf("TestListRelays: unexpected relay %+v", relay)
+	}
+	if relays.Next() {
+		t.Fatalf("TestListRelays: want a single failed relay")
+	}
+
+	relays = client.ListRelays(models.ListRelaysRequest{Sort: "unknown"})
+	if relays.Next() || relays.Err() == nil {
+		t.Fatalf("TestListRelays: want an error for an unknown sort")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/RadekPudelko/relay/internal/server"
 	"github.com/RadekPudelko/relay/pkg/models"
 )
 
@@ -199,3 +200,52 @@ func TestGetReadyRelays(t *testing.T) {
 	}
 	t.Log(t0, t1, t2, t3, t4, t5, t6, t7, t8)
 }
+
+func TestGetReadyRelaysPriority(t *testing.T) {
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	createRelay := func(deviceId string, priority int) int {
+		id, err := server.CreateRelay(db, deviceId, "func0", "", nil, now, models.RelayOptions{Priority: priority})
+		if err != nil {
+			t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+		}
+		return id
+	}
+
+	// dev0 has a backlog of routine relays ahead of an urgent one
+	dev0Routine := createRelay("dev0", 0)
+	createRelay("dev0", 0)
+	dev0Urgent := createRelay("dev0", 10)
+	dev1Routine := createRelay("dev1", 0)
+	dev2High := createRelay("dev2", 5)
+	dev2Low := createRelay("dev2", -1)
+
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{dev0Urgent, dev2High, dev1Routine})
+	if err != nil {
+		t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+	}
+	// Devices with the most urgent relays make the cut
+	err = AssertGetReadyRelays(db, now, 0, 2, []int{dev0Urgent, dev2High})
+	if err != nil {
+		t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+	}
+
+	// Ties go to the oldest relay
+	err = models.UpdateRelayStatus(db, dev0Urgent, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, dev2High, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+	}
+	err = AssertGetReadyRelays(db, now, 0, 10, []int{dev0Routine, dev1Routine, dev2Low})
+	if err != nil {
+		t.Fatalf("TestGetReadyRelaysPriority: %+v", err)
+	}
+}
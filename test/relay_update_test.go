@@ -0,0 +1,119 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func assertStatusCode(err error, statusCode int) error {
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("status code=%d", statusCode)) {
+		return fmt.Errorf("want status code %d, got %+v", statusCode, err)
+	}
+	return nil
+}
+
+func TestUpdateRelay(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("relay_update.db3")
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	now := time.Now().UTC()
+	later := now.Add(time.Hour)
+	expiresAt := now.Add(2 * time.Hour)
+	drc := 1
+	relayId, err := server.CreateRelay(db, "dev0", "func0", "a", &drc, later, models.RelayOptions{ExpiresAt: &expiresAt})
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	relay, err := client.GetRelay(relayId)
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	version := relay.Version
+
+	argument := "b"
+	sooner := now.Add(30 * time.Minute)
+	priority := 5
+	relay, err = client.UpdateRelay(relayId, models.UpdateRelayRequest{Version: &version, Argument: &argument,
+		ScheduledTime: &sooner, Priority: &priority, ClearDesiredReturnCode: true})
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	err = AssertRelay(relay, "dev0", "func0", "b", nil, models.RelayReady, &sooner, 0)
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	if relay.DesiredReturnCode != nil || relay.Priority != 5 || relay.ExpiresAt == nil || !relay.ExpiresAt.Equal(expiresAt) ||
+		relay.Version != version+1 {
+		t.Fatalf("TestUpdateRelay: unexpected relay after update %+v", relay)
+	}
+
+	// A stale version is a conflict
+	_, err = client.UpdateRelay(relayId, models.UpdateRelayRequest{Version: &version, Argument: &argument})
+	if err := assertStatusCode(err, http.StatusConflict); err != nil {
+		t.Fatalf("TestUpdateRelay: stale version, %+v", err)
+	}
+
+	// The relay must still expire after it is scheduled
+	_, err = client.UpdateRelay(relayId, models.UpdateRelayRequest{ScheduledTime: &expiresAt})
+	if err := assertStatusCode(err, http.StatusUnprocessableEntity); err != nil {
+		t.Fatalf("TestUpdateRelay: scheduled after expiry, %+v", err)
+	}
+	relay, err = client.UpdateRelay(relayId, models.UpdateRelayRequest{ScheduledTime: &expiresAt, ClearExpiresAt: true})
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	if relay.ExpiresAt != nil || !relay.ScheduledTime.Equal(expiresAt) {
+		t.Fatalf("TestUpdateRelay: want expiry cleared, got %+v", relay)
+	}
+
+	unknown := "unknown"
+	_, err = client.UpdateRelay(relayId, models.UpdateRelayRequest{RetryPolicy: &unknown})
+	if err := assertStatusCode(err, http.StatusUnprocessableEntity); err != nil {
+		t.Fatalf("TestUpdateRelay: unknown retry policy, %+v", err)
+	}
+	_, err = client.UpdateRelay(1000, models.UpdateRelayRequest{Argument: &argument})
+	if err := assertStatusCode(err, http.StatusUnprocessableEntity); err != nil {
+		t.Fatalf("TestUpdateRelay: missing relay, %+v", err)
+	}
+
+	// Once the scheduler claims the relay it can not be changed
+	claimed, err := models.ClaimRelay(db, relayId, "test", now.Add(time.Minute))
+	if err != nil || !claimed {
+		t.Fatalf("TestUpdateRelay: claimed=%t, %+v", claimed, err)
+	}
+	_, err = client.UpdateRelay(relayId, models.UpdateRelayRequest{Argument: &argument})
+	if err := assertStatusCode(err, http.StatusConflict); err != nil {
+		t.Fatalf("TestUpdateRelay: running relay, %+v", err)
+	}
+
+	// Claiming changed the version, so an update based on the relay before the claim does not apply after it
+	err = models.ReleaseRelay(db, relayId, "test", later, models.RelayReady, 1, 0)
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	updated, err := models.UpdateReadyRelay(db, relayId, relay.Version, models.RelayUpdate{Argument: &argument})
+	if err != nil {
+		t.Fatalf("TestUpdateRelay: %+v", err)
+	}
+	if updated {
+		t.Fatalf("TestUpdateRelay: update applied to a relay which ran since it was read")
+	}
+}
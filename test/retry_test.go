@@ -0,0 +1,83 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/particle"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestRetryPolicies(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.RetryPolicies = map[string]config.RetryPolicyConfig{
+		"quick": {
+			Ping:          config.BackoffConfig{MaxAttempts: 2},
+			CloudFunction: config.BackoffConfig{MaxAttempts: 4},
+		},
+	}
+
+	db, err := SetupFileDB("retry.db3")
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().UTC()
+	options := models.RelayOptions{RetryPolicy: "quick"}
+	offlineId, err := server.CreateRelay(db, "dev"+particle.DevicePingOffline, "func0", "", nil, now, options)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	errorId, err := server.CreateRelay(db, "dev0", "func0", particle.DeviceCFError, nil, now, options)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	// Uses the default policy, which retries after cf_retry_seconds
+	defaultId, err := server.CreateRelay(db, "dev1", "func0", particle.DeviceCFError, nil, now, models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+
+	stop := StartBackgroundTask(&myConfig, db, particle.NewMock(), server.NewWakeup())
+	defer stop()
+
+	err = AssertRelayStatusWithin(db, offlineId, models.RelayFailed, time.Second)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	relay, err := models.SelectRelay(db, offlineId)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	if relay.Pings != 2 || relay.Tries != 0 {
+		t.Fatalf("TestRetryPolicies: offline relay pings want=2, got=%d, tries want=0, got=%d", relay.Pings, relay.Tries)
+	}
+
+	err = AssertRelayStatusWithin(db, errorId, models.RelayFailed, time.Second)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	relay, err = models.SelectRelay(db, errorId)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	if relay.Tries != 4 {
+		t.Fatalf("TestRetryPolicies: tries want=4, got=%d", relay.Tries)
+	}
+
+	relay, err = models.SelectRelay(db, defaultId)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	err = AssertRelay(relay, "dev1", "func0", particle.DeviceCFError, nil, models.RelayReady, nil, 1)
+	if err != nil {
+		t.Fatalf("TestRetryPolicies: %+v", err)
+	}
+	retryTime := now.Add(time.Duration(myConfig.Settings.CFRetrySeconds) * time.Second)
+	if relay.ScheduledTime.Before(retryTime) {
+		t.Fatalf("TestRetryPolicies: default policy retry scheduled at %s, before %s", relay.ScheduledTime, retryTime)
+	}
+}
@@ -0,0 +1,217 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+func TestMaterializeSchedules(t *testing.T) {
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	defer db.Close()
+
+	deviceKey, err := models.InsertOrUpdateDevice(db, "dev0")
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Minute)
+	runTime := now.Add(-time.Minute)
+	ttl := 600
+	skipId, err := models.InsertSchedule(db, deviceKey, models.Schedule{CloudFunction: "func0", Cron: "* * * * *", Timezone: "UTC",
+		OverlapPolicy: models.OverlapSkip, TtlSeconds: &ttl, NextRunTime: &runTime})
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	allowId, err := models.InsertSchedule(db, deviceKey, models.Schedule{CloudFunction: "func1", Cron: "* * * * *", Timezone: "UTC",
+		OverlapPolicy: models.OverlapAllow, NextRunTime: &runTime})
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	pausedTime := runTime
+	_, err = models.InsertSchedule(db, deviceKey, models.Schedule{CloudFunction: "func2", Cron: "* * * * *", Timezone: "UTC",
+		OverlapPolicy: models.OverlapAllow, Paused: true, NextRunTime: &pausedTime})
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+
+	n, err := server.MaterializeSchedules(db, now)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	if n != 2 {
+		t.Fatalf("TestMaterializeSchedules: created want=2, got=%d", n)
+	}
+	skip, err := models.SelectSchedule(db, skipId)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	next := now.Add(time.Minute)
+	if skip.NextRunTime == nil || !skip.NextRunTime.Equal(next) {
+		t.Fatalf("TestMaterializeSchedules: next run want=%s, got=%v", next, skip.NextRunTime)
+	}
+	relay, err := models.SelectRelay(db, *skip.LastRelayId)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	err = AssertRelay(relay, "dev0", "func0", "", nil, models.RelayReady, &runTime, 0)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	expiresAt := runTime.Add(time.Duration(ttl) * time.Second)
+	if relay.ScheduleId == nil || *relay.ScheduleId != skipId || relay.ExpiresAt == nil || !relay.ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("TestMaterializeSchedules: relay want schedule=%d expiring at %s, got %+v", skipId, expiresAt, relay)
+	}
+
+	// Nothing is due until the next occurrence
+	n, err = server.MaterializeSchedules(db, now)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	if n != 0 {
+		t.Fatalf("TestMaterializeSchedules: created want=0, got=%d", n)
+	}
+
+	// The skip schedule's relay is still ready, so only the allow schedule creates one
+	n, err = server.MaterializeSchedules(db, next)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	if n != 1 {
+		t.Fatalf("TestMaterializeSchedules: created want=1, got=%d", n)
+	}
+	skip, err = models.SelectSchedule(db, skipId)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	if *skip.LastRelayId != relay.Id || !skip.NextRunTime.Equal(next.Add(time.Minute)) {
+		t.Fatalf("TestMaterializeSchedules: want skipped occurrence, got %+v", skip)
+	}
+	allow, err := models.SelectSchedule(db, allowId)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	err = AssertRelayStatusWithin(db, *allow.LastRelayId, models.RelayReady, 0)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+
+	// Once the previous relay is done, the skip schedule creates the next one
+	err = models.UpdateRelay(db, relay.Id, runTime, models.RelayComplete, 1)
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	n, err = server.MaterializeSchedules(db, next.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("TestMaterializeSchedules: %+v", err)
+	}
+	if n != 2 {
+		t.Fatalf("TestMaterializeSchedules: created want=2, got=%d", n)
+	}
+}
+
+func TestScheduleHandlers(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupMemoryDB()
+	if err != nil {
+		t.Fatalf("TestScheduleHandlers: %+v", err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+
+	badTimezone := "Mars/Olympus_Mons"
+	badOverlap := "queue"
+	timezone := "America/New_York"
+	requests := []struct {
+		req    models.CreateScheduleRequest
+		status int
+	}{
+		{models.CreateScheduleRequest{DeviceId: "dev0", CloudFunction: "func0"}, http.StatusUnprocessableEntity},
+		{models.CreateScheduleRequest{DeviceId: "dev0", CloudFunction: "func0", Cron: "0 25 * * *"}, http.StatusUnprocessableEntity},
+		{models.CreateScheduleRequest{DeviceId: "dev0", CloudFunction: "func0", Cron: "0 0 30 2 *"}, http.StatusUnprocessableEntity},
+		{models.CreateScheduleRequest{DeviceId: "dev0", CloudFunction: "func0", Cron: "0 3 * * *", Timezone: &badTimezone}, http.StatusUnprocessableEntity},
+		{models.CreateScheduleRequest{DeviceId: "dev0", CloudFunction: "func0", Cron: "0 3 * * *", OverlapPolicy: &badOverlap}, http.StatusUnprocessableEntity},
+		{models.CreateScheduleRequest{DeviceId: "dev0", CloudFunction: "func0", Cron: "0 3 * * *", Timezone: &timezone}, http.StatusOK},
+	}
+	scheduleId := 0
+	for i, request := range requests {
+		jsonData, err := json.Marshal(request.req)
+		if err != nil {
+			t.Fatalf("TestScheduleHandlers: %+v", err)
+		}
+		resp, err := http.Post(srv.URL+"/api/schedules", "application/json", bytes.NewBuffer(jsonData))
+		if err != nil {
+			t.Fatalf("TestScheduleHandlers: %+v", err)
+		}
+		body := new(bytes.Buffer)
+		body.ReadFrom(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != request.status {
+			t.Fatalf("TestScheduleHandlers: request %d status want=%d, got=%d, body=%s", i, request.status, resp.StatusCode, body)
+		}
+		if resp.StatusCode == http.StatusOK {
+			scheduleId, err = strconv.Atoi(body.String())
+			if err != nil {
+				t.Fatalf("TestScheduleHandlers: %+v", err)
+			}
+		}
+	}
+
+	var schedules []models.Schedule
+	err = getJson(srv.URL+"/api/schedules", &schedules)
+	if err != nil {
+		t.Fatalf("TestScheduleHandlers: %+v", err)
+	}
+	if len(schedules) != 1 || schedules[0].Id != scheduleId || schedules[0].OverlapPolicy != models.OverlapSkip || schedules[0].NextRunTime == nil {
+		t.Fatalf("TestScheduleHandlers: want schedule %d, got %+v", scheduleId, schedules)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		t.Fatalf("TestScheduleHandlers: %+v", err)
+	}
+	if nextRun := schedules[0].NextRunTime.In(loc); nextRun.Hour() != 3 || nextRun.Minute() != 0 {
+		t.Fatalf("TestScheduleHandlers: want next run at 3:00 in %s, got %s", timezone, nextRun)
+	}
+
+	var schedule models.Schedule
+	err = postJson(srv.URL+"/api/schedules/"+strconv.Itoa(scheduleId)+"/pause", &schedule)
+	if err != nil {
+		t.Fatalf("TestScheduleHandlers: %+v", err)
+	}
+	if !schedule.Paused || schedule.NextRunTime != nil {
+		t.Fatalf("TestScheduleHandlers: want paused schedule, got %+v", schedule)
+	}
+	err = postJson(srv.URL+"/api/schedules/"+strconv.Itoa(scheduleId)+"/resume", &schedule)
+	if err != nil {
+		t.Fatalf("TestScheduleHandlers: %+v", err)
+	}
+	if schedule.Paused || schedule.NextRunTime == nil {
+		t.Fatalf("TestScheduleHandlers: want resumed schedule, got %+v", schedule)
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusUnprocessableEntity} {
+		req, err := http.NewRequest("DELETE", srv.URL+"/api/schedules/"+strconv.Itoa(scheduleId), nil)
+		if err != nil {
+			t.Fatalf("TestScheduleHandlers: %+v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("TestScheduleHandlers: %+v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("TestScheduleHandlers: delete status want=%d, got=%d", status, resp.StatusCode)
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package test
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/RadekPudelko/relay/internal/config"
 	"github.com/RadekPudelko/relay/internal/database"
+	"github.com/RadekPudelko/relay/internal/particle"
 	"github.com/RadekPudelko/relay/pkg/models"
 	"github.com/RadekPudelko/relay/internal/server"
 )
@@ -44,7 +51,7 @@ func AssertCreateRelay(db *sql.DB,
 	desiredReturnCode *int,
 	scheduledTime time.Time,
 ) (int, error) {
-	id, err := server.CreateRelay(db, deviceId, cloudFunction, argument, desiredReturnCode, scheduledTime)
+	id, err := server.CreateRelay(db, deviceId, cloudFunction, argument, desiredReturnCode, scheduledTime, models.RelayOptions{})
 	if err != nil {
 		return 0, fmt.Errorf("AssertCreateRelay: %w", err)
 	}
@@ -146,3 +153,107 @@ func SliceCompare(a, b []int) bool {
 	}
 	return true
 }
+
+// Polls the relay until it reaches the desired status or the timeout expires
+func AssertRelayStatusWithin(db *sql.DB, relayId int, status models.RelayStatus, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		relay, err := models.SelectRelay(db, relayId)
+		if err != nil {
+			return fmt.Errorf("AssertRelayStatusWithin: %w", err)
+		}
+		if relay.Status == status {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("AssertRelayStatusWithin: relay %d status want=%d, got=%d after %s", relayId, status, relay.Status, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Runs the background task until the returned function is called, which waits for the task to stop
+// so that the database can be closed under it
+func StartBackgroundTask(config *config.Config, db *sql.DB, particle particle.ParticleAPI, wakeup *server.Wakeup) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.BackgroundTask(ctx, config, db, particle, wakeup)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// Gets the url and decodes its json response into out
+func getJson(url string, out any) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Posts to the url without a body and decodes its json response into out
+func postJson(url string, out any) error {
+	resp, err := http.Post(url, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Posts the relay and returns the response status code
+func postRelay(url string, req models.CreateRelayRequest) (int, error) {
+	jsonData, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.Post(url+"/api/relays", "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// Wraps the mock to record how many times each relay's cloud function was called, identified by its argument,
+// and whether a device was called by two instances at once
+type recordingParticle struct {
+	particle.MockParticle
+	mu         sync.Mutex
+	calls      map[string]int
+	inFlight   map[string]bool
+	violations []string
+}
+
+func newRecordingParticle(latency time.Duration) *recordingParticle {
+	mock := particle.NewMock()
+	mock.Latency = latency
+	return &recordingParticle{
+		MockParticle: mock,
+		calls:        make(map[string]int),
+		inFlight:     make(map[string]bool),
+	}
+}
+
+func (p *recordingParticle) CloudFunction(ctx context.Context, deviceId string, cloudFunction string, argument string) (int, error) {
+	p.mu.Lock()
+	p.calls[argument]++
+	if p.inFlight[deviceId] {
+		p.violations = append(p.violations, fmt.Sprintf("device %s called concurrently", deviceId))
+	}
+	p.inFlight[deviceId] = true
+	p.mu.Unlock()
+
+	returnValue, err := p.MockParticle.CloudFunction(ctx, deviceId, cloudFunction, argument)
+
+	p.mu.Lock()
+	p.inFlight[deviceId] = false
+	p.mu.Unlock()
+	return returnValue, err
+}
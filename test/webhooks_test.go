@@ -0,0 +1,268 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RadekPudelko/relay/internal/config"
+	"github.com/RadekPudelko/relay/internal/server"
+	"github.com/RadekPudelko/relay/pkg/client"
+	"github.com/RadekPudelko/relay/pkg/models"
+)
+
+// A delivery as seen by the receiver
+type receivedDelivery struct {
+	path      string
+	event     string
+	signature string
+	body      []byte
+}
+
+// Records the deliveries it receives, answering with the next of the status codes and 200 once they run out
+type webhookReceiver struct {
+	mu          sync.Mutex
+	statusCodes []int
+	deliveries  []receivedDelivery
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.deliveries = append(wr.deliveries, receivedDelivery{
+		path:      r.URL.Path,
+		event:     r.Header.Get("X-Relay-Event"),
+		signature: r.Header.Get("X-Relay-Signature"),
+		body:      body,
+	})
+	statusCode := http.StatusOK
+	if len(wr.statusCodes) > 0 {
+		statusCode, wr.statusCodes = wr.statusCodes[0], wr.statusCodes[1:]
+	}
+	w.WriteHeader(statusCode)
+}
+
+// Returns the deliveries received since the last call
+func (wr *webhookReceiver) take() []receivedDelivery {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	deliveries := wr.deliveries
+	wr.deliveries = nil
+	return deliveries
+}
+
+func TestWebhooks(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	myConfig.Webhooks.Secret = "callback-secret"
+	myConfig.Webhooks.Retry = config.BackoffConfig{MaxAttempts: 2}
+	db, err := SetupFileDB("webhooks.db3")
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	defer db.Close()
+
+	srv := httptest.NewServer(server.NewServer(&myConfig, db, server.NewWakeup()))
+	defer srv.Close()
+	client := client.NewClient(srv.Listener.Addr().(*net.TCPAddr).Port)
+
+	receiver := &webhookReceiver{}
+	receiverSrv := httptest.NewServer(receiver)
+	defer receiverSrv.Close()
+
+	later := time.Now().UTC().Add(time.Hour)
+	create := func(callbackUrl *string) int {
+		relayId, err := client.CreateRelayFromRequest(models.CreateRelayRequest{DeviceId: "dev0", CloudFunction: "func0",
+			ScheduledTime: &later, CallbackUrl: callbackUrl})
+		if err != nil {
+			t.Fatalf("TestWebhooks: %+v", err)
+		}
+		return relayId
+	}
+	dispatch := func(want int) {
+		n, err := server.DispatchWebhooks(context.Background(), &myConfig, db, time.Now().UTC())
+		if err != nil {
+			t.Fatalf("TestWebhooks: %+v", err)
+		}
+		if n != want {
+			t.Fatalf("TestWebhooks: delivered want=%d, got=%d", want, n)
+		}
+	}
+	// Checks the delivery's signature and returns its payload
+	verify := func(delivery receivedDelivery, secret string) models.WebhookPayload {
+		timestamp, _, _ := strings.Cut(strings.TrimPrefix(delivery.signature, "t="), ",")
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			t.Fatalf("TestWebhooks: invalid signature %s", delivery.signature)
+		}
+		if want := server.SignWebhook(secret, time.Unix(unix, 0), delivery.body); delivery.signature != want {
+			t.Fatalf("TestWebhooks: signature want=%s, got=%s", want, delivery.signature)
+		}
+		var payload models.WebhookPayload
+		err = json.Unmarshal(delivery.body, &payload)
+		if err != nil {
+			t.Fatalf("TestWebhooks: %+v", err)
+		}
+		if payload.Event != delivery.event {
+			t.Fatalf("TestWebhooks: event header=%s, payload=%s", delivery.event, payload.Event)
+		}
+		return payload
+	}
+
+	invalid := "ftp://example.com"
+	_, err = client.CreateWebhook(models.CreateWebhookRequest{Url: invalid})
+	if err == nil {
+		t.Fatalf("TestWebhooks: created a webhook for %s", invalid)
+	}
+	_, err = client.CreateWebhook(models.CreateWebhookRequest{Url: receiverSrv.URL, Events: []string{"started"}})
+	if err == nil {
+		t.Fatalf("TestWebhooks: created a webhook for an unknown event")
+	}
+
+	global, err := client.CreateWebhook(models.CreateWebhookRequest{Url: receiverSrv.URL + "/global", Events: []string{"complete", "cancelled"}})
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	if global.Secret == "" {
+		t.Fatalf("TestWebhooks: webhook was not given a secret")
+	}
+
+	// A relay with a callback url and its own subscription
+	callbackUrl := receiverSrv.URL + "/callback"
+	relayId := create(&callbackUrl)
+	secret := "relay-secret"
+	perRelay, err := client.CreateWebhook(models.CreateWebhookRequest{Url: receiverSrv.URL + "/relay", Secret: &secret, RelayId: &relayId})
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	other := create(nil)
+
+	err = models.UpdateRelayStatus(db, relayId, models.RelayFailed)
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, other, models.RelayComplete)
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	dispatch(3)
+
+	secrets := map[string]string{"/global": global.Secret, "/relay": secret, "/callback": myConfig.Webhooks.Secret}
+	got := map[string]models.WebhookPayload{}
+	for _, delivery := range receiver.take() {
+		got[delivery.path] = verify(delivery, secrets[delivery.path])
+	}
+	if len(got) != 3 {
+		t.Fatalf("TestWebhooks: want deliveries to %v, got %v", secrets, got)
+	}
+	// The global webhook is not subscribed to failures
+	if p := got["/global"]; p.Event != "complete" || p.Relay.Id != other {
+		t.Fatalf("TestWebhooks: global delivery, want relay %d complete, got %+v", other, p)
+	}
+	for _, path := range []string{"/relay", "/callback"} {
+		if p := got[path]; p.Event != "failed" || p.Relay.Id != relayId || p.Relay.Status != models.RelayFailed {
+			t.Fatalf("TestWebhooks: %s delivery, want relay %d failed, got %+v", path, relayId, p)
+		}
+	}
+	// Nothing is delivered twice
+	dispatch(0)
+
+	// A failed delivery is retried until it runs out of attempts
+	receiver.statusCodes = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+	err = models.UpdateRelayStatus(db, create(nil), models.RelayCancelled)
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	dispatch(0)
+	dispatch(0)
+	if n := len(receiver.take()); n != 2 {
+		t.Fatalf("TestWebhooks: attempts want=2, got=%d", n)
+	}
+	dispatch(0)
+	deliveries, err := client.GetWebhookDeliveries(global.Id)
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	if len(deliveries) != 2 || deliveries[0].Status != models.DeliveryFailed || deliveries[0].Attempts != 2 ||
+		deliveries[0].LastStatusCode == nil || *deliveries[0].LastStatusCode != http.StatusInternalServerError {
+		t.Fatalf("TestWebhooks: want a failed delivery after 2 attempts, got %+v", deliveries)
+	}
+	if deliveries[1].Status != models.DeliveryDelivered || deliveries[1].DeliveredAt == nil {
+		t.Fatalf("TestWebhooks: want a delivered delivery, got %+v", deliveries[1])
+	}
+
+	err = client.DeleteWebhook(perRelay.Id)
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	webhooks, err := client.GetWebhooks()
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	if len(webhooks) != 1 || webhooks[0].Id != global.Id {
+		t.Fatalf("TestWebhooks: want only webhook %d, got %+v", global.Id, webhooks)
+	}
+	// The secret is only returned when the webhook is created
+	var listed []map[string]any
+	err = getJson(srv.URL+"/api/webhooks", &listed)
+	if err != nil {
+		t.Fatalf("TestWebhooks: %+v", err)
+	}
+	if _, ok := listed[0]["secret"]; ok {
+		t.Fatalf("TestWebhooks: listed webhook has its secret, got %+v", listed[0])
+	}
+}
+
+// Events recorded before a restart are still delivered
+func TestWebhooksOutbox(t *testing.T) {
+	myConfig := config.GetDefaultConfig()
+	db, err := SetupFileDB("webhooks_outbox.db3")
+	if err != nil {
+		t.Fatalf("TestWebhooksOutbox: %+v", err)
+	}
+	defer db.Close()
+
+	receiver := &webhookReceiver{}
+	receiverSrv := httptest.NewServer(receiver)
+	defer receiverSrv.Close()
+
+	_, err = models.InsertWebhook(db, models.Webhook{Url: receiverSrv.URL, Secret: "secret", CreatedAt: time.Now().UTC()})
+	if err != nil {
+		t.Fatalf("TestWebhooksOutbox: %+v", err)
+	}
+	relayId, err := server.CreateRelay(db, "dev0", "func0", "", nil, time.Now().UTC(), models.RelayOptions{})
+	if err != nil {
+		t.Fatalf("TestWebhooksOutbox: %+v", err)
+	}
+	err = models.UpdateRelayStatus(db, relayId, models.RelayExpired)
+	if err != nil {
+		t.Fatalf("TestWebhooksOutbox: %+v", err)
+	}
+
+	// The dispatcher runs once on start
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.RunWebhookDispatcher(ctx, &myConfig, db)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	var deliveries []receivedDelivery
+	for len(deliveries) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		deliveries = receiver.take()
+	}
+	cancel()
+	<-done
+	if len(deliveries) != 1 || deliveries[0].event != "expired" {
+		t.Fatalf("TestWebhooksOutbox: want an expired delivery, got %+v", deliveries)
+	}
+}